@@ -0,0 +1,537 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An archive is a gzipped tar file holding a database file, image files
+// and manifest.json listing the checksum of every other file in it.
+// "backup" archives hold the whole service; "export" archives hold one
+// token with its images and items and are merged into the target
+// instance by restore.
+
+const (
+	archiveKindBackup = "backup"
+	archiveKindExport = "export"
+	archiveDatabase = "sqlite3.db"
+	archiveManifest = "manifest.json"
+)
+
+var imageDirs = []string{"images", "images/small", "images/previews"}
+
+type manifestFile struct {
+	Name string `json:"name"`
+	Size int64 `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type manifest struct {
+	Kind string `json:"kind"`
+	Created_at int64 `json:"created_at"`
+	Schema_version int `json:"schema_version"`
+	Token string `json:"token,omitempty"`
+	Files []manifestFile `json:"files"`
+}
+
+type archiveWriter struct {
+	file *os.File
+	gz *gzip.Writer
+	tw *tar.Writer
+	manifest manifest
+}
+
+func createArchive(path, kind string) (*archiveWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(file)
+	return &archiveWriter{
+		file: file,
+		gz: gz,
+		tw: tar.NewWriter(gz),
+		manifest: manifest{Kind: kind, Created_at: time.Now().Unix(), Files: []manifestFile{}},
+	}, nil
+}
+
+// addFile copies the file at path into the archive as name and records
+// its checksum in the manifest.
+func (a *archiveWriter) addFile(name, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = a.tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: stat.Size(),
+		ModTime: stat.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(a.tw, hash), file); err != nil {
+		return err
+	}
+	a.manifest.Files = append(a.manifest.Files, manifestFile{name, stat.Size(), hex.EncodeToString(hash.Sum(nil))})
+	return nil
+}
+
+// addBlob adds the original, small and preview files of a blob. Missing
+// small or preview files are skipped.
+func (a *archiveWriter) addBlob(blob_id string) error {
+	for _, dir := range imageDirs {
+		name := dir + "/" + blob_id + ".jpg"
+		if err := a.addFile(name, name); err != nil {
+			if os.IsNotExist(err) && dir != "images" {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// close writes the manifest and finishes the archive.
+func (a *archiveWriter) close() error {
+	content, err := json.MarshalIndent(a.manifest, "", "\t")
+	if err == nil {
+		err = a.tw.WriteHeader(&tar.Header{
+			Name: archiveManifest,
+			Mode: 0644,
+			Size: int64(len(content)),
+			ModTime: time.Unix(a.manifest.Created_at, 0),
+		})
+	}
+	if err == nil {
+		_, err = a.tw.Write(content)
+	}
+	for _, closer := range []io.Closer{a.tw, a.gz, a.file} {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// sqliteSnapshot writes a consistent copy of the live database to path.
+func sqliteSnapshot(path string) (int, error) {
+	s, ok := store.(*sqlStore)
+	if !ok || s.dialect != sqliteDialect {
+		return 0, fmt.Errorf("Backup is only supported for SQLite, use pg_dump for PostgreSQL\n")
+	}
+	version, err := readSchemaVersion(s.db, s.dialect)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = s.db.Exec("vacuum into ?", path); err != nil {
+		return 0, fmt.Errorf("Error creating database snapshot: %v\n", err)
+	}
+	return version, nil
+}
+
+// backup writes the database and every image file to an archive at path.
+func backup(path string) error {
+	dir, err := ioutil.TempDir("", "decety-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	snapshot := filepath.Join(dir, archiveDatabase)
+	version, err := sqliteSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	a, err := createArchive(path, archiveKindBackup)
+	if err != nil {
+		return err
+	}
+	a.manifest.Schema_version = version
+	if err = a.addFile(archiveDatabase, snapshot); err != nil {
+		a.close()
+		return err
+	}
+	for _, dir := range imageDirs {
+		names, err := filepath.Glob(dir + "/*.jpg")
+		if err != nil {
+			a.close()
+			return err
+		}
+		for _, name := range names {
+			// images uploaded after the snapshot are included too, they're
+			// harmless orphans in the restored instance; images deleted
+			// since the glob are skipped, addFile fails before writing
+			// anything for them
+			err = a.addFile(filepath.ToSlash(name), name)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				a.close()
+				return err
+			}
+		}
+	}
+	return a.close()
+}
+
+// export writes one token with its images and items to an archive at
+// path. The database in the archive is a fresh SQLite file, so tokens
+// can be moved between instances with any backend.
+func export(path, token string) error {
+	// the database is read as it is, and must be at this binary's schema
+	if s, ok := store.(*sqlStore); ok {
+		version, err := readSchemaVersion(s.db, s.dialect)
+		if err != nil {
+			return err
+		}
+		if version != s.dialect.latestVersion() {
+			return fmt.Errorf("Database schema version %d is outdated, run \"migrate up\"\n", version)
+		}
+	}
+	t, err := findToken(store, token)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "decety-export")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	target, err := openSQLiteStore(filepath.Join(dir, archiveDatabase))
+	if err != nil {
+		return err
+	}
+	blobs, err := copyToken(store, target, t)
+	target.Close()
+	if err != nil {
+		return err
+	}
+
+	a, err := createArchive(path, archiveKindExport)
+	if err != nil {
+		return err
+	}
+	a.manifest.Schema_version = sqliteDialect.latestVersion()
+	a.manifest.Token = token
+	if err = a.addFile(archiveDatabase, filepath.Join(dir, archiveDatabase)); err != nil {
+		a.close()
+		return err
+	}
+	added := map[string]bool{}
+	for _, blob_id := range blobs {
+		if added[blob_id] {
+			continue
+		}
+		added[blob_id] = true
+		if err = a.addBlob(blob_id); err != nil {
+			a.close()
+			return err
+		}
+	}
+	return a.close()
+}
+
+func findToken(s Store, token string) (tokenRow, error) {
+	tokens, err := s.ListTokens()
+	if err != nil {
+		return tokenRow{}, err
+	}
+	for _, t := range tokens {
+		if t.Token == token {
+			return t, nil
+		}
+	}
+	return tokenRow{}, fmt.Errorf("Token %v not exists\n", token)
+}
+
+// readToken reads a token with its images, items and the schemas of its
+// shop.
+func readToken(from Store, t tokenRow) (tokenCopy, error) {
+	c := tokenCopy{Token: t}
+	var err error
+	if c.Image_ids, err = from.ImagesByToken(t.Token); err != nil {
+		return c, err
+	}
+	if c.Blobs, err = from.ImageBlobs(t.Token); err != nil {
+		return c, err
+	}
+	if c.Items, err = from.ItemsByToken(t.Token); err != nil {
+		return c, err
+	}
+	schemas, err := from.ListSchemas()
+	if err != nil {
+		return c, err
+	}
+	for _, schema := range schemas {
+		if schema.Shop_id == t.Shop_id {
+			c.Schemas = append(c.Schemas, schema)
+		}
+	}
+	return c, nil
+}
+
+// copyToken copies a token with its images, items and schemas from one
+// store to another and returns the blobs of the copied images by
+// image_id. It fails without writing anything if the token, its shop_id
+// or one of its images already exists in the target.
+func copyToken(from, to Store, t tokenRow) (map[string]string, error) {
+	c, err := readToken(from, t)
+	if err != nil {
+		return nil, err
+	}
+	return c.Blobs, to.ImportToken(c)
+}
+
+// extractArchive unpacks the archive at path into dir and checks every
+// file against the manifest.
+func extractArchive(path, dir string) (manifest, error) {
+	var m manifest
+	file, err := os.Open(path)
+	if err != nil {
+		return m, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return m, err
+	}
+	tr := tar.NewReader(gz)
+
+	hashes := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, err
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if header.Typeflag != tar.TypeReg || filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return m, fmt.Errorf("Unexpected entry %v in archive\n", header.Name)
+		}
+
+		if header.Name == archiveManifest {
+			if err = json.NewDecoder(tr).Decode(&m); err != nil {
+				return m, fmt.Errorf("Error reading manifest: %v\n", err)
+			}
+			continue
+		}
+
+		target := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return m, err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return m, err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, hash), tr)
+		out.Close()
+		if err != nil {
+			return m, err
+		}
+		hashes[header.Name] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	if m.Kind != archiveKindBackup && m.Kind != archiveKindExport {
+		return m, fmt.Errorf("Archive has no valid manifest\n")
+	}
+	for _, f := range m.Files {
+		hash, ok := hashes[f.Name]
+		if !ok {
+			return m, fmt.Errorf("File %v listed in manifest is missing\n", f.Name)
+		}
+		if hash != f.Sha256 {
+			return m, fmt.Errorf("Checksum mismatch for %v\n", f.Name)
+		}
+		delete(hashes, f.Name)
+	}
+	for name := range hashes {
+		return m, fmt.Errorf("File %v is not listed in manifest\n", name)
+	}
+	return m, nil
+}
+
+// restore verifies an archive and then either replaces the database and
+// images with a backup or, for an export, adds the exported token to the
+// current store. A backup must be restored while the server is stopped,
+// and replaces an existing database only with force.
+func restore(path string, force bool) error {
+	dir, err := ioutil.TempDir(".", ".restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := extractArchive(path, dir)
+	if err != nil {
+		return err
+	}
+	if m.Schema_version > sqliteDialect.latestVersion() {
+		return fmt.Errorf("Archive schema version %d is newer than this binary supports (%d)\n",
+			m.Schema_version, sqliteDialect.latestVersion())
+	}
+
+	if m.Kind == archiveKindExport {
+		return importExport(dir, m)
+	}
+
+	if dialectForDSN(databaseDSN) != sqliteDialect {
+		return fmt.Errorf("Backup restore is only supported for SQLite\n")
+	}
+	if _, err = os.Stat(databaseDSN); err == nil && !force {
+		return fmt.Errorf("Database %v already exists, use -force to replace it\n", databaseDSN)
+	}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err = os.Remove(databaseDSN + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, f := range m.Files {
+		target := filepath.FromSlash(f.Name)
+		if f.Name == archiveDatabase {
+			target = databaseDSN
+		}
+		if err = os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return err
+		}
+		if err = os.Rename(filepath.Join(dir, filepath.FromSlash(f.Name)), target); err != nil {
+			return err
+		}
+	}
+	log.Printf("Restored backup from %v with %d files\n", time.Unix(m.Created_at, 0).UTC(), len(m.Files))
+	return nil
+}
+
+func importExport(dir string, m manifest) error {
+	from, err := openSQLiteStore(filepath.Join(dir, archiveDatabase))
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+	t, err := findToken(from, m.Token)
+	if err != nil {
+		return err
+	}
+
+	to, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+
+	c, err := readToken(from, t)
+	if err != nil {
+		return err
+	}
+
+	// the files are put in place before the rows referring to them are
+	// committed; the ones that weren't there are removed if that fails
+	placed := []string{}
+	removePlaced := func() {
+		for _, name := range placed {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				log.Print(err)
+			}
+		}
+	}
+	for _, f := range m.Files {
+		if f.Name == archiveDatabase {
+			continue
+		}
+		name := filepath.FromSlash(f.Name)
+		_, err = os.Stat(name)
+		existed := err == nil
+		if err = os.Rename(filepath.Join(dir, name), name); err != nil {
+			removePlaced()
+			return err
+		}
+		if !existed {
+			placed = append(placed, name)
+		}
+	}
+	if err = to.ImportToken(c); err != nil {
+		removePlaced()
+		return err
+	}
+	log.Printf("Imported token %v with %d images\n", t.Token, len(c.Image_ids))
+	signalServer()
+	return nil
+}
+
+// backupCommand implements "main backup <archive>".
+func backupCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: backup <archive.tar.gz>\n")
+	}
+	return backup(args[0])
+}
+
+// exportCommand implements "main export -token <token> <archive>".
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	token := flags.String("token", "", "token to export")
+	shop_id := flags.String("shop_id", "", "export the token of this shop")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || (*token == "") == (*shop_id == "") {
+		return fmt.Errorf("Usage: export -token <token> | -shop_id <shop_id> <archive.tar.gz>\n")
+	}
+
+	if *shop_id != "" {
+		tokens, err := store.ListTokens()
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			if t.Shop_id == *shop_id {
+				*token = t.Token
+			}
+		}
+		if *token == "" {
+			return fmt.Errorf("Shop id %v not exists\n", *shop_id)
+		}
+	}
+	return export(flags.Arg(0), *token)
+}
+
+// restoreCommand implements "main restore [-force] <archive>".
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	force := flags.Bool("force", false, "replace the existing database with a backup")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: restore [-force] <archive.tar.gz>\n")
+	}
+	return restore(flags.Arg(0), *force)
+}
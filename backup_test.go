@@ -0,0 +1,197 @@
+package main
+
+import (
+	"time"
+	"testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"archive/tar"
+	"compress/gzip"
+)
+
+// useSQLiteStore opens a store at databaseDSN in the current directory.
+func useSQLiteStore(t *testing.T) *sqlStore {
+	saved, savedDSN := store, databaseDSN
+	databaseDSN = "sqlite3.db"
+	s, err := openSQLiteStore(databaseDSN)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	store = s
+	t.Cleanup(func() {
+		s.Close()
+		store, databaseDSN = saved, savedDSN
+	})
+	return s
+}
+
+func fillBackupStore(t *testing.T, s Store) {
+	exp := time.Now().Add(time.Hour).Unix()
+	s.CreateToken(tokenRow{"t_1", exp, "", "1", 0})
+	s.CreateToken(tokenRow{"t_2", exp, "", "2", 0})
+	for _, id := range []string{"a", "b"} {
+		s.AddImage("t_1", id, id)
+		writeImageFiles(t, id)
+	}
+	s.AddImage("t_2", "c", "c")
+	writeImageFiles(t, "c")
+	s.AddItem(itemRow{Token: "t_1", Shop_id: "1", itemKey: itemKey{Item_id: "shirt"}, Type: "1",
+		Params: testParams(1), Image_ids: []string{"b", "a"}, Requests_count: 7})
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir := chdirTemp(t)
+	s := useSQLiteStore(t)
+	fillBackupStore(t, s)
+
+	archive := filepath.Join(dir, "backup.tar.gz")
+	if err := backup(archive); err != nil {
+		t.Fatalf("Error backup: %v", err)
+	}
+	s.DeleteToken("t_1")
+	s.Close()
+
+	if err := restore(archive, false); err == nil {
+		t.Fatalf("Restored over an existing database without -force")
+	}
+	os.RemoveAll("images")
+	if err := restore(archive, true); err != nil {
+		t.Fatalf("Error restore: %v", err)
+	}
+
+	s = useSQLiteStore(t)
+	items, err := s.ItemsByToken("t_1")
+	if err != nil || len(items) != 1 || items[0].Requests_count != 7 || len(items[0].Image_ids) != 2 {
+		t.Fatalf("Wrong items after restore: %v, %v", items, err)
+	}
+	if _, err = os.Stat("images/small/c.jpg"); err != nil {
+		t.Fatalf("Image file not restored: %v", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	dir := chdirTemp(t)
+	s := useSQLiteStore(t)
+	fillBackupStore(t, s)
+
+	archive := filepath.Join(dir, "export.tar.gz")
+	// the export reads the database while the store still has it open
+	if err := run([]string{"export", "-shop_id", "1", archive}); err != nil {
+		t.Fatalf("Error export: %v", err)
+	}
+	if err := restore(archive, false); err == nil {
+		t.Fatalf("Imported a token that already exists")
+	}
+
+	// import into an empty instance
+	chdirTemp(t)
+	s = useSQLiteStore(t)
+	// a conflict found while committing leaves neither rows nor files
+	s.CreateToken(tokenRow{"other", time.Now().Add(time.Hour).Unix(), "", "1", 0})
+	if err := restore(archive, false); err == nil {
+		t.Fatalf("Imported a shop id that already exists")
+	}
+	if ok, _ := s.TokenExists("t_1"); ok {
+		t.Fatalf("Failed import left the token")
+	}
+	if _, err := os.Stat("images/a.jpg"); err == nil {
+		t.Fatalf("Failed import left image files")
+	}
+	s.DeleteToken("other")
+	if err := restore(archive, false); err != nil {
+		t.Fatalf("Error import: %v", err)
+	}
+	if ok, _ := s.TokenExists("t_2"); ok {
+		t.Fatalf("Exported a token that wasn't asked for")
+	}
+	items, err := s.ItemsByToken("t_1")
+	if err != nil || len(items) != 1 || items[0].Image_ids[0] != "b" {
+		t.Fatalf("Wrong items after import: %v, %v", items, err)
+	}
+	for _, name := range []string{"images/a.jpg", "images/previews/b.jpg"} {
+		if _, err = os.Stat(name); err != nil {
+			t.Fatalf("Image file not imported: %v", err)
+		}
+	}
+	if _, err = os.Stat("images/c.jpg"); err == nil {
+		t.Fatalf("Imported an image of another token")
+	}
+}
+
+func TestBackupReadOnly(t *testing.T) {
+	dir := chdirTemp(t)
+	db, err := sqliteDialect.open(databaseDSN)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	if err = migrateUp(db, sqliteDialect, 5); err != nil {
+		t.Fatalf("Error migrateUp: %v", err)
+	}
+	db.Close()
+
+	// an outdated database is backed up as it is, not migrated first
+	archive := filepath.Join(dir, "backup.tar.gz")
+	if err = run([]string{"backup", archive}); err != nil {
+		t.Fatalf("Error backup: %v", err)
+	}
+	m, err := extractArchive(archive, filepath.Join(dir, "x"))
+	if err != nil || m.Schema_version != 5 {
+		t.Fatalf("Wrong backup of an outdated database: %v, %v", m.Schema_version, err)
+	}
+	if err = run([]string{"export", "-token", "t_1", archive}); err == nil {
+		t.Fatalf("Exported from an outdated database")
+	}
+
+	db, _ = sqliteDialect.open(databaseDSN)
+	defer db.Close()
+	if version, _ := getSchemaVersion(db); version != 5 {
+		t.Fatalf("Backup migrated the database to %d", version)
+	}
+}
+
+func TestRestoreChecksum(t *testing.T) {
+	dir := chdirTemp(t)
+	s := useSQLiteStore(t)
+	fillBackupStore(t, s)
+
+	archive := filepath.Join(dir, "export.tar.gz")
+	if err := export(archive, "t_1"); err != nil {
+		t.Fatalf("Error export: %v", err)
+	}
+
+	// rewrite the archive with one image changed
+	extracted, _ := ioutil.TempDir(dir, "x")
+	m, err := extractArchive(archive, extracted)
+	if err != nil {
+		t.Fatalf("Error extractArchive: %v", err)
+	}
+	ioutil.WriteFile(filepath.Join(extracted, "images", "a.jpg"), []byte("png"), 0644)
+	a, _ := createArchive(archive, m.Kind)
+	for _, f := range m.Files {
+		a.addFile(f.Name, filepath.Join(extracted, filepath.FromSlash(f.Name)))
+	}
+	a.manifest = m
+	a.close()
+
+	s.DeleteToken("t_1")
+	if err = restore(archive, false); err == nil {
+		t.Fatalf("Restored an archive with a wrong checksum")
+	}
+	if ok, _ := s.TokenExists("t_1"); ok {
+		t.Fatalf("Partially restored an archive with a wrong checksum")
+	}
+
+	// entries outside the target directory are rejected
+	file, _ := os.Create(archive)
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "../evil", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	tw.Write([]byte("x"))
+	tw.Close()
+	gz.Close()
+	file.Close()
+	if err = restore(archive, false); err == nil {
+		t.Fatalf("Restored an archive with a path outside the target")
+	}
+}
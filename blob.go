@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Uploaded images are stored once per content, as a blob named by the
+// SHA-256 of the stored JPEG: images/<blob_id>.jpg with its small and
+// preview versions. Every upload still gets its own image_id, and the
+// store records the blob each image refers to. A blob's files are
+// removed when the last image referring to it is deleted.
+//
+// The store keeps a row per blob, which "main gc" and the server lock
+// alike: an image is only added to a blob that isn't being removed, and
+// a blob is only marked as being removed while no image refers to it.
+// Files are written after the blob's first image is added and removed
+// after the blob is marked, so neither runs while the other holds it.
+
+// how often, and how many times, an upload waits for the removal of the
+// files of its blob to finish
+const (
+	blobRemovingWait = 50 * time.Millisecond
+	blobRemovingRetries = 100
+)
+
+type blobLock struct {
+	sync.Mutex
+	users int
+}
+
+var (
+	blobLocksMu sync.Mutex
+	blobLocks = map[string]*blobLock{}
+)
+
+// lockBlob serializes uploads of the same content within the server, so
+// that an upload sharing a new blob doesn't return before its files are
+// written. It returns the unlock function.
+func lockBlob(blob_id string) func() {
+	blobLocksMu.Lock()
+	l, ok := blobLocks[blob_id]
+	if !ok {
+		l = &blobLock{}
+		blobLocks[blob_id] = l
+	}
+	l.users++
+	blobLocksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		blobLocksMu.Lock()
+		if l.users--; l.users == 0 {
+			delete(blobLocks, blob_id)
+		}
+		blobLocksMu.Unlock()
+	}
+}
+
+func blobID(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// addImage adds image_id to the token referring to the blob of data, an
+// image as readUpload returns it, and stores data unless an image with
+// the same content is stored already.
+func addImage(token, image_id string, data []byte) error {
+	blob_id := blobID(data)
+	unlock := lockBlob(blob_id)
+	defer unlock()
+
+	created, err := store.AddImage(token, image_id, blob_id)
+	for retries := 0; err == errBlobRemoving && retries < blobRemovingRetries; retries++ {
+		time.Sleep(blobRemovingWait)
+		created, err = store.AddImage(token, image_id, blob_id)
+	}
+	if err != nil || !created {
+		return err
+	}
+
+	// files left by a failed upload are overwritten
+	if err = ioutil.WriteFile("images/" + blob_id + ".jpg", data, 0644); err != nil {
+		err = fmt.Errorf("Error writing image: %v\n", err)
+	} else {
+		err = generateSmallImageAndPreview(blob_id)
+	}
+	if err != nil {
+		if _, err := store.DeleteOrphanedImage(image_id); err != nil {
+			log.Print(err)
+		} else if err := releaseBlob(blob_id); err != nil {
+			log.Print(err)
+		}
+	}
+	return err
+}
+
+// releaseBlobs removes the files of the blobs no image refers to anymore.
+func releaseBlobs(blob_ids []string) error {
+	for _, blob_id := range blob_ids {
+		unlock := lockBlob(blob_id)
+		err := releaseBlob(blob_id)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func releaseBlob(blob_id string) error {
+	released, err := store.ReleaseBlob(blob_id)
+	if err != nil || !released {
+		return err
+	}
+	removeBlobFiles(blob_id)
+	return store.DeleteBlob(blob_id)
+}
+
+func removeBlobFiles(blob_id string) {
+	for _, dir := range []string{"images/", "images/small/", "images/previews/"} {
+		if err := os.Remove(dir + blob_id + ".jpg"); err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	}
+	if resizedImages != nil {
+		resizedImages.removeBlob(blob_id)
+	}
+}
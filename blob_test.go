@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlobReferences(t *testing.T) {
+	dir := chdirTemp(t)
+	s := useMemoryStore(t)
+	for _, token := range []string{"t_1", "t_2"} {
+		s.CreateToken(tokenRow{token, time.Now().Add(time.Hour).Unix(), "", token, 0})
+	}
+	writeTestJPEG(t, dir + "/sample.jpg", 30, 20)
+	data, _ := ioutil.ReadFile(dir + "/sample.jpg")
+	blob_id := blobID(data)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := addImage("t_1", "img" + strconv.Itoa(i), data); err != nil {
+				t.Errorf("addImage: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := addImage("t_2", "other", data); err != nil {
+		t.Fatalf("addImage: %v", err)
+	}
+	if files, _ := ioutil.ReadDir("images/small"); len(files) != 1 {
+		t.Fatalf("%d stored files for one content", len(files))
+	}
+	if references, _ := s.BlobReferences(blob_id); references != 11 {
+		t.Fatalf("%d references to the blob, expected 11", references)
+	}
+	if got, _ := s.ImageBlob("other"); got != blob_id {
+		t.Fatalf("Image stored as %v, expected %v", got, blob_id)
+	}
+
+	// the blob outlives the token that uploaded it first
+	s.TrashToken("t_1")
+	if _, err := purgeTrashedTokens(-time.Minute); err != nil {
+		t.Fatalf("purgeTrashedTokens: %v", err)
+	}
+	if _, err := os.Stat("images/" + blob_id + ".jpg"); err != nil {
+		t.Fatalf("Blob removed while referenced")
+	}
+
+	if _, err := collectOrphanedImages(-time.Minute, false); err != nil {
+		t.Fatalf("collectOrphanedImages: %v", err)
+	}
+	for _, dir := range []string{"images/", "images/small/", "images/previews/"} {
+		if _, err := os.Stat(dir + blob_id + ".jpg"); !os.IsNotExist(err) {
+			t.Fatalf("Unreferenced blob left in %v", dir)
+		}
+	}
+}
+
+func TestBlobRemoval(t *testing.T) {
+	dir := chdirTemp(t)
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1", 0})
+	writeTestJPEG(t, dir + "/sample.jpg", 30, 20)
+	data, _ := ioutil.ReadFile(dir + "/sample.jpg")
+	blob_id := blobID(data)
+	if err := addImage("t_1", "img1", data); err != nil {
+		t.Fatalf("addImage: %v", err)
+	}
+	s.DeleteOrphanedImage("img1")
+
+	// another process marks the blob and is slow to remove its files
+	if released, _ := s.ReleaseBlob(blob_id); !released {
+		t.Fatalf("Unreferenced blob not released")
+	}
+	done := make(chan error)
+	go func() {
+		done <- addImage("t_1", "img2", data)
+	}()
+	time.Sleep(3 * blobRemovingWait)
+	select {
+	case err := <-done:
+		t.Fatalf("Upload didn't wait for the removal: %v", err)
+	default:
+	}
+	removeBlobFiles(blob_id)
+	s.DeleteBlob(blob_id)
+
+	if err := <-done; err != nil {
+		t.Fatalf("addImage: %v", err)
+	}
+	if _, err := os.Stat("images/small/" + blob_id + ".jpg"); err != nil {
+		t.Fatalf("Blob files not stored again: %v", err)
+	}
+}
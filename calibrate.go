@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Normalizations of calibrateWeights. Both make params with large values
+// (or spread) count less, so that every param weighs about the same in
+// the distance, and scale the weights to unit length.
+const (
+	calibrateInverseMean = "mean"
+	calibrateInverseStd = "std"
+)
+
+// calibrateWeights computes a weight per column of data.
+func calibrateWeights(data [][]float64, method string) ([]float64, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("No data to calibrate with\n")
+	}
+	n := len(data[0])
+	weights := make([]float64, n)
+	for i := 0; i < n; i++ {
+		mean := 0.0
+		for _, row := range data {
+			mean += row[i]
+		}
+		mean /= float64(len(data))
+
+		var value float64
+		switch method {
+		case calibrateInverseMean:
+			value = mean
+		case calibrateInverseStd:
+			for _, row := range data {
+				value += (row[i] - mean) * (row[i] - mean)
+			}
+			value = math.Sqrt(value / float64(len(data)))
+		default:
+			return nil, fmt.Errorf("Unknown method %v\n", method)
+		}
+		if value == 0 {
+			return nil, fmt.Errorf("Can't calibrate param %d: its %v is 0\n", i + 1, method)
+		}
+		weights[i] = 1 / math.Abs(value)
+	}
+
+	norm := 0.0
+	for _, w := range weights {
+		norm += w * w
+	}
+	norm = math.Sqrt(norm)
+	for i := range weights {
+		weights[i] /= norm
+	}
+	return weights, nil
+}
+
+// shopItems returns the items of the active tokens of a shop, or of all
+// shops if shop_id is empty, in a category.
+func shopItems(shop_id, category string) ([]itemRow, error) {
+	tokens, err := store.ListTokens()
+	if err != nil {
+		return nil, err
+	}
+	items := []itemRow{}
+	for _, t := range tokens {
+		if t.Deleted_at != 0 || (shop_id != "" && t.Shop_id != shop_id) {
+			continue
+		}
+		rows, err := store.ItemsByToken(t.Token)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range rows {
+			if item.Category == category {
+				items = append(items, item)
+			}
+		}
+	}
+	return items, nil
+}
+
+// itemVectors returns the params of items in schema order, skipping the
+// ones that lack some.
+func itemVectors(items []itemRow, schema paramSchema) [][]float64 {
+	data := [][]float64{}
+	for _, item := range items {
+		if vector, ok := schema.vector(item.Params); ok {
+			data = append(data, vector)
+		}
+	}
+	return data
+}
+
+// readCalibrationCSV reads the columns named like the schema's params
+// from a CSV file with a header row. Other columns are ignored.
+func readCalibrationCSV(path string, schema paramSchema) ([][]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %v: %v\n", path, err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %v: %v\n", path, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%v is empty\n", path)
+	}
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	data := [][]float64{}
+	for line, record := range records[1:] {
+		row := make([]float64, len(schema.Params))
+		for i, p := range schema.Params {
+			column, ok := columns[p.Name]
+			if !ok {
+				return nil, fmt.Errorf("%v has no column %v\n", path, p.Name)
+			}
+			row[i], err = strconv.ParseFloat(strings.TrimSpace(record[column]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %v on line %d of %v\n", p.Name, line + 2, path)
+			}
+		}
+		data = append(data, row)
+	}
+	return data, nil
+}
+
+// bestMatchChanges reports for how many of the queries, against every
+// item of items, the best matching type differs between the current and
+// the calibrated schema.
+func bestMatchChanges(items []itemRow, queries [][]float64, current, calibrated paramSchema) (changed, total int) {
+	byKey := map[indexKey][]itemRow{}
+	for _, item := range items {
+		k := indexKey{item.Shop_id, item.itemKey}
+		byKey[k] = append(byKey[k], item)
+	}
+
+	names := current.names()
+	for _, query := range queries {
+		params := map[string]float64{}
+		for i, name := range names {
+			params[name] = query[i]
+		}
+		for k, types := range byKey {
+			before := rankTypes(k.Shop_id, types, current, params, 1)
+			after := rankTypes(k.Shop_id, types, calibrated, params, 1)
+			if len(before) == 0 || len(after) == 0 {
+				continue
+			}
+			total++
+			if before[0].Type != after[0].Type {
+				changed++
+			}
+		}
+	}
+	return changed, total
+}
+
+// calibrateCommand implements "main calibrate [-shop_id id] [-category c]
+// [-csv file] [-method mean|std] [-save]".
+func calibrateCommand(args []string) error {
+	flags := flag.NewFlagSet("calibrate", flag.ContinueOnError)
+	shop_id := flags.String("shop_id", "", "calibrate with the items of this shop, all shops if empty")
+	category := flags.String("category", "", "calibrate the schema of this category")
+	csvPath := flags.String("csv", "", "calibrate with the measurements in this CSV file instead of the items")
+	method := flags.String("method", calibrateInverseMean, "normalize by the inverse mean or inverse std of each param")
+	save := flags.Bool("save", false, "save the weights as the schema of the shop and category")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("Usage: calibrate [-shop_id id] [-category c] [-csv file] [-method mean|std] [-save]\n")
+	}
+	if *save && *shop_id == "" {
+		return fmt.Errorf("-save needs a -shop_id\n")
+	}
+
+	schema, err := schemaFor(*shop_id, *category)
+	if err != nil {
+		return err
+	}
+	items, err := shopItems(*shop_id, *category)
+	if err != nil {
+		return err
+	}
+	var data [][]float64
+	if *csvPath != "" {
+		data, err = readCalibrationCSV(*csvPath, schema)
+	} else {
+		data = itemVectors(items, schema)
+	}
+	if err != nil {
+		return err
+	}
+
+	weights, err := calibrateWeights(data, *method)
+	if err != nil {
+		return err
+	}
+	calibrated := paramSchema{*shop_id, *category, append([]paramDef{}, schema.Params...)}
+	for i := range calibrated.Params {
+		calibrated.Params[i].Weight = weights[i]
+		fmt.Printf("%-12s %.8f (was %.8f)\n", calibrated.Params[i].Name, weights[i], schema.Params[i].Weight)
+	}
+	log.Printf("Calibrated with %d measurements\n", len(data))
+
+	changed, total := bestMatchChanges(items, data, schema, calibrated)
+	if total > 0 {
+		log.Printf("Best match changes for %d of %d lookups (%.1f%%)\n", changed, total, 100 * float64(changed) / float64(total))
+	}
+
+	if *save {
+		if err = store.SaveSchema(calibrated); err != nil {
+			return err
+		}
+		log.Printf("Saved the schema of shop %v, category %q\n", *shop_id, *category)
+		signalServer()
+	}
+	return nil
+}
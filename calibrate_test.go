@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCalibrateWeights(t *testing.T) {
+	data := [][]float64{{1, 10, 4}, {3, 30, 4}}
+	tests := []struct {
+		method string
+		want []float64
+	}{
+		// 1 / {2, 20, 4}, normalized
+		{calibrateInverseMean, []float64{0.8909, 0.0891, 0.4454}},
+		{calibrateInverseStd, nil},
+		{"median", nil},
+	}
+	for _, test := range tests {
+		weights, err := calibrateWeights(data, test.method)
+		if (err == nil) != (test.want != nil) {
+			t.Errorf("%v: calibrateWeights returned %v, %v", test.method, weights, err)
+			continue
+		}
+		for i := range test.want {
+			if math.Abs(weights[i] - test.want[i]) > 1e-4 {
+				t.Errorf("%v: wrong weights %v", test.method, weights)
+			}
+		}
+	}
+
+	data[1][2] = 8
+	weights, err := calibrateWeights(data, calibrateInverseStd)
+	// 1 / {1, 10, 2}, normalized
+	if err != nil || math.Abs(weights[0] - 0.8909) > 1e-4 || math.Abs(weights[1] - 0.0891) > 1e-4 {
+		t.Errorf("Wrong std weights %v, %v", weights, err)
+	}
+}
+
+func TestReadCalibrationCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.csv")
+	ioutil.WriteFile(path, []byte("name,waist,inseam\nA, 80,70\nB,90,75.5\n"), 0644)
+
+	schema := paramSchema{Params: []paramDef{{"inseam", "cm", 1, 0, 0}, {"waist", "cm", 1, 0, 0}}}
+	data, err := readCalibrationCSV(path, schema)
+	if err != nil || len(data) != 2 || data[0][0] != 70 || data[1][1] != 90 {
+		t.Fatalf("readCalibrationCSV returned %v, %v", data, err)
+	}
+	schema.Params = append(schema.Params, paramDef{"hips", "cm", 1, 0, 0})
+	if _, err = readCalibrationCSV(path, schema); err == nil {
+		t.Fatalf("Missing column accepted")
+	}
+}
+
+func TestCalibrateCommand(t *testing.T) {
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1234", 0})
+	key := itemKey{Item_id: "shirt"}
+	for i := 1; i <= 3; i++ {
+		params := testParams(float64(i * 10))
+		params[paramNames[0]] = float64(i * 100)
+		s.AddItem(itemRow{Token: "t_1", Shop_id: "1234", itemKey: key, Type: string(rune('0' + i)), Params: params})
+	}
+
+	if err := calibrateCommand([]string{"-save"}); err == nil {
+		t.Fatalf("-save without -shop_id accepted")
+	}
+	if err := calibrateCommand([]string{"-shop_id", "1234", "-save"}); err != nil {
+		t.Fatalf("Error calibrateCommand: %v", err)
+	}
+	schema, found, err := s.GetSchema("1234", "")
+	if err != nil || !found {
+		t.Fatalf("Schema not saved: %v", err)
+	}
+	// the first param is 10 times larger, so it weighs 10 times less
+	weights := schema.weights()
+	if math.Abs(weights[1] / weights[0] - 10) > 1e-9 || schema.Params[0].Unit != paramUnit {
+		t.Fatalf("Wrong calibrated schema %v", schema)
+	}
+}
+
+func TestBestMatchChanges(t *testing.T) {
+	key := itemKey{Item_id: "shirt"}
+	items := []itemRow{
+		{Shop_id: "1", itemKey: key, Type: "1", Params: map[string]float64{"a": 0, "b": 10}},
+		{Shop_id: "1", itemKey: key, Type: "2", Params: map[string]float64{"a": 10, "b": 0}},
+	}
+	current := paramSchema{Params: []paramDef{{"a", "", 1, 0, 0}, {"b", "", 1, 0, 0}}}
+	calibrated := paramSchema{Params: []paramDef{{"a", "", 1, 0, 0}, {"b", "", 0.1, 0, 0}}}
+
+	// (4, 2) is nearer to type 2 until b counts less
+	changed, total := bestMatchChanges(items, [][]float64{{4, 2}, {0, 10}}, current, calibrated)
+	if changed != 1 || total != 2 {
+		t.Fatalf("bestMatchChanges returned %d of %d", changed, total)
+	}
+}
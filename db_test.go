@@ -76,16 +76,16 @@ func benchUpdating(t *testing.T) {
 						"color": strconv.Itoa(j),
 						"type": strconv.Itoa(h),
 						"size": "M",
-						"d1": fmt.Sprint(rand.Float64()),
-						"d2": fmt.Sprint(rand.Float64()),
-						"d3": fmt.Sprint(rand.Float64()),
-						"d4": fmt.Sprint(rand.Float64()),
-						"d5": fmt.Sprint(rand.Float64()),
+						"d1": fmt.Sprint(1600 + rand.Float64() * 300),
+						"d2": fmt.Sprint(700 + rand.Float64() * 800),
+						"d3": fmt.Sprint(900 + rand.Float64() * 600),
+						"d4": fmt.Sprint(900 + rand.Float64() * 600),
+						"d5": fmt.Sprint(300 + rand.Float64() * 200),
 						"image_ids": strings.Join(ids, ","),
 					}
 					resp, body := request(baseURL + "update", "POST", data, map[string]string{})
 
-					if resp.StatusCode != 200 || string(body) != `{"error":"","result":""}` {
+					if resp.StatusCode != 200 || string(body) != `{"error":"","result":"","status":"created"}` {
 						t.Fatalf("Failed updating data")
 					}
 
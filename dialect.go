@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"strconv"
+	"database/sql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// dialect holds what differs between the SQL databases we support.
+type dialect struct {
+	name string
+}
+
+var (
+	sqliteDialect = &dialect{"sqlite3"}
+	postgresDialect = &dialect{"postgres"}
+)
+
+// dialectForDSN picks PostgreSQL for postgres:// URLs and key=value
+// connection strings, and SQLite (where the DSN is a file path) otherwise.
+func dialectForDSN(dsn string) *dialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") ||
+		strings.Contains(dsn, "dbname=") {
+		return postgresDialect
+	}
+	return sqliteDialect
+}
+
+func (d *dialect) open(dsn string) (*sql.DB, error) {
+	if d == sqliteDialect {
+		// Foreign keys are off by default in SQLite. WAL lets readers run
+		// alongside a writer, and immediate transactions take the write
+		// lock up front so concurrent writers wait for the busy timeout
+		// instead of failing on lock upgrade.
+		dsn = fmt.Sprintf("file:%s?_foreign_keys=1&_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate",
+			dsn, sqliteBusyTimeout.Milliseconds())
+	}
+	return d.openDSN(dsn)
+}
+
+// openReadOnly opens a database that can't be written to, not even to
+// switch SQLite to WAL.
+func (d *dialect) openReadOnly(dsn string) (*sql.DB, error) {
+	switch {
+	case d == sqliteDialect:
+		dsn = fmt.Sprintf("file:%s?mode=ro&_busy_timeout=%d", dsn, sqliteBusyTimeout.Milliseconds())
+	case strings.Contains(dsn, "://") && strings.Contains(dsn, "?"):
+		dsn += "&default_transaction_read_only=on"
+	case strings.Contains(dsn, "://"):
+		dsn += "?default_transaction_read_only=on"
+	default:
+		dsn += " default_transaction_read_only=on"
+	}
+	return d.openDSN(dsn)
+}
+
+func (d *dialect) openDSN(dsn string) (*sql.DB, error) {
+	db, err := sql.Open(d.name, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening database: %v\n", err)
+	}
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(dbMaxIdleConns)
+	db.SetConnMaxLifetime(dbConnMaxLifetime)
+	return db, nil
+}
+
+// rebind replaces "?" placeholders with "$1", "$2"... for PostgreSQL.
+func (d *dialect) rebind(query string) string {
+	if d != postgresDialect {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// forUpdate locks the rows a select reads until the transaction ends.
+// SQLite transactions take the lock of the whole database up front.
+func (d *dialect) forUpdate(query string) string {
+	if d != postgresDialect {
+		return query
+	}
+	return query + " for update"
+}
+
+func (d *dialect) migrations() []migration {
+	if d == postgresDialect {
+		return postgresMigrations
+	}
+	return sqliteMigrations
+}
+
+func (d *dialect) latestVersion() int {
+	m := d.migrations()
+	return m[len(m)-1].version
+}
+
+// tableColumns returns the set of column names of table, which is empty
+// if the table doesn't exist.
+func (d *dialect) tableColumns(q querier, table string) (map[string]bool, error) {
+	columns := map[string]bool{}
+	if d == postgresDialect {
+		rows, err := q.Query(`select column_name from information_schema.columns
+			where table_schema = current_schema() AND table_name = $1`, table)
+		if err != nil {
+			return nil, fmt.Errorf("Error query execution: %v\n", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err = rows.Scan(&name); err != nil {
+				return nil, err
+			}
+			columns[name] = true
+		}
+		return columns, rows.Err()
+	}
+
+	rows, err := q.Query("pragma table_info(" + table + ")")
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, type_ string
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &type_, &notnull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+// collectOrphanedImages deletes the images that no item refers to and
+// that were uploaded more than grace ago, with their files. In dry run
+// mode it only returns what it would delete.
+func collectOrphanedImages(grace time.Duration, dryRun bool) ([]string, error) {
+	image_ids, err := store.OrphanedImages(time.Now().Add(-grace).Unix())
+	if err != nil || dryRun {
+		return image_ids, err
+	}
+
+	removed := []string{}
+	for _, image_id := range image_ids {
+		blob_id, err := store.ImageBlob(image_id)
+		if err != nil {
+			return removed, err
+		}
+		// the image may have been added to an item since the query
+		deleted, err := store.DeleteOrphanedImage(image_id)
+		if err != nil {
+			return removed, err
+		}
+		if deleted {
+			if err = releaseBlobs([]string{blob_id}); err != nil {
+				return removed, err
+			}
+			removed = append(removed, image_id)
+		}
+	}
+	// blobs left unreferenced by removals that stopped halfway
+	blob_ids, err := store.UnreferencedBlobs()
+	if err != nil {
+		return removed, err
+	}
+	return removed, releaseBlobs(blob_ids)
+}
+
+// startImageCollector runs collectOrphanedImages every
+// orphanSweepInterval until the process exits.
+func startImageCollector() {
+	if orphanSweepInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(orphanSweepInterval) {
+			removed, err := collectOrphanedImages(orphanGracePeriod, false)
+			if err != nil {
+				log.Printf("Error collecting orphaned images: %v\n", err)
+			}
+			if len(removed) > 0 {
+				log.Printf("Removed %d orphaned images\n", len(removed))
+			}
+		}
+	}()
+}
+
+// gcCommand implements "main gc [-grace duration] [-dry-run]".
+func gcCommand(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	grace := flags.Duration("grace", orphanGracePeriod, "only remove images uploaded longer ago than this")
+	dryRun := flags.Bool("dry-run", false, "list orphaned images without removing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	image_ids, err := collectOrphanedImages(*grace, *dryRun)
+	for _, image_id := range image_ids {
+		fmt.Println(image_id)
+	}
+	if *dryRun {
+		log.Printf("%d orphaned images would be removed\n", len(image_ids))
+	} else {
+		log.Printf("Removed %d orphaned images\n", len(image_ids))
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+	"testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// chdirTemp runs the test in an empty directory with the images/
+// layout the handlers expect.
+func chdirTemp(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "decety-images")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	os.MkdirAll(filepath.Join("images", "previews"), os.ModePerm)
+	os.MkdirAll(filepath.Join("images", "small"), os.ModePerm)
+	return dir
+}
+
+func writeImageFiles(t *testing.T, image_id string) {
+	for _, dir := range []string{"images/", "images/small/", "images/previews/"} {
+		if err := ioutil.WriteFile(dir + image_id + ".jpg", []byte("jpg"), 0644); err != nil {
+			t.Fatalf("Error writing file: %v", err)
+		}
+	}
+}
+
+func TestCollectOrphanedImages(t *testing.T) {
+	chdirTemp(t)
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1", 0})
+	for _, id := range []string{"used", "orphan"} {
+		s.AddImage("t_1", id, id)
+		writeImageFiles(t, id)
+	}
+	s.AddItem(itemRow{Token: "t_1", itemKey: itemKey{Item_id: "shirt"}, Type: "1",
+		Params: testParams(0), Image_ids: []string{"used"}})
+
+	if removed, _ := collectOrphanedImages(time.Hour, false); len(removed) != 0 {
+		t.Fatalf("Removed images inside the grace period: %v", removed)
+	}
+	removed, err := collectOrphanedImages(-time.Minute, true)
+	if err != nil || len(removed) != 1 || removed[0] != "orphan" {
+		t.Fatalf("Dry run returned %v, %v", removed, err)
+	}
+	if ok, _ := s.ImageExists("orphan"); !ok {
+		t.Fatalf("Dry run removed the image")
+	}
+
+	removed, err = collectOrphanedImages(-time.Minute, false)
+	if err != nil || len(removed) != 1 || removed[0] != "orphan" {
+		t.Fatalf("Collector returned %v, %v", removed, err)
+	}
+	if ok, _ := s.ImageExists("orphan"); ok {
+		t.Fatalf("Orphaned image row not removed")
+	}
+	if _, err = os.Stat("images/small/orphan.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("Orphaned image file not removed")
+	}
+	if _, err = os.Stat("images/used.jpg"); err != nil {
+		t.Fatalf("Referenced image file removed")
+	}
+}
+
+func TestOrphanedImagesSQL(t *testing.T) {
+	s := openTestStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1", 0})
+	s.AddImage("t_1", "used", "used")
+	s.AddImage("t_1", "orphan", "orphan")
+	s.AddItem(itemRow{Token: "t_1", itemKey: itemKey{Item_id: "shirt"}, Type: "1",
+		Params: testParams(0), Image_ids: []string{"used"}})
+
+	image_ids, err := s.OrphanedImages(time.Now().Add(time.Minute).Unix())
+	if err != nil || len(image_ids) != 1 || image_ids[0] != "orphan" {
+		t.Fatalf("OrphanedImages returned %v, %v", image_ids, err)
+	}
+	if deleted, _ := s.DeleteOrphanedImage("used"); deleted {
+		t.Fatalf("Deleted a referenced image")
+	}
+	if deleted, _ := s.DeleteOrphanedImage("orphan"); !deleted {
+		t.Fatalf("Orphaned image not deleted")
+	}
+}
@@ -1,10 +1,14 @@
 module decety-api
 
-go 1.16
+go 1.18
 
 require (
-	github.com/gorilla/mux v1.8.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.7 // indirect
-	github.com/satori/go.uuid v1.2.0 // indirect
-	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba // indirect
+	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.7
+	github.com/satori/go.uuid v1.2.0
+	golang.org/x/image v0.18.0
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
 )
+
+require gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+
+	_ "golang.org/x/image/webp"
+)
+
+// uploadFormats are the image types uploads may be, by the content type
+// http.DetectContentType sniffs, and the name image.Decode reports for
+// them.
+var uploadFormats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png": "png",
+	"image/webp": "webp",
+}
+
+// resizeSpec describes one resized version of an uploaded image. With
+// Crop the image is cut to the aspect ratio of Width x Height around its
+// center and scaled to exactly that size. Without it, it's scaled to fit
+// in Width x Height keeping its aspect ratio, where 0 means unbounded,
+// and never scaled up.
+type resizeSpec struct {
+	Width int
+	Height int
+	Crop bool
+	Quality int
+}
+
+// ImageProcessor writes resized versions of uploaded images.
+type ImageProcessor interface {
+	// Resize reads the image at src and writes it resized to dst as
+	// JPEG. It returns errInvalidImage if src can't be decoded.
+	Resize(src, dst string, spec resizeSpec) error
+}
+
+var (
+	errInvalidImage = errors.New("Invalid image\n")
+	errImageTooLarge = errors.New("Image too large\n")
+)
+
+// readUpload checks that an upload is an image of uploadFormats within
+// the size limits and returns it as the JPEG to store. JPEGs are stored
+// as they are, other formats converted.
+func readUpload(upload io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(upload, maxUploadBytes + 1))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading upload: %v\n", err)
+	}
+	if int64(len(data)) > maxUploadBytes {
+		return nil, errImageTooLarge
+	}
+
+	format, ok := uploadFormats[http.DetectContentType(data)]
+	if !ok {
+		return nil, errInvalidImage
+	}
+	// the header is checked before decoding, which allocates by it
+	config, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || decoded != format {
+		return nil, errInvalidImage
+	}
+	if config.Width > maxImageSide || config.Height > maxImageSide || config.Width * config.Height > maxImagePixels {
+		return nil, errImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errInvalidImage
+	}
+
+	if format != "jpeg" {
+		// JPEG has no alpha, so transparent parts become white
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		var buffer bytes.Buffer
+		if err = jpeg.Encode(&buffer, flat, &jpeg.Options{Quality: storedImageQuality}); err != nil {
+			return nil, fmt.Errorf("Error encoding image: %v\n", err)
+		}
+		data = buffer.Bytes()
+	}
+	return data, nil
+}
+
+// goImageProcessor resizes in process by averaging the source pixels
+// that fall on each target pixel.
+type goImageProcessor struct{}
+
+func (p goImageProcessor) Resize(src, dst string, spec resizeSpec) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Error opening image: %v\n", err)
+	}
+	img, _, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		return errInvalidImage
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("Error creating image: %v\n", err)
+	}
+	err = jpeg.Encode(out, resizeImage(img, spec), &jpeg.Options{Quality: spec.Quality})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("Error writing image: %v\n", err)
+	}
+	return nil
+}
+
+// resizedBounds returns the part of a w x h image that is kept and the
+// size it is scaled to.
+func resizedBounds(w, h int, spec resizeSpec) (crop image.Rectangle, width, height int) {
+	crop = image.Rect(0, 0, w, h)
+	if spec.Crop {
+		// the widest part with the target aspect ratio
+		if w * spec.Height > h * spec.Width {
+			cw := h * spec.Width / spec.Height
+			crop = image.Rect((w - cw) / 2, 0, (w - cw) / 2 + cw, h)
+		} else {
+			ch := w * spec.Height / spec.Width
+			crop = image.Rect(0, (h - ch) / 2, w, (h - ch) / 2 + ch)
+		}
+		return crop, spec.Width, spec.Height
+	}
+
+	scale := 1.0
+	if spec.Width > 0 && w > spec.Width {
+		scale = float64(spec.Width) / float64(w)
+	}
+	if spec.Height > 0 && float64(h) * scale > float64(spec.Height) {
+		scale = float64(spec.Height) / float64(h)
+	}
+	width, height = int(float64(w) * scale + 0.5), int(float64(h) * scale + 0.5)
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return crop, width, height
+}
+
+func resizeImage(img image.Image, spec resizeSpec) *image.RGBA {
+	bounds := img.Bounds()
+	crop, width, height := resizedBounds(bounds.Dx(), bounds.Dy(), spec)
+	crop = crop.Add(bounds.Min)
+	source := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(source, source.Bounds(), img, crop.Min, draw.Src)
+
+	result := image.NewRGBA(image.Rect(0, 0, width, height))
+	sw, sh := crop.Dx(), crop.Dy()
+	for y := 0; y < height; y++ {
+		y0, y1 := y * sh / height, (y + 1) * sh / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x * sw / width, (x + 1) * sw / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := source.Pix[sy * source.Stride + x0 * 4 : sy * source.Stride + x1 * 4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i + 1])
+					sum[2] += int(row[i + 2])
+					sum[3] += int(row[i + 3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			pixel := result.Pix[y * result.Stride + x * 4:]
+			for i := range sum {
+				pixel[i] = uint8((sum[i] + n / 2) / n)
+			}
+		}
+	}
+	return result
+}
+
+// epegImageProcessor resizes with the epeg binary, which only reads
+// JPEG and can't crop: with Crop the image is stretched to the size.
+type epegImageProcessor struct {
+	// added to LD_LIBRARY_PATH, where epeg finds its libraries
+	libraryPath string
+}
+
+func (p epegImageProcessor) Resize(src, dst string, spec resizeSpec) error {
+	args := []string{"-q", strconv.Itoa(spec.Quality)}
+	if spec.Width > 0 {
+		args = append(args, "-w", strconv.Itoa(spec.Width))
+	}
+	if spec.Height > 0 {
+		args = append(args, "-h", strconv.Itoa(spec.Height))
+	}
+	if !spec.Crop {
+		args = append(args, "-p")
+	}
+	cmd := exec.Command("epeg", append(args, src, dst)...)
+	if p.libraryPath != "" {
+		cmd.Env = append(os.Environ(), "LD_LIBRARY_PATH=" + p.libraryPath)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Error running epeg: %v: %s\n", err, out)
+	}
+	return nil
+}
+
+// generateSmallImageAndPreview writes the versions of a stored blob that
+// /image-small and the admin panel serve.
+func generateSmallImageAndPreview(blob_id string) error {
+	src := "images/" + blob_id + ".jpg"
+	if err := imageProcessor.Resize(src, "images/previews/" + blob_id + ".jpg", previewSpec); err != nil {
+		return err
+	}
+	return imageProcessor.Resize(src, "images/small/" + blob_id + ".jpg", smallSpec)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResizedBounds(t *testing.T) {
+	tests := []struct {
+		w, h int
+		spec resizeSpec
+		crop image.Rectangle
+		width, height int
+	}{
+		{300, 150, previewSpec, image.Rect(75, 0, 225, 150), 80, 80},
+		{150, 300, previewSpec, image.Rect(0, 75, 150, 225), 80, 80},
+		{40, 40, previewSpec, image.Rect(0, 0, 40, 40), 80, 80},
+		{600, 300, smallSpec, image.Rect(0, 0, 600, 300), 400, 200},
+		{300, 150, smallSpec, image.Rect(0, 0, 300, 150), 300, 150},
+		{1000, 1, resizeSpec{Width: 100, Height: 100}, image.Rect(0, 0, 1000, 1), 100, 1},
+	}
+	for _, test := range tests {
+		crop, width, height := resizedBounds(test.w, test.h, test.spec)
+		if crop != test.crop || width != test.width || height != test.height {
+			t.Errorf("%dx%d %+v: resizedBounds returned %v, %dx%d", test.w, test.h, test.spec, crop, width, height)
+		}
+	}
+}
+
+// writeTestJPEG writes a w x h image, red on the left half and blue on
+// the right.
+func writeTestJPEG(t *testing.T, path string, w, h int) {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w / 2 {
+				img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	var buffer bytes.Buffer
+	jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 95})
+	if err := ioutil.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+		t.Fatalf("Error writing image: %v", err)
+	}
+}
+
+func decodeTestJPEG(t *testing.T, path string) image.Image {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Error opening image: %v", err)
+	}
+	defer file.Close()
+	img, err := jpeg.Decode(file)
+	if err != nil {
+		t.Fatalf("Error decoding image: %v", err)
+	}
+	return img
+}
+
+func TestGoImageProcessor(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJPEG(t, dir + "/src.jpg", 600, 300)
+
+	p := goImageProcessor{}
+	if err := p.Resize(dir + "/src.jpg", dir + "/small.jpg", smallSpec); err != nil {
+		t.Fatalf("Error Resize: %v", err)
+	}
+	small := decodeTestJPEG(t, dir + "/small.jpg")
+	if small.Bounds().Dx() != 400 || small.Bounds().Dy() != 200 {
+		t.Fatalf("Wrong small size %v", small.Bounds())
+	}
+	if r, _, b, _ := small.At(50, 100).RGBA(); r >> 8 < 200 || b >> 8 > 50 {
+		t.Fatalf("Left of the small image isn't red")
+	}
+
+	if err := p.Resize(dir + "/src.jpg", dir + "/preview.jpg", previewSpec); err != nil {
+		t.Fatalf("Error Resize: %v", err)
+	}
+	preview := decodeTestJPEG(t, dir + "/preview.jpg")
+	if preview.Bounds().Dx() != 80 || preview.Bounds().Dy() != 80 {
+		t.Fatalf("Wrong preview size %v", preview.Bounds())
+	}
+	// the center was kept, so both halves are still there
+	if r, _, b, _ := preview.At(10, 40).RGBA(); r >> 8 < 200 || b >> 8 > 50 {
+		t.Fatalf("Left of the preview isn't red")
+	}
+	if r, _, b, _ := preview.At(70, 40).RGBA(); b >> 8 < 200 || r >> 8 > 50 {
+		t.Fatalf("Right of the preview isn't blue")
+	}
+
+	ioutil.WriteFile(dir + "/text.jpg", []byte("not an image"), 0644)
+	if err := p.Resize(dir + "/text.jpg", dir + "/out.jpg", smallSpec); err != errInvalidImage {
+		t.Fatalf("Resize returned %v for an invalid image", err)
+	}
+}
+
+func uploadRequest(t *testing.T, token string, content []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("token", token)
+	part, _ := writer.CreateFormFile("image", "image.jpg")
+	part.Write(content)
+	writer.Close()
+
+	req := httptest.NewRequest("POST", prefix + "/upload", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestUploadHandler(t *testing.T) {
+	dir := chdirTemp(t)
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1234", 0})
+
+	writeTestJPEG(t, dir + "/sample.jpg", 300, 600)
+	content, _ := ioutil.ReadFile(dir + "/sample.jpg")
+	body := uploadRequest(t, "t_1", content).Body.String()
+	if !strings.HasPrefix(body, `{"error":"","result":"`) {
+		t.Fatalf("Unexpected /upload response: %v", body)
+	}
+	image_id := strings.TrimSuffix(strings.TrimPrefix(body, `{"error":"","result":"`), `"}`)
+	if blob_id, _ := s.ImageBlob(image_id); blob_id != blobID(content) {
+		t.Fatalf("Image stored as %v, expected %v", blob_id, blobID(content))
+	}
+	if small := decodeTestJPEG(t, "images/small/" + blobID(content) + ".jpg"); small.Bounds().Dy() != 200 {
+		t.Fatalf("Wrong small size %v", small.Bounds())
+	}
+	if preview := decodeTestJPEG(t, "images/previews/" + blobID(content) + ".jpg"); preview.Bounds().Dx() != 80 {
+		t.Fatalf("Wrong preview size %v", preview.Bounds())
+	}
+
+	// the same content again is a new image of the same blob
+	body = uploadRequest(t, "t_1", content).Body.String()
+	if second := strings.TrimSuffix(strings.TrimPrefix(body, `{"error":"","result":"`), `"}`); second == image_id {
+		t.Fatalf("Second upload got the same image_id")
+	}
+	if references, _ := s.BlobReferences(blobID(content)); references != 2 {
+		t.Fatalf("%d references to the blob, expected 2", references)
+	}
+
+	if body = uploadRequest(t, "t_1", []byte("not an image")).Body.String(); body != `{"error":"invalid_image"}` {
+		t.Fatalf("Unexpected /upload response for an invalid image: %v", body)
+	}
+	if files, _ := ioutil.ReadDir("images/small"); len(files) != 1 {
+		t.Fatalf("Files of the invalid image left behind")
+	}
+}
+
+func TestReadUpload(t *testing.T) {
+	webp, err := ioutil.ReadFile("testdata/gopher.webp")
+	if err != nil {
+		t.Fatalf("Error reading testdata: %v", err)
+	}
+
+	// half transparent, which is stored white
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			img.Set(x, y, color.NRGBA{0, 0, 255, 255})
+		}
+	}
+	var buffer bytes.Buffer
+	png.Encode(&buffer, img)
+	data, err := readUpload(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		t.Fatalf("readUpload of a PNG: %v", err)
+	}
+	stored, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("PNG not converted to JPEG: %v", err)
+	}
+	if stored.Bounds().Dx() != 40 {
+		t.Fatalf("Wrong stored size %v", stored.Bounds())
+	}
+	if r, g, b, _ := stored.At(35, 10).RGBA(); r >> 8 < 250 || g >> 8 < 250 || b >> 8 < 250 {
+		t.Fatalf("Transparent part stored as %v %v %v", r >> 8, g >> 8, b >> 8)
+	}
+
+	if data, err = readUpload(bytes.NewReader(webp)); err != nil {
+		t.Fatalf("readUpload of a WebP: %v", err)
+	}
+	if _, err = jpeg.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatalf("WebP not converted to JPEG: %v", err)
+	}
+
+	dir := t.TempDir()
+	writeTestJPEG(t, dir + "/sample.jpg", 30, 20)
+	content, _ := ioutil.ReadFile(dir + "/sample.jpg")
+	tests := []struct {
+		content []byte
+		err error
+	}{
+		{content, nil},
+		{[]byte("GIF89a not supported"), errInvalidImage},
+		{[]byte("<html>not an image</html>"), errInvalidImage},
+		// sniffed as JPEG but cut off
+		{content[:len(content) / 2], errInvalidImage},
+	}
+	for i, test := range tests {
+		if _, err := readUpload(bytes.NewReader(test.content)); err != test.err {
+			t.Fatalf("readUpload of upload %d returned %v, expected %v", i, err, test.err)
+		}
+	}
+	// JPEGs are stored as they are
+	if data, _ = readUpload(bytes.NewReader(content)); !bytes.Equal(data, content) {
+		t.Fatalf("JPEG upload was changed")
+	}
+
+	saved := maxImageSide
+	maxImageSide = 25
+	defer func() { maxImageSide = saved }()
+	if _, err := readUpload(bytes.NewReader(content)); err != errImageTooLarge {
+		t.Fatalf("readUpload of a too wide image returned %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// imageCache keeps resized versions of uploaded images on disk, up to
+// maxBytes, evicting the least recently used. Each version is generated
+// once however many requests ask for it at the same time.
+type imageCache struct {
+	dir string
+	maxBytes int64
+
+	mu sync.Mutex
+	size int64
+	// of *cachedImage, most recently used first
+	order *list.List
+	entries map[string]*list.Element
+	pending map[string]*pendingImage
+}
+
+type cachedImage struct {
+	name string
+	size int64
+}
+
+// pendingImage is a version being generated, which other requests for it
+// wait for.
+type pendingImage struct {
+	done chan struct{}
+	err error
+}
+
+// resizedImages is nil until main opens it.
+var resizedImages *imageCache
+
+// newImageCache opens the cache in dir, keeping what an earlier run left
+// there ordered by modification time.
+func newImageCache(dir string, maxBytes int64) (*imageCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("Error creating %v: %v\n", dir, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %v: %v\n", dir, err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	c := &imageCache{
+		dir: dir,
+		maxBytes: maxBytes,
+		order: list.New(),
+		entries: map[string]*list.Element{},
+		pending: map[string]*pendingImage{},
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(file.Name(), "tmp-") {
+			// left by a run that stopped while resizing
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		c.entries[file.Name()] = c.order.PushBack(&cachedImage{file.Name(), file.Size()})
+		c.size += file.Size()
+	}
+	c.evict()
+	return c, nil
+}
+
+// cachedImageName names the version of a blob resized to spec.
+func cachedImageName(blob_id string, spec resizeSpec) string {
+	fit := "contain"
+	if spec.Crop {
+		fit = "cover"
+	}
+	return fmt.Sprintf("%v_%dx%d_%v_q%d.jpg", blob_id, spec.Width, spec.Height, fit, spec.Quality)
+}
+
+// open returns the version of a blob resized to spec, generating it if
+// it isn't cached. The file stays readable if it's evicted meanwhile.
+func (c *imageCache) open(blob_id string, spec resizeSpec) (*os.File, error) {
+	name := cachedImageName(blob_id, spec)
+	path := filepath.Join(c.dir, name)
+	for {
+		c.mu.Lock()
+		if e, ok := c.entries[name]; ok {
+			c.order.MoveToFront(e)
+			file, err := os.Open(path)
+			c.mu.Unlock()
+			return file, err
+		}
+		if p, ok := c.pending[name]; ok {
+			c.mu.Unlock()
+			<-p.done
+			if p.err != nil {
+				return nil, p.err
+			}
+			continue
+		}
+		p := &pendingImage{done: make(chan struct{})}
+		c.pending[name] = p
+		c.mu.Unlock()
+
+		file, size, err := c.generate(blob_id, name, spec)
+
+		c.mu.Lock()
+		delete(c.pending, name)
+		if err == nil {
+			c.entries[name] = c.order.PushFront(&cachedImage{name, size})
+			c.size += size
+			c.evict()
+		}
+		c.mu.Unlock()
+		p.err = err
+		close(p.done)
+		return file, err
+	}
+}
+
+func (c *imageCache) generate(blob_id, name string, spec resizeSpec) (*os.File, int64, error) {
+	tmp := filepath.Join(c.dir, "tmp-" + name)
+	if err := imageProcessor.Resize("images/" + blob_id + ".jpg", tmp, spec); err != nil {
+		os.Remove(tmp)
+		return nil, 0, err
+	}
+	path := filepath.Join(c.dir, name)
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, 0, fmt.Errorf("Error renaming %v: %v\n", tmp, err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, stat.Size(), nil
+}
+
+// evict removes the least recently used versions while the cache is over
+// maxBytes, except the most recent one. The caller holds mu.
+func (c *imageCache) evict() {
+	for c.size > c.maxBytes && c.order.Len() > 1 {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *imageCache) remove(e *list.Element) {
+	entry := c.order.Remove(e).(*cachedImage)
+	delete(c.entries, entry.name)
+	c.size -= entry.size
+	if err := os.Remove(filepath.Join(c.dir, entry.name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing cached image: %v\n", err)
+	}
+}
+
+// removeBlob removes the cached versions of a removed blob.
+func (c *imageCache) removeBlob(blob_id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, e := range c.entries {
+		if strings.HasPrefix(name, blob_id + "_") {
+			c.remove(e)
+		}
+	}
+}
+
+// imagePreset returns the preset of imagePresets that the width, height,
+// fit and quality parameters of /image/{id} ask for. Parameters left out
+// are 0, "contain" and the preset's quality.
+func imagePreset(value func(string) string) (resizeSpec, bool) {
+	spec := resizeSpec{}
+	for _, p := range []struct {
+		name string
+		dst *int
+	}{{"width", &spec.Width}, {"height", &spec.Height}, {"quality", &spec.Quality}} {
+		if s := value(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return resizeSpec{}, false
+			}
+			*p.dst = n
+		}
+	}
+	switch value("fit") {
+	case "", "contain":
+	case "cover":
+		spec.Crop = true
+	default:
+		return resizeSpec{}, false
+	}
+
+	for _, preset := range imagePresets {
+		if preset.Width == spec.Width && preset.Height == spec.Height && preset.Crop == spec.Crop &&
+			(spec.Quality == 0 || spec.Quality == preset.Quality) {
+			return preset, true
+		}
+	}
+	return resizeSpec{}, false
+}
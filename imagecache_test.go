@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingImageProcessor counts the resizes it passes on.
+type countingImageProcessor struct {
+	count *int32
+}
+
+func (p countingImageProcessor) Resize(src, dst string, spec resizeSpec) error {
+	atomic.AddInt32(p.count, 1)
+	// let concurrent requests pile up
+	time.Sleep(10 * time.Millisecond)
+	return goImageProcessor{}.Resize(src, dst, spec)
+}
+
+func useCountingImageProcessor(t *testing.T) *int32 {
+	saved := imageProcessor
+	count := new(int32)
+	imageProcessor = countingImageProcessor{count}
+	t.Cleanup(func() { imageProcessor = saved })
+	return count
+}
+
+func TestImagePreset(t *testing.T) {
+	tests := []struct {
+		query map[string]string
+		spec resizeSpec
+		ok bool
+	}{
+		{map[string]string{"height": "400"}, resizeSpec{Height: 400, Quality: 85}, true},
+		{map[string]string{"width": "160", "height": "160", "fit": "cover"}, resizeSpec{Width: 160, Height: 160, Crop: true, Quality: 50}, true},
+		{map[string]string{"width": "480", "fit": "contain", "quality": "80"}, resizeSpec{Width: 480, Quality: 80}, true},
+		{map[string]string{"width": "480", "quality": "95"}, resizeSpec{}, false},
+		{map[string]string{"width": "160", "height": "160"}, resizeSpec{}, false},
+		{map[string]string{"width": "481"}, resizeSpec{}, false},
+		{map[string]string{"width": "wide"}, resizeSpec{}, false},
+		{map[string]string{"height": "200", "fit": "fill"}, resizeSpec{}, false},
+	}
+	for _, test := range tests {
+		spec, ok := imagePreset(func(name string) string { return test.query[name] })
+		if ok != test.ok || spec != test.spec {
+			t.Fatalf("imagePreset(%v) = %v, %v, expected %v, %v", test.query, spec, ok, test.spec, test.ok)
+		}
+	}
+}
+
+func TestImageCache(t *testing.T) {
+	dir := chdirTemp(t)
+	count := useCountingImageProcessor(t)
+	writeTestJPEG(t, "images/a.jpg", 300, 600)
+	writeTestJPEG(t, "images/b.jpg", 300, 600)
+
+	c, err := newImageCache(dir + "/images/cache", 1 << 20)
+	if err != nil {
+		t.Fatalf("newImageCache: %v", err)
+	}
+	small := resizeSpec{Height: 200, Quality: 85}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			file, err := c.open("a", small)
+			if err != nil {
+				t.Errorf("open: %v", err)
+				return
+			}
+			file.Close()
+		}()
+	}
+	wg.Wait()
+	if *count != 1 {
+		t.Fatalf("Resized %d times for concurrent requests", *count)
+	}
+	if img := decodeTestJPEG(t, "images/cache/" + cachedImageName("a", small)); img.Bounds().Dy() != 200 {
+		t.Fatalf("Wrong cached size %v", img.Bounds())
+	}
+
+	// room for about one image: the least recently used is evicted
+	c.maxBytes = c.size + 1
+	file, _ := c.open("b", small)
+	file.Close()
+	if _, ok := c.entries[cachedImageName("a", small)]; ok {
+		t.Fatalf("Least recently used image not evicted")
+	}
+	if files, _ := ioutil.ReadDir("images/cache"); len(files) != 1 {
+		t.Fatalf("%d files in the cache, expected 1", len(files))
+	}
+
+	// a restart keeps what's cached
+	c, err = newImageCache(dir + "/images/cache", 1 << 20)
+	if err != nil {
+		t.Fatalf("newImageCache: %v", err)
+	}
+	file, _ = c.open("b", small)
+	file.Close()
+	if *count != 2 {
+		t.Fatalf("Cached image resized again after a restart")
+	}
+	c.removeBlob("b")
+	if files, _ := ioutil.ReadDir("images/cache"); len(files) != 0 || c.size != 0 {
+		t.Fatalf("Cached versions of a removed image left behind")
+	}
+}
+
+func TestImageHandlerResize(t *testing.T) {
+	dir := chdirTemp(t)
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1234", 0})
+	s.AddImage("t_1", "a", "a")
+	writeTestJPEG(t, "images/a.jpg", 300, 600)
+	cache, err := newImageCache(dir + "/images/cache", 1 << 20)
+	if err != nil {
+		t.Fatalf("newImageCache: %v", err)
+	}
+	saved := resizedImages
+	resizedImages = cache
+	defer func() { resizedImages = saved }()
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest("GET", prefix + "/image/a" + query, nil))
+		return rec
+	}
+	if rec := get("?width=160&height=160&fit=cover"); rec.Code != 200 {
+		t.Fatalf("Resized image returned %d", rec.Code)
+	}
+	if img := decodeTestJPEG(t, "images/cache/a_160x160_cover_q50.jpg"); img.Bounds().Dx() != 160 || img.Bounds().Dy() != 160 {
+		t.Fatalf("Wrong resized size %v", img.Bounds())
+	}
+	if rec := get("?width=123"); rec.Code != 400 {
+		t.Fatalf("Unknown size returned %d", rec.Code)
+	}
+	if rec := get(""); rec.Code != 200 || rec.Body.Len() == 0 {
+		t.Fatalf("Original image returned %d", rec.Code)
+	}
+}
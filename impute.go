@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Values of missingParams
+const (
+	missingParamsReject = "reject"
+	missingParamsReweight = "reweight"
+	missingParamsImpute = "impute"
+)
+
+// imputeModel is the mean and covariance of the params of a schema over
+// existing items. The missing params of a request are imputed with their
+// mean conditioned on the given ones.
+type imputeModel struct {
+	names []string // of the schema's params, in the order of mean
+	mean []float64
+	covariance [][]float64
+	samples int
+	built time.Time
+}
+
+var (
+	imputeModelsMu sync.Mutex
+	// by shop_id and category
+	imputeModels = map[[2]string]imputeModel{}
+	// the models being built, which other requests don't build again
+	imputeBuilds = map[[2]string]bool{}
+)
+
+func checkMissingParams() error {
+	switch missingParams {
+	case missingParamsReject, missingParamsReweight, missingParamsImpute:
+		return nil
+	}
+	return fmt.Errorf("Unknown missingParams %v\n", missingParams)
+}
+
+// newImputeModel computes the model of data, rows of params in schema
+// order.
+func newImputeModel(schema paramSchema, data [][]float64) imputeModel {
+	model := imputeModel{names: schema.names(), samples: len(data), built: time.Now()}
+	if len(data) == 0 {
+		return model
+	}
+	n := len(data[0])
+	model.mean = make([]float64, n)
+	for _, row := range data {
+		for i, value := range row {
+			model.mean[i] += value / float64(len(data))
+		}
+	}
+	model.covariance = make([][]float64, n)
+	for i := range model.covariance {
+		model.covariance[i] = make([]float64, n)
+		for j := range model.covariance[i] {
+			for _, row := range data {
+				model.covariance[i][j] += (row[i] - model.mean[i]) * (row[j] - model.mean[j]) / float64(len(data))
+			}
+		}
+	}
+	return model
+}
+
+// imputeModelFor returns the model of the items of a shop and category,
+// or of all shops if the shop has fewer than imputeMinSamples. Models
+// are built in the background, once at a time, and rebuilt after
+// imputeModelTTL, so /get never waits for one: until the first is
+// built, the returned model has no samples.
+func imputeModelFor(shop_id, category string, schema paramSchema) imputeModel {
+	key := [2]string{shop_id, category}
+	imputeModelsMu.Lock()
+	defer imputeModelsMu.Unlock()
+	model, ok := imputeModels[key]
+	if ok && !model.fits(schema) {
+		// built for an older schema
+		model, ok = imputeModel{}, false
+	}
+	if (!ok || time.Since(model.built) >= imputeModelTTL) && !imputeBuilds[key] {
+		imputeBuilds[key] = true
+		go func() {
+			built, err := buildImputeModel(shop_id, category, schema)
+			imputeModelsMu.Lock()
+			delete(imputeBuilds, key)
+			if err == nil {
+				imputeModels[key] = built
+			}
+			imputeModelsMu.Unlock()
+			if err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+	return model
+}
+
+func buildImputeModel(shop_id, category string, schema paramSchema) (imputeModel, error) {
+	items, err := categoryItems(shop_id, category)
+	if err != nil {
+		return imputeModel{}, err
+	}
+	data := itemVectors(items, schema)
+	if len(data) < imputeMinSamples {
+		if items, err = categoryItems("", category); err != nil {
+			return imputeModel{}, err
+		}
+		if all := itemVectors(items, schema); len(all) > len(data) {
+			data = all
+		}
+	}
+	return newImputeModel(schema, data), nil
+}
+
+// fits reports whether the model was built for the params of schema in
+// their order, rather than for a schema they were renamed or reordered
+// from.
+func (model imputeModel) fits(schema paramSchema) bool {
+	if len(model.names) != len(schema.Params) {
+		return false
+	}
+	for i, p := range schema.Params {
+		if model.names[i] != p.Name {
+			return false
+		}
+	}
+	return true
+}
+
+// categoryItems returns the items of the active tokens of a shop, or of
+// all shops if shop_id is empty, in a category. The server reads them
+// from the index rather than the database.
+func categoryItems(shop_id, category string) ([]itemRow, error) {
+	if idx, ok := store.(*itemIndex); ok {
+		return idx.categoryItems(shop_id, category), nil
+	}
+	return shopItems(shop_id, category)
+}
+
+// impute fills in the params of schema missing from params. With a
+// singular covariance of the given params the missing ones get their
+// mean.
+func (model imputeModel) impute(schema paramSchema, params map[string]float64) map[string]float64 {
+	given, missing := []int{}, []int{}
+	for i, p := range schema.Params {
+		if _, ok := params[p.Name]; ok {
+			given = append(given, i)
+		} else {
+			missing = append(missing, i)
+		}
+	}
+
+	// mean[m] + cov[m][g] * cov[g][g]^-1 * (params[g] - mean[g])
+	covGiven := make([][]float64, len(given))
+	for a, i := range given {
+		covGiven[a] = make([]float64, len(given))
+		for b, j := range given {
+			covGiven[a][b] = model.covariance[i][j]
+		}
+	}
+	inverse, err := invertMatrix(covGiven)
+	diff := make([]float64, len(given))
+	if err == nil {
+		for a := range given {
+			for b, j := range given {
+				diff[a] += inverse[a][b] * (params[schema.Params[j].Name] - model.mean[j])
+			}
+		}
+	}
+
+	result := map[string]float64{}
+	for name, value := range params {
+		result[name] = value
+	}
+	for _, m := range missing {
+		value := model.mean[m]
+		for a, i := range given {
+			value += model.covariance[m][i] * diff[a]
+		}
+		result[schema.Params[m].Name] = math.Round(value * 1e4) / 1e4
+	}
+	return result
+}
+
+// only returns the schema reduced to the named params, with the weights
+// scaled to keep their length, so that distances stay comparable with
+// the ones of the full schema.
+func (schema paramSchema) only(names map[string]bool) paramSchema {
+	reduced := paramSchema{Shop_id: schema.Shop_id, Category: schema.Category}
+	all, kept := 0.0, 0.0
+	for _, p := range schema.Params {
+		all += p.Weight * p.Weight
+		if names[p.Name] {
+			kept += p.Weight * p.Weight
+			reduced.Params = append(reduced.Params, p)
+		}
+	}
+	if kept > 0 {
+		for i := range reduced.Params {
+			reduced.Params[i].Weight *= math.Sqrt(all / kept)
+		}
+	}
+	return reduced
+}
+
+// getParams are the params of a /get query and the schema to match them
+// with.
+type getParams struct {
+	schema paramSchema
+	params map[string]float64
+	// params the shopper left out, which are imputed or ignored
+	missing []string
+	imputed bool
+}
+
+// readGetParams reads the params of a /get query. Unless missingParams
+// is "reject", params that are left out are handled according to it as
+// long as at least one is given and the rest are valid. Until an
+// imputation model is built, they are ignored as with "reweight".
+func readGetParams(shop_id, category string, schema paramSchema, value func(string) string) (getParams, map[string]string) {
+	params, errs := schema.parseValues(value)
+	if len(errs) == 0 || missingParams == missingParamsReject {
+		return getParams{schema: schema, params: params}, errs
+	}
+
+	given := map[string]bool{}
+	missing := []string{}
+	for _, p := range schema.Params {
+		if errs[p.Name] == paramMissing {
+			missing = append(missing, p.Name)
+		} else {
+			given[p.Name] = true
+		}
+	}
+	if len(missing) != len(errs) || len(given) == 0 {
+		return getParams{}, errs
+	}
+	reduced := schema.only(given)
+	if params, errs = reduced.parseValues(value); len(errs) != 0 {
+		return getParams{}, errs
+	}
+
+	if missingParams == missingParamsImpute {
+		if model := imputeModelFor(shop_id, category, schema); model.samples > 0 {
+			return getParams{schema, model.impute(schema, params), missing, true}, nil
+		}
+	}
+	return getParams{reduced, params, missing, false}, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useMissingParams(t *testing.T, mode string) {
+	saved := missingParams
+	missingParams = mode
+	t.Cleanup(func() {
+		missingParams = saved
+		imputeModels = map[[2]string]imputeModel{}
+	})
+}
+
+// waitImputeModels waits for the imputation models being built.
+func waitImputeModels(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		imputeModelsMu.Lock()
+		building := len(imputeBuilds)
+		imputeModelsMu.Unlock()
+		if building == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Imputation models not built")
+}
+
+// useImputeModel builds the imputation model of a shop and category
+// from the current items, as /get would in the background.
+func useImputeModel(t *testing.T, shop_id, category string) {
+	schema, err := schemaFor(shop_id, category)
+	if err != nil {
+		t.Fatalf("Error schemaFor: %v", err)
+	}
+	model, err := buildImputeModel(shop_id, category, schema)
+	if err != nil {
+		t.Fatalf("Error buildImputeModel: %v", err)
+	}
+	key := [2]string{shop_id, category}
+	imputeModelsMu.Lock()
+	imputeModels[key] = model
+	imputeModelsMu.Unlock()
+	t.Cleanup(func() {
+		imputeModelsMu.Lock()
+		delete(imputeModels, key)
+		imputeModelsMu.Unlock()
+	})
+}
+
+func TestImputeModel(t *testing.T) {
+	schema := paramSchema{Params: []paramDef{{"height", "cm", 1, 0, 0}, {"chest", "cm", 1, 0, 0}, {"waist", "cm", 1, 0, 0}}}
+	// chest grows with height, waist doesn't
+	model := newImputeModel(schema, [][]float64{{160, 90, 80}, {170, 95, 70}, {180, 100, 70}, {190, 105, 80}})
+
+	params := model.impute(schema, map[string]float64{"height": 200})
+	if math.Abs(params["chest"] - 110) > 1e-9 || math.Abs(params["waist"] - 75) > 1e-9 || params["height"] != 200 {
+		t.Fatalf("Wrong imputed params %v", params)
+	}
+	// with a singular covariance of the given params the means are used
+	model = newImputeModel(schema, [][]float64{{170, 90, 80}, {170, 100, 70}})
+	if params = model.impute(schema, map[string]float64{"height": 200}); params["chest"] != 95 || params["waist"] != 75 {
+		t.Fatalf("Wrong imputed means %v", params)
+	}
+
+	// a cached model of params renamed or reordered, even as many, is
+	// rebuilt rather than used
+	useMemoryStore(t)
+	useMissingParams(t, missingParamsImpute)
+	imputeModelsMu.Lock()
+	imputeModels[[2]string{"1", ""}] = model
+	imputeModelsMu.Unlock()
+	if got := imputeModelFor("1", "", schema); got.samples != 2 {
+		t.Fatalf("Model of the same schema not used: %v", got)
+	}
+	reordered := paramSchema{Params: []paramDef{schema.Params[1], schema.Params[0], schema.Params[2]}}
+	if got := imputeModelFor("1", "", reordered); got.samples != 0 {
+		t.Fatalf("Model of another schema used: %v", got)
+	}
+	waitImputeModels(t)
+}
+
+func TestSchemaOnly(t *testing.T) {
+	schema := paramSchema{Params: []paramDef{{"a", "", 3, 0, 0}, {"b", "", 4, 0, 0}}}
+	reduced := schema.only(map[string]bool{"b": true})
+	if len(reduced.Params) != 1 || reduced.Params[0].Weight != 5 {
+		t.Fatalf("Wrong reduced schema %v", reduced)
+	}
+}
+
+func TestMissingParams(t *testing.T) {
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1234", 0})
+	s.AddImage("t_1", "img1", "img1")
+	form := url.Values{"token": {"t_1"}, "category": {"shirts"},
+		"params": {`[{"name":"height","unit":"cm","weight":1},{"name":"chest","unit":"cm","weight":1}]`}}
+	serve("POST", prefix + "/schema", form)
+	// M fits tall and slim shoppers, L short and broad ones
+	for _, item := range []struct{ type_, height, chest string }{{"M", "190", "90"}, {"L", "160", "110"}} {
+		serve("POST", prefix + "/update", url.Values{"token": {"t_1"}, "id": {"shirt"}, "category": {"shirts"},
+			"type": {item.type_}, "image_ids": {"img1"}, "height": {item.height}, "chest": {item.chest}})
+	}
+
+	get := url.Values{"shop_id": {"1234"}, "id": {"shirt"}, "height": {"180"}}
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{missingParamsReject, `{"error":"invalid_params","fields":{"chest":"missing"}}`},
+		{missingParamsReweight, `{"error":"","result":["img1"],"type":"M","params":[190,90],"ignored":["chest"]}`},
+		// chest is imputed as 96.6667, closer to M
+		{missingParamsImpute, `{"error":"","result":["img1"],"type":"M","params":[190,90],"imputed":["chest"]}`},
+	}
+	for _, test := range tests {
+		useMissingParams(t, test.mode)
+		if test.mode == missingParamsImpute {
+			// the first request starts building the model and meanwhile
+			// ignores the missing params
+			if body := serve("POST", prefix + "/get", get).Body.String(); !strings.HasSuffix(body, `"ignored":["chest"]}`) {
+				t.Errorf("Unexpected /get response before the model is built: %v", body)
+			}
+			waitImputeModels(t)
+		}
+		if body := serve("POST", prefix + "/get", get).Body.String(); body != test.want {
+			t.Errorf("%v: unexpected /get response: %v", test.mode, body)
+		}
+	}
+
+	get.Set("k", "2")
+	if body := serve("POST", prefix + "/get", get).Body.String(); !strings.HasSuffix(body, `],"imputed":["chest"]}`) {
+		t.Errorf("Unexpected /get response: %v", body)
+	}
+	get.Del("height")
+	if body := serve("POST", prefix + "/get", get).Body.String(); body != `{"error":"invalid_params","fields":{"chest":"missing","height":"missing"}}` {
+		t.Errorf("Request without params accepted: %v", body)
+	}
+}
+
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// indexKey identifies the types of an item in a shop, which /get
+// compares with each other.
+type indexKey struct {
+	Shop_id string
+	itemKey
+}
+
+// colorKey identifies all sizes of an item in a color.
+type colorKey struct {
+	Shop_id string
+	Item_id string
+	Color string
+}
+
+// typeKey identifies one item type for request counting.
+type typeKey struct {
+	Shop_id string
+	itemKey
+	Type string
+}
+
+// itemIndex wraps a Store and answers ItemTypes and GetSchema, which
+// /get relies on, from memory. It is loaded when created and updated by
+// every write that goes through it. Commands that write items or schemas
+// from another process, "main calibrate -save" and importing an export,
+// make the server reload it with signalServer; "main gc" only removes
+// images that no item refers to, which the index doesn't hold.
+// IncrementRequests is counted in memory and written back by
+// flushRequests.
+type itemIndex struct {
+	Store
+
+	// reloadMu is held while reloading from the store, so that reloads
+	// apply in the order they read; mu is only held to apply them, so
+	// that reads wait for no queries
+	reloadMu sync.Mutex
+	mu sync.RWMutex
+	items map[indexKey][]itemRow
+	tokenKeys map[string]map[indexKey]bool
+	colorKeys map[colorKey]map[indexKey]bool
+	schemas map[[2]string]paramSchema
+
+	pendingMu sync.Mutex
+	pending map[typeKey]requestCounts
+}
+
+// newItemIndex loads the items of all active tokens and all schemas of s.
+func newItemIndex(s Store) (*itemIndex, error) {
+	idx := &itemIndex{
+		Store: s,
+		pending: map[typeKey]requestCounts{},
+	}
+	if err := idx.reload(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// reload replaces everything in the index with what's in the store, to
+// pick up changes made by other processes such as "main calibrate -save".
+// The index keeps answering from the old maps until the new ones are
+// loaded.
+func (idx *itemIndex) reload() error {
+	idx.reloadMu.Lock()
+	defer idx.reloadMu.Unlock()
+	fresh := &itemIndex{
+		items: map[indexKey][]itemRow{},
+		tokenKeys: map[string]map[indexKey]bool{},
+		colorKeys: map[colorKey]map[indexKey]bool{},
+	}
+
+	tokens, err := idx.Store.ListTokens()
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if t.Deleted_at != 0 {
+			continue
+		}
+		byKey, err := idx.tokenTypes(t.Token)
+		if err != nil {
+			return err
+		}
+		for k, types := range byKey {
+			fresh.setKey(k, types)
+		}
+	}
+	schemas, err := idx.readSchemas()
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	idx.items, idx.tokenKeys, idx.colorKeys, idx.schemas = fresh.items, fresh.tokenKeys, fresh.colorKeys, schemas
+	idx.mu.Unlock()
+	return nil
+}
+
+// setKey replaces the types of a key, which must be called with mu held.
+// The rows' requests and misses counts are left as loaded: nothing reads
+// them from the index, and counting doesn't touch the rows.
+func (idx *itemIndex) setKey(k indexKey, types []itemRow) {
+	for _, item := range idx.items[k] {
+		delete(idx.tokenKeys[item.Token], k)
+	}
+	if len(types) == 0 {
+		idx.deleteKey(k)
+		return
+	}
+
+	idx.items[k] = types
+	ck := colorKey{k.Shop_id, k.Item_id, k.Color}
+	if idx.colorKeys[ck] == nil {
+		idx.colorKeys[ck] = map[indexKey]bool{}
+	}
+	idx.colorKeys[ck][k] = true
+	for _, item := range types {
+		if idx.tokenKeys[item.Token] == nil {
+			idx.tokenKeys[item.Token] = map[indexKey]bool{}
+		}
+		idx.tokenKeys[item.Token][k] = true
+	}
+}
+
+// deleteKey removes the types of a key, which must be called with mu
+// held.
+func (idx *itemIndex) deleteKey(k indexKey) {
+	delete(idx.items, k)
+	ck := colorKey{k.Shop_id, k.Item_id, k.Color}
+	delete(idx.colorKeys[ck], k)
+	if len(idx.colorKeys[ck]) == 0 {
+		delete(idx.colorKeys, ck)
+	}
+}
+
+// tokenTypes reads the items of a token from the store by key.
+func (idx *itemIndex) tokenTypes(token string) (map[indexKey][]itemRow, error) {
+	items, err := idx.Store.ItemsByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	byKey := map[indexKey][]itemRow{}
+	for _, item := range items {
+		k := indexKey{item.Shop_id, item.itemKey}
+		byKey[k] = append(byKey[k], item)
+	}
+	return byKey, nil
+}
+
+// unloadToken removes the items of a token, which must be called with
+// mu held.
+func (idx *itemIndex) unloadToken(token string) {
+	for k := range idx.tokenKeys[token] {
+		idx.deleteKey(k)
+	}
+	delete(idx.tokenKeys, token)
+}
+
+// reloadToken replaces the items of a token with the ones in the store,
+// or just removes them if the token is no longer active.
+func (idx *itemIndex) reloadToken(token string) error {
+	idx.reloadMu.Lock()
+	defer idx.reloadMu.Unlock()
+
+	byKey := map[indexKey][]itemRow{}
+	tokens, err := idx.Store.ListTokens()
+	for _, t := range tokens {
+		if t.Token == token && t.Deleted_at == 0 {
+			byKey, err = idx.tokenTypes(token)
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	// on errors the items are dropped rather than served stale
+	idx.unloadToken(token)
+	if err != nil {
+		return err
+	}
+	for k, types := range byKey {
+		idx.setKey(k, types)
+	}
+	return nil
+}
+
+// reloadKeys replaces the types of the given keys with the ones in the
+// store.
+func (idx *itemIndex) reloadKeys(keys ...indexKey) error {
+	idx.reloadMu.Lock()
+	defer idx.reloadMu.Unlock()
+	loaded := [][]itemRow{}
+	var err error
+	for _, k := range keys {
+		var types []itemRow
+		if types, err = idx.Store.ItemTypes(k.Shop_id, k.itemKey); err != nil {
+			break
+		}
+		loaded = append(loaded, types)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for i, types := range loaded {
+		idx.setKey(keys[i], types)
+	}
+	if err != nil {
+		// drop the key rather than serve stale types
+		idx.setKey(keys[len(loaded)], nil)
+	}
+	return err
+}
+
+func (idx *itemIndex) readSchemas() (map[[2]string]paramSchema, error) {
+	schemas, err := idx.Store.ListSchemas()
+	if err != nil {
+		return nil, err
+	}
+	result := map[[2]string]paramSchema{}
+	for _, schema := range schemas {
+		result[[2]string{schema.Shop_id, schema.Category}] = schema
+	}
+	return result, nil
+}
+
+func (idx *itemIndex) reloadSchemas() error {
+	idx.reloadMu.Lock()
+	defer idx.reloadMu.Unlock()
+	schemas, err := idx.readSchemas()
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	idx.schemas = schemas
+	idx.mu.Unlock()
+	return nil
+}
+
+func (idx *itemIndex) ItemTypes(shop_id string, key itemKey) ([]itemRow, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return append([]itemRow{}, idx.items[indexKey{shop_id, key}]...), nil
+}
+
+func (idx *itemIndex) ItemTypesBatch(shop_id string, keys []itemKey) ([][]itemRow, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	result := make([][]itemRow, len(keys))
+	for i, key := range keys {
+		result[i] = append([]itemRow{}, idx.items[indexKey{shop_id, key}]...)
+	}
+	return result, nil
+}
+
+func (idx *itemIndex) ItemColorTypes(shop_id, item_id, color string) ([]itemRow, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	result := []itemRow{}
+	for k := range idx.colorKeys[colorKey{shop_id, item_id, color}] {
+		result = append(result, idx.items[k]...)
+	}
+	return result, nil
+}
+
+// categoryItems returns the indexed items of a shop, or of all shops if
+// shop_id is empty, in a category.
+func (idx *itemIndex) categoryItems(shop_id, category string) []itemRow {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	result := []itemRow{}
+	for k, types := range idx.items {
+		if shop_id != "" && k.Shop_id != shop_id {
+			continue
+		}
+		for _, item := range types {
+			if item.Category == category {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+func (idx *itemIndex) GetSchema(shop_id, category string) (paramSchema, bool, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	schema, ok := idx.schemas[[2]string{shop_id, category}]
+	return schema, ok, nil
+}
+
+// IncrementRequests counts the request in memory. The count reaches the
+// store with the next flushRequests.
+func (idx *itemIndex) IncrementRequests(shop_id string, key itemKey, type_ string) error {
+	idx.count(typeKey{shop_id, key, type_}, requestCounts{Requests: 1})
+	return nil
+}
+
+// IncrementMisses counts the miss in memory like IncrementRequests.
+func (idx *itemIndex) IncrementMisses(shop_id string, key itemKey, type_ string) error {
+	idx.count(typeKey{shop_id, key, type_}, requestCounts{Misses: 1})
+	return nil
+}
+
+// count only takes pendingMu, so that counting never waits for readers
+// of the index or makes them wait.
+func (idx *itemIndex) count(k typeKey, c requestCounts) {
+	idx.pendingMu.Lock()
+	idx.addPending(k, c)
+	idx.pendingMu.Unlock()
+}
+
+// addPending must be called with pendingMu held.
+func (idx *itemIndex) addPending(k typeKey, c requestCounts) {
+	p := idx.pending[k]
+	p.Requests += c.Requests
+	p.Misses += c.Misses
+	idx.pending[k] = p
+}
+
+// AddRequests counts in memory like IncrementRequests.
+func (idx *itemIndex) AddRequests(counts map[typeKey]requestCounts) error {
+	idx.pendingMu.Lock()
+	defer idx.pendingMu.Unlock()
+	for k, c := range counts {
+		idx.addPending(k, c)
+	}
+	return nil
+}
+
+// flushRequests writes the counted requests to the store. On failure
+// they are kept for the next call.
+func (idx *itemIndex) flushRequests() error {
+	idx.pendingMu.Lock()
+	counts := idx.pending
+	idx.pending = map[typeKey]requestCounts{}
+	idx.pendingMu.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+
+	err := idx.Store.AddRequests(counts)
+	if err != nil {
+		idx.pendingMu.Lock()
+		for k, c := range counts {
+			idx.addPending(k, c)
+		}
+		idx.pendingMu.Unlock()
+	}
+	return err
+}
+
+// startRequestsFlusher runs flushRequests every requestsFlushInterval
+// until the process exits.
+func (idx *itemIndex) startRequestsFlusher() {
+	go func() {
+		for range time.Tick(requestsFlushInterval) {
+			if err := idx.flushRequests(); err != nil {
+				log.Printf("Error writing requests counts: %v\n", err)
+			}
+		}
+	}()
+}
+
+func (idx *itemIndex) Close() error {
+	err := idx.flushRequests()
+	if cerr := idx.Store.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (idx *itemIndex) AddItem(item itemRow) error {
+	if err := idx.Store.AddItem(item); err != nil {
+		return err
+	}
+	return idx.reloadKeys(indexKey{item.Shop_id, item.itemKey})
+}
+
+func (idx *itemIndex) SaveItem(item itemRow, mode string) (bool, error) {
+	created, err := idx.Store.SaveItem(item, mode)
+	if err != nil {
+		return created, err
+	}
+	return created, idx.reloadKeys(indexKey{item.Shop_id, item.itemKey})
+}
+
+func (idx *itemIndex) DeleteItems(token string, scope string, key itemKey, type_ string, deleteImages bool) (int, []string, error) {
+	deleted, image_ids, err := idx.Store.DeleteItems(token, scope, key, type_, deleteImages)
+	if err != nil || deleted == 0 {
+		return deleted, image_ids, err
+	}
+
+	// the token's keys that had types selected by the scope
+	idx.mu.RLock()
+	keys := []indexKey{}
+	for k := range idx.tokenKeys[token] {
+		if matchesDelete(itemRow{itemKey: k.itemKey, Type: type_}, scope, key, type_) {
+			keys = append(keys, k)
+		}
+	}
+	idx.mu.RUnlock()
+	return deleted, image_ids, idx.reloadKeys(keys...)
+}
+
+func (idx *itemIndex) EditToken(t tokenRow) error {
+	if err := idx.Store.EditToken(t); err != nil {
+		return err
+	}
+	if err := idx.reloadSchemas(); err != nil {
+		return err
+	}
+	return idx.reloadToken(t.Token)
+}
+
+func (idx *itemIndex) DeleteToken(token string) error {
+	if err := idx.Store.DeleteToken(token); err != nil {
+		return err
+	}
+	if err := idx.reloadSchemas(); err != nil {
+		return err
+	}
+	return idx.reloadToken(token)
+}
+
+func (idx *itemIndex) ImportToken(c tokenCopy) error {
+	if err := idx.Store.ImportToken(c); err != nil {
+		return err
+	}
+	if err := idx.reloadSchemas(); err != nil {
+		return err
+	}
+	return idx.reloadToken(c.Token.Token)
+}
+
+func (idx *itemIndex) TrashToken(token string) (bool, error) {
+	trashed, err := idx.Store.TrashToken(token)
+	if err != nil || !trashed {
+		return trashed, err
+	}
+	return trashed, idx.reloadToken(token)
+}
+
+func (idx *itemIndex) RestoreToken(token string) (bool, error) {
+	restored, err := idx.Store.RestoreToken(token)
+	if err != nil || !restored {
+		return restored, err
+	}
+	return restored, idx.reloadToken(token)
+}
+
+func (idx *itemIndex) DeleteTrashedToken(token string, before int64) (bool, error) {
+	deleted, err := idx.Store.DeleteTrashedToken(token, before)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+	return deleted, idx.reloadSchemas()
+}
+
+func (idx *itemIndex) SaveSchema(schema paramSchema) error {
+	if err := idx.Store.SaveSchema(schema); err != nil {
+		return err
+	}
+	return idx.reloadSchemas()
+}
+
+func (idx *itemIndex) DeleteSchema(shop_id, category string) (bool, error) {
+	deleted, err := idx.Store.DeleteSchema(shop_id, category)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+	return deleted, idx.reloadSchemas()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestItemIndex(t *testing.T) {
+	s := newMemoryStore()
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1", 0})
+	key := itemKey{Item_id: "shirt"}
+	s.AddItem(itemRow{Token: "t_1", Shop_id: "1", itemKey: key, Type: "1", Params: testParams(1)})
+	s.SaveSchema(paramSchema{"1", "", []paramDef{{"a", "", 1, 0, 0}}})
+
+	idx, err := newItemIndex(s)
+	if err != nil {
+		t.Fatalf("Error newItemIndex: %v", err)
+	}
+	if types, _ := idx.ItemTypes("1", key); len(types) != 1 {
+		t.Fatalf("Index not loaded: %v", types)
+	}
+	if _, found, _ := idx.GetSchema("1", ""); !found {
+		t.Fatalf("Schemas not loaded")
+	}
+
+	// writes that bypass the index aren't seen
+	s.AddItem(itemRow{Token: "t_1", Shop_id: "1", itemKey: key, Type: "2", Params: testParams(2)})
+	if types, _ := idx.ItemTypes("1", key); len(types) != 1 {
+		t.Fatalf("ItemTypes not answered from the index")
+	}
+	// writes through it are
+	idx.SaveItem(itemRow{Token: "t_1", Shop_id: "1", itemKey: key, Type: "3", Params: testParams(3)}, saveModeCreate)
+	if types, _ := idx.ItemTypes("1", key); len(types) != 3 {
+		t.Fatalf("Index not updated on SaveItem: %v", types)
+	}
+	idx.DeleteItems("t_1", deleteScopeType, key, "2", false)
+	if types, _ := idx.ItemTypes("1", key); len(types) != 2 {
+		t.Fatalf("Index not updated on DeleteItems: %v", types)
+	}
+
+	if items := idx.categoryItems("1", ""); len(items) != 2 {
+		t.Fatalf("Wrong category items %v", items)
+	}
+	if items := idx.categoryItems("2", ""); len(items) != 0 {
+		t.Fatalf("Items of another shop returned: %v", items)
+	}
+
+	idx.SaveItem(itemRow{Token: "t_1", Shop_id: "1", itemKey: itemKey{Item_id: "shirt", Size: "L"}, Type: "1"}, saveModeCreate)
+	if types, _ := idx.ItemColorTypes("1", "shirt", ""); len(types) != 3 {
+		t.Fatalf("Sizes not indexed: %v", types)
+	}
+	idx.DeleteItems("t_1", deleteScopeKey, itemKey{Item_id: "shirt", Size: "L"}, "", false)
+	if types, _ := idx.ItemColorTypes("1", "shirt", ""); len(types) != 2 {
+		t.Fatalf("Index not updated on DeleteItems: %v", types)
+	}
+
+	idx.IncrementRequests("1", key, "1")
+	idx.AddRequests(map[typeKey]requestCounts{{"1", key, "1"}: {Requests: 1}})
+	if types, _ := s.ItemTypes("1", key); types[0].Requests_count != 0 {
+		t.Fatalf("Requests written before flush")
+	}
+	if c := idx.pending[typeKey{"1", key, "1"}]; c.Requests != 2 {
+		t.Fatalf("Requests not counted in the index: %v", c)
+	}
+	if err = idx.flushRequests(); err != nil {
+		t.Fatalf("Error flushRequests: %v", err)
+	}
+	if types, _ := s.ItemTypes("1", key); types[0].Requests_count != 2 {
+		t.Fatalf("Requests not flushed: %v", types)
+	}
+
+	idx.EditToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "2", 0})
+	if types, _ := idx.ItemTypes("1", key); len(types) != 0 {
+		t.Fatalf("Types left under the old shop id")
+	}
+	if types, _ := idx.ItemTypes("2", key); len(types) != 2 {
+		t.Fatalf("Types not moved to the new shop id: %v", types)
+	}
+	if _, found, _ := idx.GetSchema("2", ""); !found {
+		t.Fatalf("Schema not moved to the new shop id")
+	}
+
+	idx.TrashToken("t_1")
+	if types, _ := idx.ItemTypes("2", key); len(types) != 0 {
+		t.Fatalf("Types of a trashed token served")
+	}
+	idx.RestoreToken("t_1")
+	if types, _ := idx.ItemTypes("2", key); len(types) != 2 {
+		t.Fatalf("Types of a restored token missing: %v", types)
+	}
+	idx.DeleteToken("t_1")
+	if types, _ := idx.ItemTypes("2", key); len(types) != 0 {
+		t.Fatalf("Types of a deleted token served")
+	}
+}
+
+func TestSignalServer(t *testing.T) {
+	chdirTemp(t)
+	s := newMemoryStore()
+	idx, err := newItemIndex(s)
+	if err != nil {
+		t.Fatalf("Error newItemIndex: %v", err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	if err = writePIDFile(); err != nil {
+		t.Fatalf("Error writePIDFile: %v", err)
+	}
+
+	// a schema saved by another process, as "main calibrate -save" does
+	s.SaveSchema(paramSchema{"1", "", []paramDef{{"a", "", 1, 0, 0}}})
+	signalServer()
+	select {
+	case <-signals:
+	case <-time.After(time.Second):
+		t.Fatalf("Server not sent SIGHUP")
+	}
+	if err = idx.reload(); err != nil {
+		t.Fatalf("Error reload: %v", err)
+	}
+	if _, found, _ := idx.GetSchema("1", ""); !found {
+		t.Fatalf("Schema not reloaded")
+	}
+
+	// without a server there is nobody to signal
+	removePIDFile()
+	signalServer()
+	select {
+	case <-signals:
+		t.Fatalf("SIGHUP sent without a pid file")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// benchmarkGet matches against typeCount types of productCount items,
+// like db_test.go does against a live server.
+func benchmarkGet(b *testing.B, indexed bool) {
+	s, err := openSQLiteStore(b.TempDir() + "/bench.db")
+	if err != nil {
+		b.Fatalf("Error opening store: %v", err)
+	}
+	saved := store
+	defer func() { store = saved }()
+	store = s
+
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1", 0})
+	for p := 0; p < productCount; p++ {
+		for i := 0; i < typeCount; i++ {
+			s.AddItem(itemRow{Token: "t_1", Shop_id: "1", itemKey: itemKey{Item_id: strconv.Itoa(p)},
+				Type: strconv.Itoa(i), Params: testParams(float64(600 + i))})
+		}
+	}
+	if indexed {
+		idx, err := newItemIndex(s)
+		if err != nil {
+			b.Fatalf("Error newItemIndex: %v", err)
+		}
+		store = idx
+	}
+	defer store.Close()
+
+	form := url.Values{"shop_id": {"1"}, "id": {"7"}}
+	for _, name := range paramNames {
+		form.Set(name, "617.2")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if rec := serve("POST", prefix + "/get", form); rec.Code != 200 || !strings.Contains(rec.Body.String(), `"type":"17"`) {
+			b.Fatalf("Unexpected /get response %d: %v", rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func BenchmarkGetSQL(b *testing.B) {
+	benchmarkGet(b, false)
+}
+
+func BenchmarkGetIndexed(b *testing.B) {
+	benchmarkGet(b, true)
+}
@@ -2,26 +2,28 @@ package main
 
 import (
 	"fmt"
+	"encoding/json"
 	"log"
 	"net/http"
 	"github.com/gorilla/mux"
 	"golang.org/x/time/rate"
-	_ "github.com/mattn/go-sqlite3"
-	"database/sql"
 	"math/rand"
 	"time"
 	"path/filepath"
 	"os"
-	"os/exec"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"strconv"
 	"strings"
+	"sort"
+	"context"
+	"syscall"
+	"os/signal"
 )
 
 var (
-	templateNames = []string{"login", "tokens", "token-block"}
+	templateNames = []string{"login", "tokens", "token-block", "trash-block"}
 	staticNames = []string{"login.css", "login.js", "tokens.css", "tokens.js"}
 	limiter = rate.NewLimiter(1, 1000)
 	server *http.Server
@@ -41,6 +43,17 @@ func printError(w http.ResponseWriter, error string) {
 	fmt.Fprintf(w, "{\"error\":\"" + error + "\"}")
 }
 
+// printParamErrors reports the params parseParams rejected, by field.
+func printParamErrors(w http.ResponseWriter, errs map[string]string) {
+	json_fields, err := json.Marshal(errs)
+	if err != nil {
+		log.Printf("Error json serializing: %v\n", err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+	fmt.Fprint(w, "{\"error\":\"invalid_params\",\"fields\":" + string(json_fields) + "}")
+}
+
 func printResult(w http.ResponseWriter, result string) {
 	fmt.Fprintf(w, "{\"error\":\"\",\"result\":" + result + "}")
 }
@@ -55,74 +68,6 @@ func getRequestFile(r *http.Request) (multipart.File, bool) {
 	return multipart.File(nil), false
 }
 
-func isValidToken(db *sql.DB, token string) (bool, error) {
-	stmt, err := db.Prepare("select exp_time from tokens where token == ?")
-	if err != nil {
-		return false, fmt.Errorf("Error creating stmt: %v\n", err)
-	}
-	rows, err := stmt.Query(token)
-	if err != nil {
-		return false, fmt.Errorf("Error query execution: %v\n", err)
-	}
-	defer rows.Close()
-	if !rows.Next() {
-		return false, nil
-	}
-
-	var exp_time int64
-	if err = rows.Scan(&exp_time); err != nil {
-		return false, err
-	}
-	if err = rows.Err(); err != nil {
-		return false, err
-	}
-
-	return exp_time > time.Now().Unix(), nil
-}
-
-func addImageIDtoDB(db *sql.DB, token, image_id string) error {
-	stmt, err := db.Prepare("insert into images (token, image_id) values (?, ?)")
-	if err != nil {
-		return fmt.Errorf("Error creating stmt: %v\n", err)
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(token, image_id)
-	if err != nil {
-		return fmt.Errorf("Error request execution: %v\n", err)
-	}
-	return nil
-}
-
-func isImageIDExists(db *sql.DB, image_id string) bool {
-	stmt, err := db.Prepare("select * from images where image_id == ?")
-	if err != nil {
-		log.Fatalf("Error creating stmt: %v\n", err)
-	}
-	rows, err := stmt.Query(image_id)
-	if err != nil {
-		log.Fatalf("Error query execution: %v\n", err)
-	}
-	defer rows.Close()
-	return rows.Next()
-}
-
-func generateSmallImageAndPreview(file multipart.File, image_id string) error {
-	cmd := exec.Command("epeg", "-w", "80", "-h", "80", "-q", 
-		"50", "images/" + image_id + ".jpg", "images/previews/" + image_id + ".jpg")
-	cmd.Env = append(os.Environ(), "LD_LIBRARY_PATH=/usr/local/lib")
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-
-	cmd = exec.Command("epeg", "-h", "200", "-p", 
-		"images/" + image_id + ".jpg", "images/small/" + image_id + ".jpg")
-	cmd.Env = append(os.Environ(), "LD_LIBRARY_PATH=/usr/local/lib")
-	if err := cmd.Run(); err != nil {
-		return err
-	}
-	return nil
-}
-
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if !limiter.Allow() {
 		printError(w, "flood_limit")
@@ -132,15 +77,7 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseMultipartForm(1 << 23)
 	token := r.FormValue("token")
 
-	db, err := sql.Open("sqlite3", "sqlite3.db")
-	if err != nil {
-		log.Printf("Error opening database: %v\n", err)
-		http.Error(w, "500 internal server error", 500)
-		return
-	}
-	defer db.Close()
-
-	valid, err := isValidToken(db, token)
+	valid, err := store.IsValidToken(token)
 	if err != nil {
 		log.Print(err)
 		http.Error(w, "500 internal server error", 500)
@@ -159,30 +96,31 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	defer reqfile.Close()
 
 	image_id := getRandomID()
-	for ;isImageIDExists(db, image_id); {
+	for {
+		exists, err := store.ImageExists(image_id)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, "500 internal server error", 500)
+			return
+		}
+		if !exists {
+			break
+		}
 		image_id = getRandomID()
 	}
-	file, err := os.Create("images/" + image_id + ".jpg")
-	if err != nil {
-		log.Print(err)
-		http.Error(w, "500 internal server error", 500)
-		return
-	}
-	io.Copy(file, reqfile)
-	file.Close()
 
-	if _, err := reqfile.Seek(0, 0); err != nil {
-		log.Print(err)
-		http.Error(w, "500 internal server error", 500)
+	data, err := readUpload(reqfile)
+	if err == nil {
+		err = addImage(token, image_id, data)
+	}
+	if err == errInvalidImage {
+		printError(w, "invalid_image")
 		return
 	}
-	if err = generateSmallImageAndPreview(reqfile, image_id); err != nil {
-		log.Print(err)
-		http.Error(w, "500 internal server error", 500)
+	if err == errImageTooLarge {
+		printError(w, "image_too_large")
 		return
 	}
-
-	err = addImageIDtoDB(db, token, image_id)
 	if err != nil {
 		log.Print(err)
 		http.Error(w, "500 internal server error", 500)
@@ -192,33 +130,17 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	printResult(w, "\"" + image_id + "\"")
 }
 
-func isValidImageIDs(db *sql.DB, image_ids string) (bool, error) {
+func isValidImageIDs(image_ids string) (bool, error) {
 	ids := strings.Split(image_ids, ",")
 	if len(ids) > maxImagesPerID || image_ids == "" {
 		return false, nil
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		return false, fmt.Errorf("Error creating database transaction: %v\n", err)
-	}
-	defer tx.Commit()
-
-	stmt, err := tx.Prepare("select image_id from images where image_id == ?")
-	if err != nil {
-		return false, fmt.Errorf("Error creating stmt: %v\n", err)
-	}
-	defer stmt.Close()
 	for _, image_id := range ids {
-		rows, err := stmt.Query(image_id)
-		if err != nil {
-			return false, fmt.Errorf("Error query execution: %v\n", err)
+		exists, err := store.ImageExists(image_id)
+		if err != nil || !exists {
+			return false, err
 		}
-		if !rows.Next() {
-			rows.Close()
-			return false, nil
-		}	
-		rows.Close()
 	}
 	return true, nil
 }
@@ -232,69 +154,21 @@ func imageIDsToJSON(image_ids string) string {
 	return "[" + result[:len(result)-1] + "]"
 }
 
-func getShopID(db *sql.DB, token string) (string, error) {
-	stmt, err := db.Prepare("select shop_id from tokens where token == ?")
-	if err != nil {
-		return "", fmt.Errorf("Error creating stmt: %v\n", err)
-	}
-	rows, err := stmt.Query(token)
-	if err != nil {
-		return "", fmt.Errorf("Error query execution: %v\n", err)
-	}
-	defer rows.Close()
-	if !rows.Next() {
-		return "", fmt.Errorf("Token %v\n not exists", token)
-	}
-
-	var shop_id string
-	if rows.Scan(&shop_id) != nil {
-		return "", err
-	}
-	if rows.Err() != nil {
-		return "", err
-	}
-	return shop_id, nil
-}
-
-func isItemExists(db *sql.DB, id, color, size, description, type_ string) bool {
-	stmt, err := db.Prepare("select * from items where item_id == ? AND color == ? AND size == ? AND description == ? AND type == ?")
-	if err != nil {
-		log.Fatalf("Error creating stmt: %v\n", err)
-	}
-	rows, err := stmt.Query(id, color, size, description, type_)
-	if err != nil {
-		log.Fatalf("Error query execution: %v\n", err)
-	}
-	defer rows.Close()
-	return rows.Next()
-} 
-
-func getL2Norm(a, b []float64) float64 {
-	result := 0.0
-	for i := range a {
-		// Z-scaling
-		dt := (a[i] - b[i]) * paramWeights[i]
-		result += dt * dt
-	}
-	return result
-}
-
 func updateHandler(w http.ResponseWriter, r *http.Request) {
-	id := r.FormValue("id")
-	color := r.FormValue("color")
-	size := r.FormValue("size")
-	description := r.FormValue("description")
+	key := itemKey{r.FormValue("id"), r.FormValue("color"), r.FormValue("size"), r.FormValue("description")}
 	type_ := r.FormValue("type")
+	category := r.FormValue("category")
 	image_ids := r.FormValue("image_ids")
 	token := r.FormValue("token")
-	params := make([]string, len(paramNames))
-	for i, name := range paramNames {
-		floatValue, err := strconv.ParseFloat(r.FormValue(name), 10)
-		if err != nil || r.FormValue(name) == "" {
-			printError(w, "invalid_request")
-			return
-		}
-		params[i] = fmt.Sprintf("'%f'", floatValue)
+	// "create" fails if the type exists, "replace" if it doesn't,
+	// "upsert" does either
+	mode := r.FormValue("mode")
+	if mode == "" {
+		mode = saveModeCreate
+	}
+	if mode != saveModeCreate && mode != saveModeReplace && mode != saveModeUpsert {
+		printError(w, "invalid_request")
+		return
 	}
 
 	if !limiter.Allow() {
@@ -302,33 +176,51 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db, err := sql.Open("sqlite3", "sqlite3.db")
+	valid, err := store.IsValidToken(token)
 	if err != nil {
-		log.Printf("Error opening database: %v\n", err)
+		log.Print(err)
 		http.Error(w, "500 internal server error", 500)
 		return
 	}
-	defer db.Close()
+	if !valid {
+		printError(w, "invalid_token")
+		return
+	}
 
-	valid, err := isValidToken(db, token)
+	shop_id, err := store.GetShopID(token)
 	if err != nil {
 		log.Print(err)
 		http.Error(w, "500 internal server error", 500)
 		return
 	}
-	if !valid {
-		printError(w, "invalid_token")
+
+	schema, err := schemaFor(shop_id, category)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+	params, errs := schema.parseParams(r)
+	if len(errs) != 0 {
+		printParamErrors(w, errs)
 		return
 	}
 
-	shop_id, err := getShopID(db, token)
+	// all types of an item are measured with the same schema
+	types, err := store.ItemTypes(shop_id, key)
 	if err != nil {
 		log.Print(err)
 		http.Error(w, "500 internal server error", 500)
 		return
 	}
+	for _, item := range types {
+		if item.Type != type_ && item.Category != category {
+			printError(w, "invalid_request")
+			return
+		}
+	}
 
-	valid, err = isValidImageIDs(db, image_ids)
+	valid, err = isValidImageIDs(image_ids)
 	if err != nil {
 		log.Print(err)
 		http.Error(w, "500 internal server error", 500)
@@ -339,241 +231,687 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if isItemExists(db, id, color, size, description, type_) || id == "" {
+	if key.Item_id == "" {
 		printError(w, "invalid_id")
 		return
 	}
 
-	stmt, err := db.Prepare(fmt.Sprintf(`insert into items (token, shop_id, item_id, color, size, description, type, image_list, %s, requests_count) 
-		values (?, ?, ?, ?, ?, ?, ?, ?, %s, 0)`, 
-		strings.Join(paramNames[:], ", "), 
-		strings.Join(params, ", ")))
+	created, err := store.SaveItem(itemRow{
+		Token: token,
+		Shop_id: shop_id,
+		itemKey: key,
+		Category: category,
+		Type: type_,
+		Params: params,
+		Image_ids: strings.Split(image_ids, ","),
+	}, mode)
+	if err == errItemExists || err == errItemNotFound {
+		printError(w, "invalid_id")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+
+	status := "updated"
+	if created {
+		status = "created"
+	}
+	fmt.Fprintf(w, `{"error":"","result":"","status":"%s"}`, status)
+}
+
+// deleteHandler deletes one type (when "type" is given), all types of an
+// item/color/size/description (when "color" or "size" is given) or every
+// type of an item_id. With delete_images=1 the images no remaining item
+// refers to are deleted too.
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	key := itemKey{r.FormValue("id"), r.FormValue("color"), r.FormValue("size"), r.FormValue("description")}
+	type_ := r.FormValue("type")
+	token := r.FormValue("token")
+	deleteImages := r.FormValue("delete_images") == "1"
+
+	scope := deleteScopeItem
+	if _, ok := r.Form["type"]; ok {
+		scope = deleteScopeType
+	} else if _, ok := r.Form["color"]; ok {
+		scope = deleteScopeKey
+	} else if _, ok := r.Form["size"]; ok {
+		scope = deleteScopeKey
+	}
+
+	if !limiter.Allow() {
+		printError(w, "flood_limit")
+		return
+	}
 
+	valid, err := store.IsValidToken(token)
 	if err != nil {
-		log.Printf("Error creating stmt: %v\n", err)
+		log.Print(err)
 		http.Error(w, "500 internal server error", 500)
 		return
 	}
-	defer stmt.Close()
+	if !valid {
+		printError(w, "invalid_token")
+		return
+	}
 
-	_, err = stmt.Exec(token, shop_id, id, color, size, description, type_, image_ids)
+	if key.Item_id == "" {
+		printError(w, "invalid_request")
+		return
+	}
+
+	// the blobs of the deleted images are only known beforehand
+	blobs := map[string]string{}
+	if deleteImages {
+		if blobs, err = store.ImageBlobs(token); err != nil {
+			log.Print(err)
+			http.Error(w, "500 internal server error", 500)
+			return
+		}
+	}
+	deleted, image_ids, err := store.DeleteItems(token, scope, key, type_, deleteImages)
 	if err != nil {
-		log.Printf("Error request execution: %v\n", err)
+		log.Print(err)
 		http.Error(w, "500 internal server error", 500)
 		return
 	}
+	if deleted == 0 {
+		printError(w, "invalid_id")
+		return
+	}
+	released := []string{}
+	for _, image_id := range image_ids {
+		released = append(released, blobs[image_id])
+	}
+	if err = releaseBlobs(released); err != nil {
+		log.Print(err)
+	}
 
-	printResult(w, "\"\"")
+	json_images, _ := json.Marshal(image_ids)
+	printResult(w, fmt.Sprintf(`{"types":%d,"images":%s}`, deleted, json_images))
 }
 
-func getBestType(db *sql.DB, tx *sql.Tx, shop_id, id, color, size, description string, params []float64) (err error, success bool, bestType, bestParams, resultImageList string) {
-	stmt, err := tx.Prepare(fmt.Sprintf(`select token, image_list, type, %v from items where 
-		shop_id == ? AND item_id == ? AND color == ? AND size == ? AND description == ?`, strings.Join(paramNames, ", ")))
-	if err != nil {
-		log.Printf("Error creating stmt: %v\n", err)
+// schemaHandler returns the schema that applies to a category of the
+// token's shop (GET), or sets the shop's schema for the category from
+// the JSON array in "params" (POST). POST with delete=1 deletes it, so
+// that the next more general schema applies again.
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	category := r.FormValue("category")
+
+	if !limiter.Allow() {
+		printError(w, "flood_limit")
 		return
 	}
-	defer stmt.Close()
 
-	rows, err := stmt.Query(shop_id, id, color, size, description)
+	valid, err := store.IsValidToken(token)
 	if err != nil {
-		log.Printf("Error query execution: %v\n", err)
+		log.Print(err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+	if !valid {
+		printError(w, "invalid_token")
 		return
 	}
-	defer rows.Close()
 
-	success = false
-	var minL2Norm float64
+	shop_id, err := store.GetShopID(token)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
 
-	for rows.Next() {
-		var token, image_list, type_ string
-		dest := make([]interface{}, 3 + len(paramNames))
-		dest[0] = &token
-		dest[1] = &image_list
-		dest[2] = &type_
-		for i := range paramNames {
-			dest[i+3] = new(float64)
+	if r.Method == http.MethodPost {
+		if r.FormValue("delete") == "1" {
+			deleted, err := store.DeleteSchema(shop_id, category)
+			if err != nil {
+				log.Print(err)
+				http.Error(w, "500 internal server error", 500)
+				return
+			}
+			if !deleted {
+				printError(w, "invalid_id")
+				return
+			}
+			printResult(w, `""`)
+			return
 		}
 
-		if err = rows.Scan(dest...); err != nil {
+		schema, ok := parseSchemaForm(r, shop_id, category)
+		if !ok {
+			printError(w, "invalid_request")
+			return
+		}
+		if err = store.SaveSchema(schema); err != nil {
 			log.Print(err)
+			http.Error(w, "500 internal server error", 500)
 			return
 		}
+		printResult(w, `""`)
+		return
+	}
 
-		currentParams := make([]float64, len(paramNames))
-		for i := range paramNames {
-			currentParams[i] = *(dest[i+3].(*float64))
-		}
+	schema, err := schemaFor(shop_id, category)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+	json_result, err := json.Marshal(schema.Params)
+	if err != nil {
+		log.Printf("Error json serializing: %v\n", err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+	printResult(w, string(json_result))
+}
+
+// parseSchemaForm reads a schema from the JSON array in the "params"
+// field. ok is false if it is malformed or fails paramSchema.check.
+func parseSchemaForm(r *http.Request, shop_id, category string) (schema paramSchema, ok bool) {
+	schema = paramSchema{Shop_id: shop_id, Category: category}
+	if err := json.Unmarshal([]byte(r.FormValue("params")), &schema.Params); err != nil {
+		return schema, false
+	}
+	return schema, schema.check() == nil
+}
+
+// typeMatch is an item type found for the requested params.
+type typeMatch struct {
+	Type string `json:"type"`
+	Params map[string]float64 `json:"params"`
+	Image_ids []string `json:"image_ids"`
+	Distance float64 `json:"distance"`
+	// Fit maps the distance to (0, 1], where 1 is an exact match.
+	Fit float64 `json:"fit"`
+	// only set by explainMatches
+	Explain []paramContribution `json:"explain,omitempty"`
+	vector []float64
+	// the terms of Distance by param, in schema order
+	contributions []float64
+}
 
-		//var valid bool
-		//valid, err = isValidToken(db, token)
-		//if err != nil {
-		//	log.Print(err)
-		//	return
-		//}
-		//if !valid {
-		//	continue
-		//}
+// paramContribution is the part one param has in the distance of a type.
+type paramContribution struct {
+	Name string `json:"name"`
+	Requested float64 `json:"requested"`
+	Item float64 `json:"item"`
+	Weight float64 `json:"weight"`
+	// (item - requested) * weight
+	Difference float64 `json:"difference"`
+	Contribution float64 `json:"contribution"`
+	// of the distance, 0 for an exact match
+	Share float64 `json:"share"`
+	// whether the garment is "larger" or "smaller" than the shopper's
+	// measurement, or "equal"
+	Garment string `json:"garment"`
+}
 
-		l2norm := getL2Norm(params, currentParams)
-		if !success || l2norm < minL2Norm {
-			success = true
-			bestType = type_
-			bestParams = strings.ReplaceAll(fmt.Sprint(currentParams), " ", ",")
-			resultImageList = image_list
-			minL2Norm = l2norm
+// explainMatches fills in Explain of matches ranked by rankTypes for the
+// same schema and params.
+func explainMatches(matches []typeMatch, schema paramSchema, params map[string]float64) {
+	for i, match := range matches {
+		explain := make([]paramContribution, len(schema.Params))
+		for j, p := range schema.Params {
+			c := paramContribution{Name: p.Name, Requested: params[p.Name], Item: match.vector[j], Weight: p.Weight,
+				Contribution: match.contributions[j]}
+			c.Difference = (c.Item - c.Requested) * c.Weight
+			if match.Distance != 0 {
+				c.Share = c.Contribution / match.Distance
+			}
+			switch {
+			case c.Item > c.Requested:
+				c.Garment = "larger"
+			case c.Item < c.Requested:
+				c.Garment = "smaller"
+			default:
+				c.Garment = "equal"
+			}
+			explain[j] = c
 		}
+		matches[i].Explain = explain
+	}
+}
 
+// loadItemTypes returns the types of an item with the schema they are
+// measured with.
+func loadItemTypes(shop_id string, key itemKey) ([]itemRow, paramSchema, error) {
+	types, err := store.ItemTypes(shop_id, key)
+	if err != nil || len(types) == 0 {
+		return types, paramSchema{}, err
 	}
-	if rows.Err() != nil {
-		err = rows.Err()
-		log.Print(err)
-		return
+	schema, err := schemaFor(shop_id, types[0].Category)
+	return types, schema, err
+}
+
+// rankTypes returns up to k of types closest to params, nearest first.
+// Types that lack a param of the schema are skipped.
+func rankTypes(shop_id string, types []itemRow, schema paramSchema, params map[string]float64, k int) []typeMatch {
+	query, ok := schema.vector(params)
+	if !ok {
+		return []typeMatch{}
+	}
+	metric := metricFor(shop_id, types[0].Category, types[0].Item_id)
+	if m, ok := metric.(categoryCovariance); ok {
+		metric = m.forSchema(shop_id, types[0].Category, schema)
+	}
+	if !metricFits(metric, len(query)) {
+		log.Printf("Metric for %v/%v doesn't fit its schema, using %v\n", shop_id, types[0].Item_id, defaultMetric)
+		metric = metrics[defaultMetric]
+	}
+	weights := schema.weights()
+
+	matches := []typeMatch{}
+	for _, item := range types {
+		vector, ok := schema.vector(item.Params)
+		if !ok {
+			continue
+		}
+		contributions := metric.Contributions(query, vector, weights)
+		distance := sumContributions(contributions)
+		if item.Image_ids == nil {
+			item.Image_ids = []string{}
+		}
+		matches = append(matches, typeMatch{Type: item.Type, Params: item.Params, Image_ids: item.Image_ids,
+			Distance: distance, Fit: 1 / (1 + distance), vector: vector, contributions: contributions})
+	}
+	// stable, so that ties keep the store order like before
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Distance < matches[j].Distance
+	})
+	if len(matches) > k {
+		matches = matches[:k]
 	}
-	return
+	return matches
 }
 
+// getNearestTypes returns up to k types of the item closest to params,
+// nearest first.
+func getNearestTypes(shop_id string, key itemKey, params map[string]float64, k int) ([]typeMatch, error) {
+	types, schema, err := loadItemTypes(shop_id, key)
+	if err != nil || len(types) == 0 {
+		return []typeMatch{}, err
+	}
+	return rankTypes(shop_id, types, schema, params, k), nil
+}
+
+// getHandler answers the type of an item that fits the params best, or
+// the k best ones. With explain=1, which needs the shop's token or an
+// admin session, it answers every type (or the k best) with the part
+// each param has in its distance, without counting the request.
 func getHandler(w http.ResponseWriter, r *http.Request) {
 	shop_id := r.FormValue("shop_id")
-	id := r.FormValue("id")
-	color := r.FormValue("color")
-	size := r.FormValue("size")
-	description := r.FormValue("description")
-	params := make([]float64, len(paramNames))
-	for i, name := range paramNames {
+	key := itemKey{r.FormValue("id"), r.FormValue("color"), r.FormValue("size"), r.FormValue("description")}
+	k := 0
+	if r.FormValue("k") != "" {
 		var err error
-		params[i], err = strconv.ParseFloat(r.FormValue(name), 10)
-		if err != nil || r.FormValue(name) == "" {
+		k, err = strconv.Atoi(r.FormValue("k"))
+		if err != nil || k < 1 {
 			printError(w, "invalid_request")
 			return
 		}
+		if k > maxNearestTypes {
+			k = maxNearestTypes
+		}
+	}
+	explain := r.FormValue("explain") == "1"
+	if explain {
+		allowed, err := canExplain(r, shop_id)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, "500 internal server error", 500)
+			return
+		}
+		if !allowed {
+			printError(w, "invalid_token")
+			return
+		}
 	}
 
-	db, err := sql.Open("sqlite3", "sqlite3.db")
+	types, schema, err := loadItemTypes(shop_id, key)
 	if err != nil {
-		log.Printf("Error opening database: %v\n", err)
+		log.Print(err)
 		http.Error(w, "500 internal server error", 500)
 		return
 	}
-	defer db.Close()
-
-	tx, err := db.Begin()
-	if err != nil {
-		log.Printf("Error creating database transaction: %v\n", err)
-		http.Error(w, "500 internal server error", 500)
+	if len(types) == 0 {
+		printError(w, "invalid_id")
+		return
+	}
+	query, errs := readGetParams(shop_id, types[0].Category, schema, r.FormValue)
+	if len(errs) != 0 {
+		printParamErrors(w, errs)
 		return
 	}
-	//defer tx.Commit()
 
-	err, success, bestType, bestParams, resultImageList := getBestType(db, tx, shop_id, id, color, size, description, params)
-	if err != nil {
-		http.Error(w, "500 internal server error", 500)
+	limit := k
+	if limit == 0 {
+		limit = 1
+		if explain {
+			limit = len(types)
+		}
+	}
+	matches := rankTypes(shop_id, types, query.schema, query.params, limit)
+	if len(matches) == 0 {
+		printError(w, "invalid_id")
 		return
 	}
-	tx.Commit()
 
-	if success {
-		stmt2, err := db.Prepare(`update items set requests_count = requests_count + 1 where shop_id == ? AND item_id == ? AND color == ? AND size == ? AND description == ? AND type == ?`)
-		if err != nil {
-			log.Printf("Error creating stmt: %v\n", err)
-			http.Error(w, "500 internal server error", 500)
-			return
+	best := matches[0]
+	maxDistance := maxDistanceFor(shop_id, key.Item_id)
+	noFit := maxDistance > 0 && best.Distance > maxDistance
+	error_code := ""
+	if noFit {
+		error_code = "no_good_fit"
+	}
+	// the params left out, if any, and what was done about them
+	missing := ""
+	if len(query.missing) != 0 {
+		json_missing, _ := json.Marshal(query.missing)
+		if query.imputed {
+			missing = `,"imputed":` + string(json_missing)
+		} else {
+			missing = `,"ignored":` + string(json_missing)
+		}
+	}
+
+	if explain {
+		explainMatches(matches, query.schema, query.params)
+	} else {
+		// only the best fit counts as requested; if it's too far off to
+		// fit, it counts as a miss instead so the shop sees which sizes
+		// it lacks
+		if noFit {
+			err = store.IncrementMisses(shop_id, key, best.Type)
+		} else {
+			err = store.IncrementRequests(shop_id, key, best.Type)
 		}
-		_, err = stmt2.Exec(shop_id, id, color, size, description, bestType)
-		stmt2.Close()
 		if err != nil {
-			log.Printf("Error request execution: %v\n", err)
+			log.Print(err)
 			http.Error(w, "500 internal server error", 500)
 			return
 		}
+	}
 
-		fmt.Fprintf(w, `{"error":"","result":["%v"],"type":"%v","params":%v}`, 
-			strings.ReplaceAll(resultImageList, ",", `","`), bestType, bestParams)
-	} else {
-		printError(w, "invalid_id")
+	if k == 0 && !explain {
+		// all params of the type, also the ones it wasn't matched on
+		vector, _ := schema.vector(best.Params)
+		fmt.Fprintf(w, `{"error":"%v","result":["%v"],"type":"%v","params":%v`, error_code,
+			strings.Join(best.Image_ids, `","`), best.Type, strings.ReplaceAll(fmt.Sprint(vector), " ", ","))
+		if noFit {
+			fmt.Fprintf(w, `,"distance":%v`, best.Distance)
+		}
+		fmt.Fprint(w, missing + "}")
+		return
 	}
-}
 
-func isValidImageID(db *sql.DB, id string) (bool, error) {
-	tx, err := db.Begin()
+	json_result, err := json.Marshal(matches)
 	if err != nil {
-		return false, fmt.Errorf("Error creating database transaction: %v\n", err)
+		log.Printf("Error json serializing: %v\n", err)
+		http.Error(w, "500 internal server error", 500)
+		return
 	}
-	defer tx.Commit()
+	fmt.Fprintf(w, `{"error":"%v","result":%v%v}`, error_code, string(json_result), missing)
+}
 
-	stmt, err := tx.Prepare("select token from images where image_id == ?")
-	if err != nil {
-		return false, fmt.Errorf("Error creating stmt: %v\n", err)
+// canExplain reports whether the request may see /get explanations for
+// a shop: with an admin session or a valid token of the shop.
+func canExplain(r *http.Request, shop_id string) (bool, error) {
+	if cookie, err := r.Cookie("uuid"); err == nil {
+		ok, err := store.CheckUUID(cookie.Value)
+		if err != nil || ok {
+			return ok, err
+		}
 	}
-	defer stmt.Close()
-	rows, err := stmt.Query(id)
-	if err != nil {
-		return false, fmt.Errorf("Error query execution: %v\n", err)
+	token := r.FormValue("token")
+	valid, err := store.IsValidToken(token)
+	if err != nil || !valid {
+		return false, err
 	}
-	defer rows.Close()
-	if !rows.Next() {
-		return false, nil
+	token_shop_id, err := store.GetShopID(token)
+	return token_shop_id == shop_id, err
+}
+
+// batchQuery is one item of /get-batch. Params and Unit are only read
+// from the "queries" field; with "keys" all items share the params of
+// the form.
+type batchQuery struct {
+	Id string `json:"id"`
+	Color string `json:"color"`
+	Size string `json:"size"`
+	Description string `json:"description"`
+	Unit string `json:"unit"`
+	Params map[string]json.Number `json:"params"`
+}
+
+func (q batchQuery) value(name string) string {
+	if name == "unit" {
+		return q.Unit
 	}
+	return string(q.Params[name])
+}
 
-	var token string
-	if err = rows.Scan(&token); err != nil {
-		return false, err
+// batchResult is what /get would have answered for one query.
+type batchResult struct {
+	Error string `json:"error"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Result []string `json:"result,omitempty"`
+	Type string `json:"type,omitempty"`
+	Params []float64 `json:"params,omitempty"`
+	Distance float64 `json:"distance,omitempty"`
+	Imputed []string `json:"imputed,omitempty"`
+	Ignored []string `json:"ignored,omitempty"`
+}
+
+// getBatchHandler answers many /get queries of a shop at once, either
+// the items in the JSON array "keys" for the params of the form or the
+// JSON array "queries" with params of their own. The results are in the
+// order of the queries, each with its own error.
+func getBatchHandler(w http.ResponseWriter, r *http.Request) {
+	shop_id := r.FormValue("shop_id")
+	source := r.FormValue("keys")
+	shared := true
+	if r.FormValue("queries") != "" {
+		if source != "" {
+			printError(w, "invalid_request")
+			return
+		}
+		source = r.FormValue("queries")
+		shared = false
 	}
-	if err = rows.Err(); err != nil {
-		return false, err
+	queries := []batchQuery{}
+	if err := json.Unmarshal([]byte(source), &queries); err != nil || len(queries) == 0 || len(queries) > maxBatchQueries {
+		printError(w, "invalid_request")
+		return
 	}
 
-	stmt2, err := tx.Prepare("select exp_time from tokens where token == ?")
-	if err != nil {
-		return false, fmt.Errorf("Error creating stmt: %v\n", err)
+	keys := make([]itemKey, len(queries))
+	for i, q := range queries {
+		keys[i] = itemKey{q.Id, q.Color, q.Size, q.Description}
 	}
-	defer stmt2.Close()
-	rows2, err := stmt2.Query(token)
+	all_types, err := store.ItemTypesBatch(shop_id, keys)
 	if err != nil {
-		return false, fmt.Errorf("Error query execution: %v\n", err)
+		log.Print(err)
+		http.Error(w, "500 internal server error", 500)
+		return
 	}
-	defer rows2.Close()
-	if !rows2.Next() {
-		return false, nil
+
+	schemas := map[string]paramSchema{}
+	results := make([]batchResult, len(queries))
+	counts := map[typeKey]requestCounts{}
+	for i, q := range queries {
+		types := all_types[i]
+		if len(types) == 0 {
+			results[i].Error = "invalid_id"
+			continue
+		}
+		schema, ok := schemas[types[0].Category]
+		if !ok {
+			schema, err = schemaFor(shop_id, types[0].Category)
+			if err != nil {
+				log.Print(err)
+				http.Error(w, "500 internal server error", 500)
+				return
+			}
+			schemas[types[0].Category] = schema
+		}
+
+		value := q.value
+		if shared {
+			value = r.FormValue
+		}
+		query, errs := readGetParams(shop_id, types[0].Category, schema, value)
+		if len(errs) != 0 {
+			results[i] = batchResult{Error: "invalid_params", Fields: errs}
+			continue
+		}
+		matches := rankTypes(shop_id, types, query.schema, query.params, 1)
+		if len(matches) == 0 {
+			results[i].Error = "invalid_id"
+			continue
+		}
+
+		// counted like /get counts them
+		best := matches[0]
+		vector, _ := schema.vector(best.Params)
+		results[i] = batchResult{Result: best.Image_ids, Type: best.Type, Params: vector}
+		if query.imputed {
+			results[i].Imputed = query.missing
+		} else {
+			results[i].Ignored = query.missing
+		}
+		k := typeKey{shop_id, keys[i], best.Type}
+		c := counts[k]
+		if maxDistance := maxDistanceFor(shop_id, q.Id); maxDistance > 0 && best.Distance > maxDistance {
+			results[i].Error = "no_good_fit"
+			results[i].Distance = best.Distance
+			c.Misses++
+		} else {
+			c.Requests++
+		}
+		counts[k] = c
 	}
 
-	var exp_time int64
-	if err = rows2.Scan(&exp_time); err != nil {
-		return false, err
+	if len(counts) != 0 {
+		if err = store.AddRequests(counts); err != nil {
+			log.Print(err)
+			http.Error(w, "500 internal server error", 500)
+			return
+		}
 	}
-	if err = rows2.Err(); err != nil {
-		return false, err
+
+	json_result, err := json.Marshal(results)
+	if err != nil {
+		log.Printf("Error json serializing: %v\n", err)
+		http.Error(w, "500 internal server error", 500)
+		return
 	}
+	printResult(w, string(json_result))
+}
 
-	return exp_time > time.Now().Unix(), nil
+// sizeMatch is the best fitting type of one size of an item.
+type sizeMatch struct {
+	Size string `json:"size"`
+	Description string `json:"description"`
+	typeMatch
 }
 
-func imageHandler(w http.ResponseWriter, r *http.Request) {
-	id := mux.Vars(r)["id"]
+// recommendSizes ranks the sizes of an item in a color by how well their
+// best type fits params, best first. Sizes whose types lack a param of
+// their schema are left out. Params are read like the ones of /get, so
+// the ones the shopper left out are handled according to missingParams.
+func recommendSizes(shop_id, item_id, color string, r *http.Request) ([]sizeMatch, map[string]string, error) {
+	types, err := store.ItemColorTypes(shop_id, item_id, color)
+	if err != nil {
+		return nil, nil, err
+	}
+	byKey := map[itemKey][]itemRow{}
+	keys := []itemKey{}
+	for _, item := range types {
+		if byKey[item.itemKey] == nil {
+			keys = append(keys, item.itemKey)
+		}
+		byKey[item.itemKey] = append(byKey[item.itemKey], item)
+	}
+
+	// sizes of an item usually share a category, so params are read
+	// once per schema, the way /get reads them
+	queries := map[string]getParams{}
+	matches := []sizeMatch{}
+	for _, key := range keys {
+		category := byKey[key][0].Category
+		query, ok := queries[category]
+		if !ok {
+			schema, err := schemaFor(shop_id, category)
+			if err != nil {
+				return nil, nil, err
+			}
+			var errs map[string]string
+			if query, errs = readGetParams(shop_id, category, schema, r.FormValue); len(errs) != 0 {
+				return nil, errs, nil
+			}
+			queries[category] = query
+		}
+		best := rankTypes(shop_id, byKey[key], query.schema, query.params, 1)
+		if len(best) != 0 {
+			matches = append(matches, sizeMatch{key.Size, key.Description, best[0]})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Distance < matches[j].Distance
+	})
+	return matches, nil, nil
+}
 
-	db, err := sql.Open("sqlite3", "sqlite3.db")
+// recommendHandler answers which size of an item fits the shopper's
+// params best. Unlike /get it doesn't count requests.
+func recommendHandler(w http.ResponseWriter, r *http.Request) {
+	shop_id := r.FormValue("shop_id")
+	item_id := r.FormValue("id")
+
+	matches, errs, err := recommendSizes(shop_id, item_id, r.FormValue("color"), r)
 	if err != nil {
-		log.Printf("Error opening database: %v\n", err)
+		log.Print(err)
 		http.Error(w, "500 internal server error", 500)
 		return
 	}
-	defer db.Close()
+	if len(errs) != 0 {
+		printParamErrors(w, errs)
+		return
+	}
+	if len(matches) == 0 {
+		printError(w, "invalid_id")
+		return
+	}
 
-	valid, err := isValidImageID(db, id)
+	json_result, err := json.Marshal(matches)
 	if err != nil {
-		log.Print("Database error:", err)
+		log.Printf("Error json serializing: %v\n", err)
 		http.Error(w, "500 internal server error", 500)
 		return
 	}
-	if !valid {
-		http.Error(w, "404 file not found", 404)
-		return
+	error_code := ""
+	if maxDistance := maxDistanceFor(shop_id, item_id); maxDistance > 0 && matches[0].Distance > maxDistance {
+		error_code = "no_good_fit"
 	}
-	file, err := os.Open("./images/" + id + ".jpg")
+	fmt.Fprintf(w, `{"error":"%v","result":%v}`, error_code, string(json_result))
+}
+
+func serveImageFile(w http.ResponseWriter, path string) {
+	file, err := os.Open(path)
 	if err != nil {
 		http.Error(w, "404 file not found", 404)
 		return
 	}
+	serveImage(w, file)
+}
+
+// serveImage writes an opened image and closes it.
+func serveImage(w http.ResponseWriter, file *os.File) {
 	defer file.Close()
 
 	fileStat, _ := file.Stat()
@@ -583,139 +921,281 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, file)
 }
 
-func imageSmallHandler(w http.ResponseWriter, r *http.Request) {
-	id := mux.Vars(r)["id"]
-
-	db, err := sql.Open("sqlite3", "sqlite3.db")
+// imageBlob returns the blob of any image, or responds with an error.
+func imageBlob(w http.ResponseWriter, image_id string) (string, bool) {
+	blob_id, err := store.ImageBlob(image_id)
 	if err != nil {
-		log.Printf("Error opening database: %v\n", err)
+		log.Print("Database error:", err)
 		http.Error(w, "500 internal server error", 500)
-		return
+		return "", false
 	}
-	defer db.Close()
+	if blob_id == "" {
+		http.Error(w, "404 file not found", 404)
+		return "", false
+	}
+	return blob_id, true
+}
 
-	valid, err := isValidImageID(db, id)
+// validImageBlob is imageBlob for the images of active tokens.
+func validImageBlob(w http.ResponseWriter, image_id string) (string, bool) {
+	valid, err := store.IsValidImageID(image_id)
 	if err != nil {
 		log.Print("Database error:", err)
 		http.Error(w, "500 internal server error", 500)
-		return
+		return "", false
 	}
 	if !valid {
 		http.Error(w, "404 file not found", 404)
+		return "", false
+	}
+	return imageBlob(w, image_id)
+}
+
+// imageHandler serves an uploaded image, or with width, height, fit
+// ("contain" or "cover") or quality parameters the version of it resized
+// to the matching preset of imagePresets.
+func imageHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	resized := r.FormValue("width") != "" || r.FormValue("height") != "" ||
+		r.FormValue("fit") != "" || r.FormValue("quality") != ""
+	spec, ok := imagePreset(r.FormValue)
+	if resized && !ok {
+		http.Error(w, "400 unknown image size", 400)
 		return
 	}
-	file, err := os.Open("./images/small/" + id + ".jpg")
-	if err != nil {
-		http.Error(w, "404 file not found", 404)
+
+	blob_id, ok := validImageBlob(w, id)
+	if !ok {
+		return
+	}
+	if !resized {
+		serveImageFile(w, "./images/" + blob_id + ".jpg")
 		return
 	}
-	defer file.Close()
 
-	fileStat, _ := file.Stat()
-	fileSize := strconv.FormatInt(fileStat.Size(), 10)
-	w.Header().Set("Content-Type", "image/jpg")
-	w.Header().Set("Content-Length", fileSize)
-	io.Copy(w, file)
+	file, err := resizedImages.open(blob_id, spec)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+	serveImage(w, file)
 }
 
-func createTablesIfNotExists(db *sql.DB) {
-	sqlStmt := fmt.Sprintf(`
-	create table if not exists images (
-		id integer not null primary key autoincrement, 
-		token text not null, 
-		image_id text not null
-	);
-
-	create table if not exists items (
-		id integer not null primary key autoincrement, 
-		token text not null,
-		shop_id text not null,
-		item_id text not null, 
-		color text,
-		size text,
-		description text,
-		type integer not null,
-		%s,
-		image_list text,
-		requests_count integer not null
-
-	);
-
-	create table if not exists tokens (
-		token text not null primary key,
-		exp_time time not null,
-		description text,
-		shop_id text
-	);
+func imageSmallHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
 
-	create table if not exists admin_uuids (
-		uuid text not null primary key
-	);
+	blob_id, ok := validImageBlob(w, id)
+	if !ok {
+		return
+	}
+	serveImageFile(w, "./images/small/" + blob_id + ".jpg")
+}
 
-	`, strings.Join(paramNames, " float,\n		") + " float")
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc(prefix + "/upload", uploadHandler).Methods("POST")
+	r.HandleFunc(prefix + "/update", updateHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix + "/delete", deleteHandler).Methods("POST")
+	r.HandleFunc(prefix + "/get", getHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix + "/get-batch", getBatchHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix + "/recommend", recommendHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix + "/schema", schemaHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix + "/image/{id}", imageHandler).Methods("GET")
+	r.HandleFunc(prefix + "/image-small/{id}", imageSmallHandler).Methods("GET")
+	r.HandleFunc(prefix + "/dc-admin-p/", loginHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix + "/dc-admin-p/tokens", tokensHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix + "/dc-admin-p/items", itemsHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix + "/dc-admin-p/schemas", schemasHandler).Methods("GET", "POST")
+	r.HandleFunc(prefix + "/dc-admin-p/static/{name}", staticHandler).Methods("GET")
+	r.HandleFunc(prefix + "/dc-admin-p/image/{id}", imagePanelHandler).Methods("GET")
+	r.HandleFunc(prefix + "/dc-admin-p/preview/{id}", previewHandler).Methods("GET")
+	return r
+}
 
-	_, err := db.Exec(sqlStmt)
-	if err != nil {
-		log.Fatal("Error creating tables:", err)
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatal(err)
 	}
 }
 
-func main() {
+// run runs the command named by args[0], or the server if there is no
+// command it knows, such as when args are the flags of a test binary.
+func run(args []string) error {
 	rand.Seed(time.Now().UTC().UnixNano())
+	if err := checkMetrics(); err != nil {
+		return err
+	}
+	if err := checkMissingParams(); err != nil {
+		return err
+	}
+
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "migrate":
+		return migrateCommand(args[1:])
+	case "restore":
+		return restoreCommand(args[1:])
+	case "backup", "export":
+		// a backup must not migrate the database it copies
+		s, err := openStoreReadOnly()
+		if err != nil {
+			return err
+		}
+		store = s
+		defer s.Close()
+		if command == "backup" {
+			return backupCommand(args[1:])
+		}
+		return exportCommand(args[1:])
+	}
+
 	os.MkdirAll(filepath.Join(".", "images/previews"), os.ModePerm)
 	os.MkdirAll(filepath.Join(".", "images/small"), os.ModePerm)
+	cache, err := newImageCache(imageCacheDir, imageCacheBytes)
+	if err != nil {
+		return err
+	}
+	resizedImages = cache
 
-	db, err := sql.Open("sqlite3", "sqlite3.db")
+	s, err := openStore()
 	if err != nil {
-		log.Fatal("Error opening database:", err)
+		return err
 	}
-	defer db.Close()
+	store = s
+	// store is replaced by the index in listenAndServe
+	defer func() { store.Close() }()
 
-	createTablesIfNotExists(db)
+	switch command {
+	case "gc":
+		return gcCommand(args[1:])
+	case "calibrate":
+		return calibrateCommand(args[1:])
+	}
+	return listenAndServe(s)
+}
 
-	for _, name := range templateNames {
-		file, err := os.Open("templates/" + name + ".html")
-		if err != nil {
-			log.Fatal("Error opening template: ", name)
-		}
+// listenAndServe runs the HTTP server on s until SIGINT or SIGTERM.
+func listenAndServe(s Store) error {
+	idx, err := newItemIndex(s)
+	if err != nil {
+		return err
+	}
+	store = idx
+	idx.startRequestsFlusher()
+	reloadOnSIGHUP(idx)
+	if err = writePIDFile(); err != nil {
+		return err
+	}
+	defer removePIDFile()
+	startImageCollector()
+	startTrashPurger()
 
-		template, err := ioutil.ReadAll(file)
+	for _, name := range templateNames {
+		template, err := ioutil.ReadFile("templates/" + name + ".html")
 		if err != nil {
-			log.Fatal("Error reading template: ", name)
+			return fmt.Errorf("Error reading template %v: %v\n", name, err)
 		}
 		templates[name] = string(template)
-		file.Close()
 	}
 
 	for _, name := range staticNames {
-		file, err := os.Open("static/" + name)
+		content, err := ioutil.ReadFile("static/" + name)
 		if err != nil {
-			log.Fatal("Error opening file: ", name)
-		}
-
-		content, err := ioutil.ReadAll(file)
-		if err != nil {
-			log.Fatal("Error reading file: ", name)
+			return fmt.Errorf("Error reading file %v: %v\n", name, err)
 		}
 		static[name] = string(content)
-		file.Close()
 	}
 	
-	r := mux.NewRouter()
-	r.HandleFunc(prefix + "/upload", uploadHandler).Methods("POST")
-	r.HandleFunc(prefix + "/update", updateHandler).Methods("GET", "POST")
-	r.HandleFunc(prefix + "/get", getHandler).Methods("GET", "POST")
-	r.HandleFunc(prefix + "/image/{id}", imageHandler).Methods("GET")
-	r.HandleFunc(prefix + "/image-small/{id}", imageSmallHandler).Methods("GET")
-	r.HandleFunc(prefix + "/dc-admin-p/", loginHandler).Methods("GET", "POST")
-	r.HandleFunc(prefix + "/dc-admin-p/tokens", tokensHandler).Methods("GET", "POST")
-	r.HandleFunc(prefix + "/dc-admin-p/items", itemsHandler).Methods("GET", "POST")
-	r.HandleFunc(prefix + "/dc-admin-p/static/{name}", staticHandler).Methods("GET")
-	r.HandleFunc(prefix + "/dc-admin-p/image/{id}", imagePanelHandler).Methods("GET")
-	r.HandleFunc(prefix + "/dc-admin-p/preview/{id}", previewHandler).Methods("GET")
 	server = &http.Server{
-		Handler: r,
+		Handler: newRouter(),
 		Addr: ":" + port,
 	}
-	server.ListenAndServe()
-}
\ No newline at end of file
+
+	// shut down on SIGINT/SIGTERM so that the deferred Close writes the
+	// pending requests counts
+	done := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		server.Shutdown(context.Background())
+		close(done)
+	}()
+	if err = server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-done
+	return nil
+}
+
+// reloadOnSIGHUP reloads the index when the process gets SIGHUP.
+func reloadOnSIGHUP(idx *itemIndex) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := idx.reload(); err != nil {
+				log.Printf("Error reloading the index: %v\n", err)
+			} else {
+				log.Printf("Reloaded the index\n")
+			}
+		}
+	}()
+}
+
+// writePIDFile records the process id of the server in pidFile for
+// signalServer.
+func writePIDFile() error {
+	if pidFile == "" {
+		return nil
+	}
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid()) + "\n"), 0644); err != nil {
+		return fmt.Errorf("Error writing pid file: %v\n", err)
+	}
+	return nil
+}
+
+func removePIDFile() {
+	if pidFile == "" {
+		return
+	}
+	if err := os.Remove(pidFile); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing pid file: %v\n", err)
+	}
+}
+
+// signalServer sends SIGHUP to the server recorded in pidFile, if one
+// runs, so that it reloads the item index after a command changed the
+// database outside of it. A server on another machine or in another
+// directory isn't found and must be sent SIGHUP by hand.
+func signalServer() {
+	if pidFile == "" {
+		return
+	}
+	content, err := ioutil.ReadFile(pidFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading pid file: %v\n", err)
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		log.Printf("Invalid pid file %v: %v\n", pidFile, err)
+		return
+	}
+	process, err := os.FindProcess(pid)
+	if err == nil {
+		err = process.Signal(syscall.SIGHUP)
+	}
+	if err != nil {
+		log.Printf("Error signaling the server (pid %d), restart it or send it SIGHUP to apply: %v\n", pid, err)
+		return
+	}
+	log.Printf("Sent SIGHUP to the server (pid %d) to reload its index\n", pid)
+}
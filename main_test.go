@@ -14,10 +14,13 @@ import (
 	"context"
 	"strings"
 	"strconv"
+	"path/filepath"
 )
 
 var (
 	baseURL = "http://localhost:32851/decety/"
+	// written by TestAll
+	sampleImage = "./sample.jpg"
 
 	imageIDsByToken = map[string][]string{}
 )
@@ -115,7 +118,7 @@ func uploadPhoto(t *testing.T, token, filename string) (int, string) {
 
 func testUploadSuccess(token string) func(t *testing.T) {
 	return func(t *testing.T) {
-		status_code, body := uploadPhoto(t, token, "./sample.jpg")
+		status_code, body := uploadPhoto(t, token, sampleImage)
 		if status_code != 200 {
 			t.Fatalf("Status code doesn't equal 200")
 		}
@@ -138,7 +141,7 @@ func testUploadSuccess(token string) func(t *testing.T) {
 
 func testUploadFail(token string) func(t *testing.T) {
 	return func(t *testing.T) {
-		status_code, body := uploadPhoto(t, token, "./sample.jpg")
+		status_code, body := uploadPhoto(t, token, sampleImage)
 		if status_code != 200 {
 			t.Fatalf("Status code doesn't equal 200")
 		}
@@ -185,7 +188,18 @@ func getUnixTime(shift time.Duration) string {
 }
 
 func TestAll(t *testing.T) {
-	go main()
+	// the server runs on a fresh database and images directory in a temp
+	// dir, with the templates and static files of the source tree
+	wd, _ := os.Getwd()
+	dir := chdirTemp(t)
+	for _, name := range []string{"templates", "static"} {
+		if err := os.Symlink(filepath.Join(wd, name), filepath.Join(dir, name)); err != nil {
+			t.Fatalf("Error linking %v: %v", name, err)
+		}
+	}
+	writeTestJPEG(t, sampleImage, 600, 800)
+
+	go run(nil)
 	time.Sleep(1000 * time.Millisecond)
 
 	t.Run("Test uploading with invalid token", testUploadFail(""))
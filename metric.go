@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Metric measures how far an item's params are from the requested ones.
+// Both are in the order of the schema in use, which also gives the
+// weights. getNearestTypes picks the item type with the smallest
+// distance, so only the order of distances matters within one metric.
+// The distance is the sum of Contributions, one per param, which /get
+// reports with explain=1.
+type Metric interface {
+	Contributions(query, item, weights []float64) []float64
+}
+
+func sumContributions(contributions []float64) float64 {
+	result := 0.0
+	for _, c := range contributions {
+		result += c
+	}
+	return result
+}
+
+// weightedL2 is the squared Euclidean distance with every param scaled
+// by its weight.
+type weightedL2 struct{}
+
+func (m weightedL2) Contributions(query, item, weights []float64) []float64 {
+	result := make([]float64, len(query))
+	for i := range query {
+		dt := (query[i] - item[i]) * weights[i]
+		result[i] = dt * dt
+	}
+	return result
+}
+
+// weightedL1 is the sum of absolute differences scaled by the weights.
+// A single badly fitting param counts less than with weightedL2.
+type weightedL1 struct{}
+
+func (m weightedL1) Contributions(query, item, weights []float64) []float64 {
+	result := make([]float64, len(query))
+	for i := range query {
+		result[i] = math.Abs(query[i] - item[i]) * weights[i]
+	}
+	return result
+}
+
+// mahalanobis is the squared Mahalanobis distance for a covariance of
+// the params, which accounts for params that grow together. It ignores
+// the weights. Use newMahalanobis to create it.
+type mahalanobis struct {
+	inverse [][]float64
+}
+
+// newMahalanobis inverts the covariance matrix of the params.
+func newMahalanobis(covariance [][]float64) (mahalanobis, error) {
+	inverse, err := invertMatrix(covariance)
+	if err != nil {
+		return mahalanobis{}, fmt.Errorf("Covariance matrix %v", err)
+	}
+	return mahalanobis{inverse}, nil
+}
+
+// invertMatrix inverts a square matrix by Gauss-Jordan elimination.
+func invertMatrix(matrix [][]float64) ([][]float64, error) {
+	n := len(matrix)
+	// Gauss-Jordan elimination on [matrix | identity]
+	a := make([][]float64, n)
+	for i := range matrix {
+		if len(matrix[i]) != n {
+			return nil, fmt.Errorf("is not square\n")
+		}
+		a[i] = make([]float64, 2 * n)
+		copy(a[i], matrix[i])
+		a[i][n + i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, fmt.Errorf("is singular\n")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		scale := a[col][col]
+		for j := range a[col] {
+			a[col][j] /= scale
+		}
+		for row := 0; row < n; row++ {
+			if row == col || a[row][col] == 0 {
+				continue
+			}
+			factor := a[row][col]
+			for j := range a[row] {
+				a[row][j] -= factor * a[col][j]
+			}
+		}
+	}
+	inverse := make([][]float64, n)
+	for i := range a {
+		inverse[i] = a[i][n:]
+	}
+	return inverse, nil
+}
+
+// mustMahalanobis is newMahalanobis for use in config.go.
+func mustMahalanobis(covariance [][]float64) mahalanobis {
+	m, err := newMahalanobis(covariance)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Contributions splits the distance by rows of the inverse covariance,
+// so a param's share includes its interactions with the others and can
+// be negative.
+func (m mahalanobis) Contributions(query, item, weights []float64) []float64 {
+	result := make([]float64, len(query))
+	for i := range query {
+		for j := range query {
+			result[i] += (query[i] - item[i]) * m.inverse[i][j] * (query[j] - item[j])
+		}
+	}
+	return result
+}
+
+// categoryCovariance is the mahalanobis metric with the covariance of
+// the params over the items of the shop and category, or of all shops
+// while the shop has too few, as imputation computes it. Until there is
+// one, fallback is used.
+type categoryCovariance struct {
+	fallback Metric
+}
+
+func (m categoryCovariance) Contributions(query, item, weights []float64) []float64 {
+	return m.fallback.Contributions(query, item, weights)
+}
+
+// forSchema returns the mahalanobis metric of the covariance of the
+// params of schema in a shop and category, or fallback.
+func (m categoryCovariance) forSchema(shop_id, category string, schema paramSchema) Metric {
+	// the model covers the full schema, which schema may be reduced from
+	full, err := schemaFor(shop_id, category)
+	if err != nil {
+		return m.fallback
+	}
+	model := imputeModelFor(shop_id, category, full)
+	if model.samples == 0 {
+		return m.fallback
+	}
+	positions := map[string]int{}
+	for i, p := range full.Params {
+		positions[p.Name] = i
+	}
+	covariance := make([][]float64, len(schema.Params))
+	for a, p := range schema.Params {
+		i, ok := positions[p.Name]
+		if !ok {
+			return m.fallback
+		}
+		covariance[a] = make([]float64, len(schema.Params))
+		for b, q := range schema.Params {
+			covariance[a][b] = model.covariance[i][positions[q.Name]]
+		}
+	}
+	result, err := newMahalanobis(covariance)
+	if err != nil {
+		return m.fallback
+	}
+	return result
+}
+
+// asymmetric is weightedL2 with a separate factor for params where the
+// item is smaller than requested ("too tight") and where it's larger
+// ("too loose").
+type asymmetric struct {
+	tight float64
+	loose float64
+}
+
+func (m asymmetric) Contributions(query, item, weights []float64) []float64 {
+	result := make([]float64, len(query))
+	for i := range query {
+		dt := (item[i] - query[i]) * weights[i]
+		if dt < 0 {
+			result[i] = m.tight * dt * dt
+		} else {
+			result[i] = m.loose * dt * dt
+		}
+	}
+	return result
+}
+
+// metricFor returns the metric used to match items of a shop: the one
+// set for the item in itemMetrics, else the one of its category in
+// categoryMetrics, else the one of the shop in shopMetrics, else
+// defaultMetric. These are only set in config.go, so choosing a metric
+// for a shop takes a rebuild of the server.
+func metricFor(shop_id, category, item_id string) Metric {
+	name, ok := itemMetrics[shop_id + "/" + item_id]
+	if !ok {
+		name, ok = categoryMetrics[shop_id + "/" + category]
+	}
+	if !ok {
+		name, ok = shopMetrics[shop_id]
+	}
+	if !ok {
+		name = defaultMetric
+	}
+	return metrics[name]
+}
+
+// maxDistanceFor returns the distance beyond which no type of the item
+// fits, or 0 if there is no limit.
+func maxDistanceFor(shop_id, item_id string) float64 {
+	if maxDistance, ok := itemMaxDistances[shop_id + "/" + item_id]; ok {
+		return maxDistance
+	}
+	if maxDistance, ok := shopMaxDistances[shop_id]; ok {
+		return maxDistance
+	}
+	return maxFitDistance
+}
+
+// metricFits reports whether m can compare vectors of n params.
+func metricFits(m Metric, n int) bool {
+	if m, ok := m.(mahalanobis); ok {
+		return len(m.inverse) == n
+	}
+	return true
+}
+
+// checkMetrics reports metric settings that metricFor can't use.
+func checkMetrics() error {
+	names := []string{defaultMetric}
+	for _, name := range shopMetrics {
+		names = append(names, name)
+	}
+	for _, name := range categoryMetrics {
+		names = append(names, name)
+	}
+	for _, name := range itemMetrics {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if _, ok := metrics[name]; !ok {
+			return fmt.Errorf("Unknown metric %v\n", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	weights := []float64{1, 2}
+	identity, err := newMahalanobis([][]float64{{1, 0}, {0, 1}})
+	if err != nil {
+		t.Fatalf("Error newMahalanobis: %v", err)
+	}
+	// variances 4 and 1
+	scaled, _ := newMahalanobis([][]float64{{4, 0}, {0, 1}})
+	// strongly correlated params: moving both together is cheap
+	correlated, _ := newMahalanobis([][]float64{{1, 0.9}, {0.9, 1}})
+
+	tests := []struct {
+		name string
+		metric Metric
+		query, item []float64
+		want float64
+	}{
+		{"l2 equal", weightedL2{}, []float64{1, 1}, []float64{1, 1}, 0},
+		{"l2", weightedL2{}, []float64{1, 1}, []float64{2, 3}, 1 + 16},
+		{"l1", weightedL1{}, []float64{1, 1}, []float64{2, 3}, 1 + 4},
+		{"l1 negative", weightedL1{}, []float64{2, 3}, []float64{1, 1}, 1 + 4},
+		{"mahalanobis identity", identity, []float64{0, 0}, []float64{3, 4}, 25},
+		{"mahalanobis scaled", scaled, []float64{0, 0}, []float64{2, 1}, 1 + 1},
+		{"mahalanobis correlated together", correlated, []float64{0, 0}, []float64{1, 1}, 2 / 1.9},
+		{"mahalanobis correlated apart", correlated, []float64{0, 0}, []float64{1, -1}, 2 / 0.1},
+		{"asymmetric tight", asymmetric{3, 1}, []float64{2, 1}, []float64{1, 1}, 3},
+		{"asymmetric loose", asymmetric{3, 1}, []float64{1, 1}, []float64{2, 1}, 1},
+		{"asymmetric mixed", asymmetric{3, 1}, []float64{2, 1}, []float64{1, 2}, 3 + 4},
+	}
+	for _, test := range tests {
+		got := sumContributions(test.metric.Contributions(test.query, test.item, weights))
+		if math.Abs(got - test.want) > 1e-9 {
+			t.Errorf("%v: distance %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNewMahalanobis(t *testing.T) {
+	tests := []struct {
+		name string
+		covariance [][]float64
+		ok bool
+	}{
+		{"diagonal", [][]float64{{2, 0}, {0, 4}}, true},
+		{"needs pivoting", [][]float64{{0, 1}, {1, 0}}, true},
+		{"singular", [][]float64{{1, 2}, {2, 4}}, false},
+		{"not square", [][]float64{{1, 2}, {3}}, false},
+	}
+	for _, test := range tests {
+		m, err := newMahalanobis(test.covariance)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: error %v", test.name, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		// covariance * inverse must be the identity
+		for i := range test.covariance {
+			for j := range test.covariance {
+				sum := 0.0
+				for k := range test.covariance {
+					sum += test.covariance[i][k] * m.inverse[k][j]
+				}
+				want := 0.0
+				if i == j {
+					want = 1
+				}
+				if math.Abs(sum - want) > 1e-9 {
+					t.Errorf("%v: product[%d][%d] = %v", test.name, i, j, sum)
+				}
+			}
+		}
+	}
+}
+
+// useMetrics replaces the metric settings for the duration of a test,
+// with none by category.
+func useMetrics(t *testing.T, shops, items map[string]string) {
+	savedShops, savedCategories, savedItems := shopMetrics, categoryMetrics, itemMetrics
+	shopMetrics, categoryMetrics, itemMetrics = shops, map[string]string{}, items
+	t.Cleanup(func() { shopMetrics, categoryMetrics, itemMetrics = savedShops, savedCategories, savedItems })
+}
+
+func TestMetricFor(t *testing.T) {
+	useMetrics(t, map[string]string{"1": "l1", "2": "asymmetric"}, map[string]string{"1/jeans": "asymmetric"})
+
+	categoryMetrics = map[string]string{"1/shirts": "mahalanobis", "1/jeans": "l2"}
+	tests := []struct {
+		shop_id, category, item_id string
+		want string
+	}{
+		{"1", "", "shirt", "main.weightedL1"},
+		{"1", "shirts", "shirt", "main.categoryCovariance"},
+		{"1", "jeans", "jeans", "main.asymmetric"},
+		{"2", "shirts", "shirt", "main.asymmetric"},
+		{"3", "", "jeans", "main.weightedL2"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprintf("%T", metricFor(test.shop_id, test.category, test.item_id)); got != test.want {
+			t.Errorf("metricFor(%v, %v, %v) = %v, want %v", test.shop_id, test.category, test.item_id, got, test.want)
+		}
+	}
+
+	if err := checkMetrics(); err != nil {
+		t.Fatalf("Error checkMetrics: %v", err)
+	}
+	useMetrics(t, map[string]string{"1": "missing"}, map[string]string{})
+	if err := checkMetrics(); err == nil {
+		t.Fatalf("Unknown metric accepted")
+	}
+}
+
+func TestCategoryCovariance(t *testing.T) {
+	s := useMemoryStore(t)
+	useMissingParams(t, missingParamsImpute)
+	schema := paramSchema{"1", "shirts", []paramDef{{"a", "cm", 1, 0, 0}, {"b", "cm", 1, 0, 0}}}
+	s.SaveSchema(schema)
+	m := categoryCovariance{weightedL2{}}
+
+	// without items there is no covariance yet
+	if got := m.forSchema("1", "shirts", schema); got != (weightedL2{}) {
+		t.Fatalf("Metric without a covariance: %#v", got)
+	}
+	waitImputeModels(t)
+
+	imputeModelsMu.Lock()
+	imputeModels[[2]string{"1", "shirts"}] = newImputeModel(schema, [][]float64{{1, 2}, {2, 3}, {3, 5}, {4, 4}})
+	imputeModelsMu.Unlock()
+	got, ok := m.forSchema("1", "shirts", schema).(mahalanobis)
+	if !ok || len(got.inverse) != 2 {
+		t.Fatalf("Wrong metric for the category: %#v", got)
+	}
+	// moving along the covariance is cheaper than across it
+	along := sumContributions(got.Contributions([]float64{0, 0}, []float64{1, 1}, nil))
+	if across := sumContributions(got.Contributions([]float64{0, 0}, []float64{1, -1}, nil)); along >= across {
+		t.Fatalf("Distance along the covariance %v, across %v", along, across)
+	}
+	// a reduced schema gets the covariance of its params
+	if got, ok := m.forSchema("1", "shirts", schema.only(map[string]bool{"b": true})).(mahalanobis); !ok || len(got.inverse) != 1 {
+		t.Fatalf("Wrong metric for a reduced schema: %#v", got)
+	}
+}
+
+func TestRankTypesMetric(t *testing.T) {
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1", 0})
+	key := itemKey{Item_id: "shirt"}
+	// type "small" is 1 below the request in every param, "large" 1.2 above
+	s.AddItem(itemRow{Token: "t_1", Shop_id: "1", itemKey: key, Type: "small", Params: testParams(9)})
+	s.AddItem(itemRow{Token: "t_1", Shop_id: "1", itemKey: key, Type: "large", Params: testParams(11.2)})
+
+	tests := []struct {
+		metric string
+		want string
+	}{
+		{"l2", "small"},
+		{"l1", "small"},
+		{"asymmetric", "large"},
+	}
+	for _, test := range tests {
+		useMetrics(t, map[string]string{"1": test.metric}, map[string]string{})
+		matches, err := getNearestTypes("1", key, testParams(10), 1)
+		if err != nil || len(matches) != 1 || matches[0].Type != test.want {
+			t.Errorf("%v: best types %v, want %v (%v)", test.metric, matches, test.want, err)
+		}
+	}
+
+	// a covariance of the wrong size falls back to the default metric
+	saved := metrics
+	metrics = map[string]Metric{"l2": weightedL2{}, "mahalanobis": mustMahalanobis([][]float64{{1}})}
+	defer func() { metrics = saved }()
+	useMetrics(t, map[string]string{"1": "mahalanobis"}, map[string]string{})
+	if matches, _ := getNearestTypes("1", key, testParams(10), 1); len(matches) != 1 || matches[0].Type != "small" {
+		t.Fatalf("Unfitting metric used: %v", matches)
+	}
+}
+
+func TestGetNearestTypes(t *testing.T) {
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1234", 0})
+	s.AddImage("t_1", "img1", "img1")
+	for i, type_ := range []string{"1", "2", "3"} {
+		serve("POST", prefix + "/update", itemForm("t_1", type_, float64(600 + i * 10)))
+	}
+
+	form := itemForm("", "", 611)
+	form.Set("shop_id", "1234")
+	tests := []struct {
+		k string
+		want string
+	}{
+		{"", `"result":["img1"],"type":"2"`},
+		{"0", `{"error":"invalid_request"}`},
+		{"x", `{"error":"invalid_request"}`},
+		{"1", `"result":[{"type":"2","params":{"d1":610,"d2":610,"d3":610,"d4":610,"d5":610},"image_ids":["img1"],"distance":`},
+		{"2", `"fit":`},
+		{"100", `"type":"1"`},
+	}
+	for _, test := range tests {
+		form.Set("k", test.k)
+		if body := serve("POST", prefix + "/get", form).Body.String(); !strings.Contains(body, test.want) {
+			t.Errorf("k=%v: unexpected /get response: %v", test.k, body)
+		}
+	}
+
+	matches, err := getNearestTypes("1234", itemKey{"shirt", "red", "M", ""}, testParams(611), 3)
+	if err != nil || len(matches) != 3 {
+		t.Fatalf("getNearestTypes returned %v, %v", matches, err)
+	}
+	for i, want := range []string{"2", "3", "1"} {
+		if matches[i].Type != want {
+			t.Fatalf("Wrong order: %v", matches)
+		}
+	}
+	if matches[0].Fit <= matches[1].Fit || matches[0].Fit > 1 || matches[2].Fit <= 0 {
+		t.Fatalf("Wrong fit scores: %v", matches)
+	}
+
+	// only the best fit is counted
+	types, _ := s.ItemTypes("1234", itemKey{"shirt", "red", "M", ""})
+	for _, item := range types {
+		if item.Type == "1" && item.Requests_count != 0 {
+			t.Fatalf("Alternative counted as requested")
+		}
+	}
+}
+
+func TestNoGoodFit(t *testing.T) {
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1234", 0})
+	s.AddImage("t_1", "img1", "img1")
+	for i, type_ := range []string{"1", "2"} {
+		serve("POST", prefix + "/update", itemForm("t_1", type_, float64(600 + i * 10)))
+	}
+	savedShops, savedItems := shopMaxDistances, itemMaxDistances
+	t.Cleanup(func() { shopMaxDistances, itemMaxDistances = savedShops, savedItems })
+
+	// type 2 is about 1 away from 611 with the default weights
+	form := itemForm("", "", 611)
+	form.Set("shop_id", "1234")
+	tests := []struct {
+		shopMax float64
+		itemMax map[string]float64
+		k string
+		want string
+	}{
+		{0, nil, "", `{"error":"","result":["img1"],"type":"2","params":[610,610,610,610,610]}`},
+		{0.5, nil, "", `{"error":"no_good_fit","result":["img1"],"type":"2","params":[610,610,610,610,610],"distance":1.0000`},
+		{0.5, nil, "2", `{"error":"no_good_fit","result":[{"type":"2"`},
+		{2, nil, "", `{"error":"","result":["img1"],"type":"2"`},
+		{2, map[string]float64{"1234/shirt": 0.5}, "", `{"error":"no_good_fit"`},
+	}
+	for _, test := range tests {
+		shopMaxDistances, itemMaxDistances = map[string]float64{"1234": test.shopMax}, test.itemMax
+		form.Set("k", test.k)
+		if body := serve("POST", prefix + "/get", form).Body.String(); !strings.HasPrefix(body, test.want) {
+			t.Errorf("max %v/%v, k=%v: unexpected /get response: %v", test.shopMax, test.itemMax, test.k, body)
+		}
+	}
+
+	// misses count instead of requests
+	types, _ := s.ItemTypes("1234", itemKey{"shirt", "red", "M", ""})
+	for _, item := range types {
+		if item.Type == "2" && (item.Requests_count != 2 || item.Misses_count != 3) {
+			t.Fatalf("Wrong counts of type 2: %v requests, %v misses", item.Requests_count, item.Misses_count)
+		}
+	}
+}
+
+func TestRecommendSizes(t *testing.T) {
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1234", 0})
+	s.AddImage("t_1", "img1", "img1")
+	s.AddImage("t_1", "img2", "img2")
+	sizes := []struct {
+		size string
+		value float64
+	}{{"S", 600}, {"M", 610}, {"L", 620}}
+	for _, size := range sizes {
+		for i, type_ := range []string{"1", "2"} {
+			form := itemForm("t_1", type_, size.value + float64(i * 2))
+			form.Set("size", size.size)
+			form.Set("image_ids", "img" + type_)
+			serve("POST", prefix + "/update", form)
+		}
+	}
+	// another color isn't recommended
+	form := itemForm("t_1", "1", 617)
+	form.Set("color", "blue")
+	serve("POST", prefix + "/update", form)
+
+	form = itemForm("", "", 617)
+	form.Set("shop_id", "1234")
+	form.Del("size")
+	body := serve("POST", prefix + "/recommend", form).Body.String()
+	var response struct {
+		Error string
+		Result []sizeMatch
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil || response.Error != "" || len(response.Result) != 3 {
+		t.Fatalf("Unexpected /recommend response: %v", body)
+	}
+	for i, want := range []string{"L/1", "M/2", "S/2"} {
+		if got := response.Result[i].Size + "/" + response.Result[i].Type; got != want {
+			t.Fatalf("Wrong ranking at %d: %v in %v", i, got, body)
+		}
+	}
+	if response.Result[1].Image_ids[0] != "img2" || response.Result[0].Fit <= response.Result[1].Fit {
+		t.Fatalf("Wrong size match: %v", body)
+	}
+
+	form.Set("id", "trousers")
+	if body = serve("POST", prefix + "/recommend", form).Body.String(); body != `{"error":"invalid_id"}` {
+		t.Fatalf("Unexpected /recommend response: %v", body)
+	}
+	form.Set("id", "shirt")
+	form.Set(paramNames[0], "x")
+	if body = serve("POST", prefix + "/recommend", form).Body.String(); !strings.HasPrefix(body, `{"error":"invalid_params"`) {
+		t.Fatalf("Unexpected /recommend response: %v", body)
+	}
+
+	// params left out are handled like the ones of /get
+	form.Set(paramNames[0], "617")
+	form.Del(paramNames[1])
+	useMissingParams(t, missingParamsReject)
+	if body = serve("POST", prefix + "/recommend", form).Body.String(); body != `{"error":"invalid_params","fields":{"` + paramNames[1] + `":"missing"}}` {
+		t.Fatalf("Unexpected /recommend response: %v", body)
+	}
+	useMissingParams(t, missingParamsReweight)
+	body = serve("POST", prefix + "/recommend", form).Body.String()
+	if err := json.Unmarshal([]byte(body), &response); err != nil || len(response.Result) != 3 || response.Result[0].Size != "L" {
+		t.Fatalf("Unexpected /recommend response: %v", body)
+	}
+}
+
+func TestGetBatch(t *testing.T) {
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1234", 0})
+	s.AddImage("t_1", "img1", "img1")
+	for i, type_ := range []string{"1", "2"} {
+		serve("POST", prefix + "/update", itemForm("t_1", type_, float64(600 + i * 10)))
+	}
+	form := itemForm("t_1", "1", 605)
+	form.Set("id", "trousers")
+	serve("POST", prefix + "/update", form)
+
+	form = itemForm("", "", 609)
+	form.Set("shop_id", "1234")
+	form.Set("keys", `[{"id":"shirt","color":"red","size":"M"},{"id":"hat"},{"id":"shirt","color":"red","size":"M"}]`)
+	want := `{"error":"","result":[{"error":"","result":["img1"],"type":"2","params":[610,610,610,610,610]},` +
+		`{"error":"invalid_id"},{"error":"","result":["img1"],"type":"2","params":[610,610,610,610,610]}]}`
+	if body := serve("POST", prefix + "/get-batch", form).Body.String(); body != want {
+		t.Fatalf("Unexpected /get-batch response: %v", body)
+	}
+
+	useImputeModel(t, "1234", "")
+	queries := url.Values{"shop_id": {"1234"}, "queries": {
+		`[{"id":"trousers","color":"red","size":"M","params":{"d1":604,"d2":604,"d3":604,"d4":604,"d5":604}},` +
+		`{"id":"shirt","color":"red","size":"M","unit":"cm","params":{"d1":60,"d2":60,"d3":60,"d4":60,"d5":60}},` +
+		`{"id":"shirt","color":"red","size":"M","params":{"d1":601}},` +
+		`{"id":"shirt","color":"red","size":"M","unit":"ft","params":{"d1":1}}]`}}
+	body := serve("POST", prefix + "/get-batch", queries).Body.String()
+	want = `{"error":"","result":[{"error":"","result":["img1"],"type":"1","params":[605,605,605,605,605]},` +
+		`{"error":"","result":["img1"],"type":"1","params":[600,600,600,600,600]},` +
+		`{"error":"","result":["img1"],"type":"1","params":[600,600,600,600,600],"imputed":["d2","d3","d4","d5"]},` +
+		`{"error":"invalid_params","fields":{"unit":"unknown_unit"}}]}`
+	if body != want {
+		t.Fatalf("Unexpected /get-batch response: %v", body)
+	}
+
+	types, _ := s.ItemTypes("1234", itemKey{"shirt", "red", "M", ""})
+	for _, item := range types {
+		if item.Requests_count != map[string]int{"1": 2, "2": 2}[item.Type] {
+			t.Fatalf("Wrong requests_count of type %v: %v", item.Type, item.Requests_count)
+		}
+	}
+
+	for _, invalid := range []url.Values{
+		{"shop_id": {"1234"}},
+		{"shop_id": {"1234"}, "keys": {"[]"}},
+		{"shop_id": {"1234"}, "keys": {`[{"id":"shirt"}]`}, "queries": {`[{"id":"shirt"}]`}},
+		{"shop_id": {"1234"}, "queries": {`[{"id":"shirt","params":{"d1":"x"}}]`}},
+	} {
+		if body := serve("POST", prefix + "/get-batch", invalid).Body.String(); body != `{"error":"invalid_request"}` {
+			t.Errorf("%v: unexpected /get-batch response: %v", invalid, body)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1234", 0})
+	s.CreateToken(tokenRow{"t_other", time.Now().Add(time.Hour).Unix(), "", "5678", 0})
+	s.AddImage("t_1", "img1", "img1")
+	for i, type_ := range []string{"1", "2", "3"} {
+		serve("POST", prefix + "/update", itemForm("t_1", type_, float64(600 + i * 10)))
+	}
+
+	form := itemForm("", "", 612)
+	form.Set("shop_id", "1234")
+	form.Set(paramNames[0], "608")
+	form.Set("explain", "1")
+	for _, token := range []string{"", "t_other"} {
+		form.Set("token", token)
+		if body := serve("POST", prefix + "/get", form).Body.String(); body != `{"error":"invalid_token"}` {
+			t.Fatalf("Explained for token %q: %v", token, body)
+		}
+	}
+
+	form.Set("token", "t_1")
+	var response struct {
+		Error string
+		Result []typeMatch
+	}
+	body := serve("POST", prefix + "/get", form).Body.String()
+	if err := json.Unmarshal([]byte(body), &response); err != nil || len(response.Result) != 3 {
+		t.Fatalf("Unexpected explain response: %v", body)
+	}
+	for _, match := range response.Result {
+		distance, share := 0.0, 0.0
+		for _, c := range match.Explain {
+			distance += c.Contribution
+			share += c.Share
+		}
+		if len(match.Explain) != len(paramNames) || math.Abs(distance - match.Distance) > 1e-9 || math.Abs(share - 1) > 1e-9 {
+			t.Fatalf("Contributions don't add up: %+v", match)
+		}
+	}
+	best := response.Result[0]
+	if best.Type != "2" || best.Explain[0].Garment != "larger" || best.Explain[1].Garment != "smaller" ||
+		best.Explain[0].Difference != 2 * paramWeights[0] {
+		t.Fatalf("Wrong explanation: %+v", best)
+	}
+
+	// an admin session works for any shop, and explaining isn't counted
+	s.AddUUID("session")
+	form.Del("token")
+	req := httptest.NewRequest("POST", prefix + "/get", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "uuid", Value: "session"})
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `"explain":[{"name":"d1"`) {
+		t.Fatalf("Unexpected explain response for an admin: %v", rec.Body.String())
+	}
+	types, _ := s.ItemTypes("1234", itemKey{"shirt", "red", "M", ""})
+	for _, item := range types {
+		if item.Requests_count != 0 {
+			t.Fatalf("Explained request counted")
+		}
+	}
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"strconv"
+	"time"
+	"database/sql"
+)
+
+// migration is one numbered schema change. Migrations are applied in
+// order of version, each inside its own transaction.
+type migration struct {
+	version int
+	name string
+	up func(tx *sql.Tx) error
+	down func(tx *sql.Tx) error
+}
+
+// Migrations must be kept sorted by version, and a released migration
+// must never be edited: add a new one instead. Every dialect has its own
+// list, and a version means the same schema in all of them.
+var sqliteMigrations = []migration{
+	{1, "initial schema", migrateInitialUp, migrateInitialDown},
+	{2, "item_images join table", migrateItemImagesUp, migrateItemImagesDown},
+	{3, "images.created_at", migrateImagesCreatedAtUp, migrateImagesCreatedAtDown},
+	{4, "tokens.deleted_at", migrateTokensDeletedAtUp, migrateTokensDeletedAtDown},
+	{5, "item_params and schema_params", migrateItemParamsUp, migrateItemParamsDown},
+	{6, "items.misses_count", migrateMissesCountUp, migrateMissesCountDown},
+	{7, "images.blob_id", migrateImageBlobsUp, migrateImageBlobsDown},
+	{8, "blobs", migrateBlobsUp, migrateBlobsDown},
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func execAll(tx *sql.Tx, stmts ...string) error {
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("Error request execution: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// The initial schema uses "if not exists" so that databases created
+// before migrations existed are adopted as version 1.
+func migrateInitialUp(tx *sql.Tx) error {
+	return execAll(tx, `
+	create table if not exists images (
+		id integer not null primary key autoincrement,
+		token text not null,
+		image_id text not null
+	)`, fmt.Sprintf(`
+	create table if not exists items (
+		id integer not null primary key autoincrement,
+		token text not null,
+		shop_id text not null,
+		item_id text not null,
+		color text,
+		size text,
+		description text,
+		type integer not null,
+		%s,
+		image_list text,
+		requests_count integer not null
+	)`, paramColumnsDefinition()), `
+	create table if not exists tokens (
+		token text not null primary key,
+		exp_time time not null,
+		description text,
+		shop_id text
+	)`, `
+	create table if not exists admin_uuids (
+		uuid text not null primary key
+	)`)
+}
+
+func migrateInitialDown(tx *sql.Tx) error {
+	return execAll(tx, "drop table if exists images", "drop table if exists items",
+		"drop table if exists tokens", "drop table if exists admin_uuids")
+}
+
+func createSchemaVersionTable(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists schema_version (
+		version integer not null primary key,
+		name text not null,
+		applied_at bigint not null
+	)`)
+	if err != nil {
+		return fmt.Errorf("Error creating schema_version table: %v\n", err)
+	}
+	return nil
+}
+
+func getSchemaVersion(db *sql.DB) (int, error) {
+	if err := createSchemaVersionTable(db); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	if err := db.QueryRow("select max(version) from schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	return int(version.Int64), nil
+}
+
+// readSchemaVersion is getSchemaVersion for a database opened read-only,
+// where schema_version can't be created; a database without it is at 0.
+func readSchemaVersion(db *sql.DB, d *dialect) (int, error) {
+	columns, err := d.tableColumns(db, "schema_version")
+	if err != nil || len(columns) == 0 {
+		return 0, err
+	}
+	var version sql.NullInt64
+	if err := db.QueryRow("select max(version) from schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	return int(version.Int64), nil
+}
+
+// migrateUp applies every migration newer than the current schema
+// version, up to and including target.
+func migrateUp(db *sql.DB, d *dialect, target int) error {
+	current, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > d.latestVersion() {
+		return fmt.Errorf("Database schema version %d is newer than this binary supports (%d)\n",
+			current, d.latestVersion())
+	}
+
+	for _, m := range d.migrations() {
+		if m.version <= current || m.version > target {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("Error creating database transaction: %v\n", err)
+		}
+		if err = m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		_, err = tx.Exec(d.rebind("insert into schema_version (version, name, applied_at) values (?, ?, ?)"),
+			m.version, m.name, time.Now().Unix())
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Error request execution: %v\n", err)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %d: %s\n", m.version, m.name)
+	}
+	return nil
+}
+
+// migrateDown reverts applied migrations until the schema is at target.
+// A database newer than the binary is refused like in migrateUp, since
+// the migrations above the binary's latest can't be reverted.
+func migrateDown(db *sql.DB, d *dialect, target int) error {
+	current, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > d.latestVersion() {
+		return fmt.Errorf("Database schema version %d is newer than this binary supports (%d)\n",
+			current, d.latestVersion())
+	}
+
+	migrations := d.migrations()
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= target {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("Error creating database transaction: %v\n", err)
+		}
+		if err = m.down(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Reverting migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		if _, err = tx.Exec(d.rebind("delete from schema_version where version = ?"), m.version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Error request execution: %v\n", err)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Reverted migration %d: %s\n", m.version, m.name)
+	}
+	return nil
+}
+
+// syncParamColumns adds a column to items for every entry of paramNames
+// that the table doesn't have yet. Until migration 5 params were columns
+// generated from config.go, so they couldn't be covered by fixed
+// migrations.
+func syncParamColumns(q querier, d *dialect) error {
+	columns, err := d.tableColumns(q, "items")
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		// items doesn't exist (schema at version 0)
+		return nil
+	}
+
+	for _, name := range paramNames {
+		if columns[name] {
+			continue
+		}
+		if _, err = q.Exec("alter table items add column " + name + " float not null default 0"); err != nil {
+			return fmt.Errorf("Error adding column %s: %v\n", name, err)
+		}
+		log.Printf("Added parameter column %s\n", name)
+	}
+	return nil
+}
+
+func paramColumnsDefinition() string {
+	return strings.Join(paramNames, " float,\n		") + " float"
+}
+
+// itemsTableDefinition returns the "create table" statement for items
+// as of migration 2.
+func itemsTableDefinition(name string) string {
+	return fmt.Sprintf(`
+	create table %s (
+		id integer not null primary key autoincrement,
+		token text not null references tokens(token) on delete cascade,
+		shop_id text not null,
+		item_id text not null,
+		color text,
+		size text,
+		description text,
+		type integer not null,
+		%s,
+		requests_count integer not null
+	)`, name, paramColumnsDefinition())
+}
+
+// Migration 2 moves items.image_list into item_images and adds foreign
+// keys, so deleting a token removes its images and items and an image
+// can't be deleted while an item refers to it.
+func migrateItemImagesUp(tx *sql.Tx) error {
+	if err := syncParamColumns(tx, sqliteDialect); err != nil {
+		return err
+	}
+	if err := logItemImagesDrops(tx); err != nil {
+		return err
+	}
+
+	err := execAll(tx, `
+	create table images_new (
+		id integer not null primary key autoincrement,
+		token text not null references tokens(token) on delete cascade,
+		image_id text not null unique
+	)`,
+	"insert or ignore into images_new (id, token, image_id) select id, token, image_id from images where token in (select token from tokens)",
+	"drop table images",
+	"alter table images_new rename to images",
+	itemsTableDefinition("items_new"),
+	fmt.Sprintf(`insert into items_new (id, token, shop_id, item_id, color, size, description, type, %[1]s, requests_count)
+		select id, token, shop_id, item_id, color, size, description, type, %[1]s, requests_count from items
+		where token in (select token from tokens)`, strings.Join(paramNames, ", ")))
+	if err != nil {
+		return err
+	}
+
+	image_lists, err := readImageLists(tx)
+	if err != nil {
+		return err
+	}
+
+	err = execAll(tx, "drop table items", "alter table items_new rename to items", `
+	create table item_images (
+		item_row integer not null references items(id) on delete cascade,
+		position integer not null,
+		image_id text not null references images(image_id),
+		primary key (item_row, position)
+	)`, "create index item_images_image_id on item_images (image_id)")
+	if err != nil {
+		return err
+	}
+
+	return splitImageLists(tx, sqliteDialect, image_lists)
+}
+
+func migrateItemImagesDown(tx *sql.Tx) error {
+	image_lists, err := readItemImages(tx)
+	if err != nil {
+		return err
+	}
+
+	err = execAll(tx, "drop table item_images", fmt.Sprintf(`
+	create table items_old (
+		id integer not null primary key autoincrement,
+		token text not null,
+		shop_id text not null,
+		item_id text not null,
+		color text,
+		size text,
+		description text,
+		type integer not null,
+		%[1]s,
+		image_list text,
+		requests_count integer not null
+	)`, paramColumnsDefinition()),
+	fmt.Sprintf(`insert into items_old (id, token, shop_id, item_id, color, size, description, type, %[1]s, requests_count)
+		select id, token, shop_id, item_id, color, size, description, type, %[1]s, requests_count from items`,
+		strings.Join(paramNames, ", ")),
+	"drop table items",
+	"alter table items_old rename to items", `
+	create table images_old (
+		id integer not null primary key autoincrement,
+		token text not null,
+		image_id text not null
+	)`,
+	"insert into images_old (id, token, image_id) select id, token, image_id from images",
+	"drop table images",
+	"alter table images_old rename to images")
+	if err != nil {
+		return err
+	}
+
+	return joinImageLists(tx, sqliteDialect, image_lists)
+}
+
+// Existing images get the migration time as upload time, so the orphan
+// collector's grace period starts now for them.
+func migrateImagesCreatedAtUp(tx *sql.Tx) error {
+	return execAll(tx, "alter table images add column created_at bigint not null default 0",
+		fmt.Sprintf("update images set created_at = %d", time.Now().Unix()))
+}
+
+func migrateImagesCreatedAtDown(tx *sql.Tx) error {
+	return execAll(tx, "alter table images drop column created_at")
+}
+
+// A token with deleted_at other than 0 is in the trash.
+func migrateTokensDeletedAtUp(tx *sql.Tx) error {
+	return execAll(tx, "alter table tokens add column deleted_at bigint not null default 0")
+}
+
+// Trashed tokens would become active again, so they're purged first.
+func migrateTokensDeletedAtDown(tx *sql.Tx) error {
+	return execAll(tx, "delete from tokens where deleted_at != 0",
+		"alter table tokens drop column deleted_at")
+}
+
+// misses_count counts the /get requests an item type was the nearest to
+// but too far off to be a fit.
+func migrateMissesCountUp(tx *sql.Tx) error {
+	return execAll(tx, "alter table items add column misses_count integer not null default 0")
+}
+
+func migrateMissesCountDown(tx *sql.Tx) error {
+	return execAll(tx, "alter table items drop column misses_count")
+}
+
+// Images are stored under blob_id, shared by images with the same
+// content. Existing images keep their files, stored under their own id.
+func migrateImageBlobsUp(tx *sql.Tx) error {
+	return execAll(tx, "alter table images add column blob_id text not null default ''",
+		"update images set blob_id = image_id",
+		"create index images_blob_id on images (blob_id)")
+}
+
+// Images stored under a blob other than their own id would lose their
+// files, so going down is refused while there are any.
+func migrateImageBlobsDown(tx *sql.Tx) error {
+	var shared int
+	if err := tx.QueryRow("select count(image_id) from images where blob_id != image_id").Scan(&shared); err != nil {
+		return err
+	}
+	if shared > 0 {
+		return fmt.Errorf("%d images are stored under a blob other than their id\n", shared)
+	}
+	return execAll(tx, "drop index images_blob_id", "alter table images drop column blob_id")
+}
+
+// blobs has a row per blob with files, which images are added to and
+// removed from under a lock of the row; see releaseBlobs.
+func migrateBlobsUp(tx *sql.Tx) error {
+	return execAll(tx, "create table blobs (blob_id text primary key, removing_at integer not null default 0)",
+		"insert into blobs (blob_id) select distinct blob_id from images")
+}
+
+func migrateBlobsDown(tx *sql.Tx) error {
+	return execAll(tx, "drop table blobs")
+}
+
+// itemColumnNames are the columns of items as of migration 4 that
+// aren't params.
+var itemColumnNames = map[string]bool{
+	"id": true, "token": true, "shop_id": true, "item_id": true, "color": true, "size": true,
+	"description": true, "type": true, "requests_count": true,
+}
+
+func migrateItemParamsUp(tx *sql.Tx) error {
+	return itemParamsUp(tx, sqliteDialect, "integer", "float")
+}
+
+func migrateItemParamsDown(tx *sql.Tx) error {
+	return itemParamsDown(tx, "float")
+}
+
+// Migration 5 moves the param columns of items into item_params, so
+// that items of different shops and categories can be measured with
+// different schemas, stored in schema_params.
+func itemParamsUp(tx *sql.Tx, d *dialect, idType, floatType string) error {
+	err := execAll(tx, fmt.Sprintf(`
+	create table item_params (
+		item_row %s not null references items(id) on delete cascade,
+		name text not null,
+		value %s not null,
+		primary key (item_row, name)
+	)`, idType, floatType), fmt.Sprintf(`
+	create table schema_params (
+		shop_id text not null,
+		category text not null,
+		position integer not null,
+		name text not null,
+		unit text not null,
+		weight %[1]s not null,
+		min_value %[1]s not null,
+		max_value %[1]s not null,
+		primary key (shop_id, category, position)
+	)`, floatType),
+		"alter table items add column category text not null default ''")
+	if err != nil {
+		return err
+	}
+
+	columns, err := d.tableColumns(tx, "items")
+	if err != nil {
+		return err
+	}
+	for name := range columns {
+		if itemColumnNames[name] || name == "category" {
+			continue
+		}
+		err = execAll(tx, fmt.Sprintf(`insert into item_params (item_row, name, value)
+			select id, '%[1]s', "%[1]s" from items where "%[1]s" is not null`, name),
+			fmt.Sprintf(`alter table items drop column "%s"`, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reverting migration 5 restores the columns of paramNames. Other params
+// and the schemas are lost.
+func itemParamsDown(tx *sql.Tx, floatType string) error {
+	for _, name := range paramNames {
+		err := execAll(tx, fmt.Sprintf("alter table items add column %s %s", name, floatType),
+			fmt.Sprintf(`update items set %[1]s = (select value from item_params
+				where item_params.item_row = items.id AND item_params.name = '%[1]s')`, name))
+		if err != nil {
+			return err
+		}
+	}
+	return execAll(tx, "drop table item_params", "drop table schema_params",
+		"alter table items drop column category")
+}
+
+// readImageLists returns items.image_list by item row id.
+func readImageLists(tx *sql.Tx) (map[int64]string, error) {
+	image_lists := map[int64]string{}
+	rows, err := tx.Query(`select id, image_list from items
+		where image_list is not null AND token in (select token from tokens)`)
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var image_list string
+		if err = rows.Scan(&id, &image_list); err != nil {
+			return nil, err
+		}
+		image_lists[id] = image_list
+	}
+	return image_lists, rows.Err()
+}
+
+// logItemImagesDrops logs every image and item that migration 2 drops
+// because its token doesn't exist, and every image dropped because an
+// earlier row has the same image_id.
+func logItemImagesDrops(tx *sql.Tx) error {
+	drops := []struct {
+		what, reason, query string
+	}{
+		{"image", "its token doesn't exist", "select image_id, token from images where token not in (select token from tokens)"},
+		{"image", "its id is taken by an earlier image", `select a.image_id, a.token from images a
+			where a.token in (select token from tokens) AND exists (select b.id from images b
+				where b.image_id = a.image_id AND b.id < a.id AND b.token in (select token from tokens))`},
+		{"item", "its token doesn't exist", "select id, token from items where token not in (select token from tokens)"},
+	}
+	for _, drop := range drops {
+		rows, err := tx.Query(drop.query)
+		if err != nil {
+			return fmt.Errorf("Error query execution: %v\n", err)
+		}
+		dropped := 0
+		for rows.Next() {
+			var id, token string
+			if err = rows.Scan(&id, &token); err != nil {
+				rows.Close()
+				return err
+			}
+			log.Printf("Dropping %v %v of token %v: %v\n", drop.what, id, token, drop.reason)
+			dropped++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if dropped > 0 {
+			log.Printf("Dropped %d %vs because %v\n", dropped, drop.what, drop.reason)
+		}
+	}
+	return nil
+}
+
+// splitImageLists fills item_images from comma-separated image lists.
+// Image ids that no longer exist are dropped from the lists.
+func splitImageLists(tx *sql.Tx, d *dialect, image_lists map[int64]string) error {
+	skipped := 0
+	for id, image_list := range image_lists {
+		position := 0
+		for _, image_id := range strings.Split(image_list, ",") {
+			result, err := tx.Exec(d.rebind(`insert into item_images (item_row, position, image_id)
+				select ?, ?, image_id from images where image_id = ?`), id, position, image_id)
+			if err != nil {
+				return fmt.Errorf("Error request execution: %v\n", err)
+			}
+			if n, _ := result.RowsAffected(); n == 0 {
+				log.Printf("Dropping image %v from the list of item %d: the image doesn't exist\n", image_id, id)
+				skipped++
+				continue
+			}
+			position++
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Dropped %d references to missing images\n", skipped)
+	}
+	return nil
+}
+
+// readItemImages returns the contents of item_images by item row id.
+func readItemImages(tx querier) (map[int64][]string, error) {
+	image_lists := map[int64][]string{}
+	rows, err := tx.Query("select item_row, image_id from item_images order by item_row, position")
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var image_id string
+		if err = rows.Scan(&id, &image_id); err != nil {
+			return nil, err
+		}
+		image_lists[id] = append(image_lists[id], image_id)
+	}
+	return image_lists, rows.Err()
+}
+
+// joinImageLists writes item_images contents back to items.image_list.
+func joinImageLists(tx *sql.Tx, d *dialect, image_lists map[int64][]string) error {
+	for id, image_ids := range image_lists {
+		if _, err := tx.Exec(d.rebind("update items set image_list = ? where id = ?"), strings.Join(image_ids, ","), id); err != nil {
+			return fmt.Errorf("Error request execution: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// migrateCommand implements "main migrate [up|down|status] [version]".
+func migrateCommand(args []string) error {
+	d := dialectForDSN(databaseDSN)
+	db, err := d.open(databaseDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	target := -1
+	if len(args) > 1 {
+		if target, err = strconv.Atoi(args[1]); err != nil || target < 0 {
+			return fmt.Errorf("Invalid version: %v\n", args[1])
+		}
+	}
+
+	switch action {
+	case "up":
+		if target == -1 {
+			target = d.latestVersion()
+		}
+		return migrateUp(db, d, target)
+	case "down":
+		if target == -1 {
+			current, err := getSchemaVersion(db)
+			if err != nil {
+				return err
+			}
+			target = current - 1
+		}
+		return migrateDown(db, d, target)
+	case "status":
+		current, err := getSchemaVersion(db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s schema version %d, latest %d\n", d.name, current, d.latestVersion())
+		for _, m := range d.migrations() {
+			state := "pending"
+			if m.version <= current {
+				state = "applied"
+			}
+			fmt.Printf("%4d  %-8s %s\n", m.version, state, m.name)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown migrate action: %v\n", action)
+}
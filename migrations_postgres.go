@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"database/sql"
+)
+
+// postgresMigrations mirror sqliteMigrations version by version.
+var postgresMigrations = []migration{
+	{1, "initial schema", migratePostgresInitialUp, migrateInitialDown},
+	{2, "item_images join table", migratePostgresItemImagesUp, migratePostgresItemImagesDown},
+	{3, "images.created_at", migrateImagesCreatedAtUp, migrateImagesCreatedAtDown},
+	{4, "tokens.deleted_at", migrateTokensDeletedAtUp, migrateTokensDeletedAtDown},
+	{5, "item_params and schema_params", migratePostgresItemParamsUp, migratePostgresItemParamsDown},
+	{6, "items.misses_count", migrateMissesCountUp, migrateMissesCountDown},
+	{7, "images.blob_id", migrateImageBlobsUp, migrateImageBlobsDown},
+	{8, "blobs", migrateBlobsUp, migrateBlobsDown},
+}
+
+func postgresParamColumnsDefinition() string {
+	return strings.Join(paramNames, " double precision,\n		") + " double precision"
+}
+
+func migratePostgresInitialUp(tx *sql.Tx) error {
+	return execAll(tx, `
+	create table if not exists images (
+		id bigserial primary key,
+		token text not null,
+		image_id text not null
+	)`, fmt.Sprintf(`
+	create table if not exists items (
+		id bigserial primary key,
+		token text not null,
+		shop_id text not null,
+		item_id text not null,
+		color text,
+		size text,
+		description text,
+		type integer not null,
+		%s,
+		image_list text,
+		requests_count integer not null
+	)`, postgresParamColumnsDefinition()), `
+	create table if not exists tokens (
+		token text not null primary key,
+		exp_time bigint not null,
+		description text,
+		shop_id text
+	)`, `
+	create table if not exists admin_uuids (
+		uuid text not null primary key
+	)`)
+}
+
+// PostgreSQL can add constraints in place, so unlike SQLite there is no
+// need to rebuild the tables.
+func migratePostgresItemImagesUp(tx *sql.Tx) error {
+	if err := syncParamColumns(tx, postgresDialect); err != nil {
+		return err
+	}
+	if err := logItemImagesDrops(tx); err != nil {
+		return err
+	}
+
+	err := execAll(tx,
+		"delete from images where token not in (select token from tokens)",
+		"delete from images a using images b where a.image_id = b.image_id AND a.id > b.id",
+		"alter table images add constraint images_image_id_key unique (image_id)",
+		"alter table images add constraint images_token_fkey foreign key (token) references tokens(token) on delete cascade",
+		"delete from items where token not in (select token from tokens)",
+		"alter table items add constraint items_token_fkey foreign key (token) references tokens(token) on delete cascade", `
+	create table item_images (
+		item_row bigint not null references items(id) on delete cascade,
+		position integer not null,
+		image_id text not null references images(image_id),
+		primary key (item_row, position)
+	)`, "create index item_images_image_id on item_images (image_id)")
+	if err != nil {
+		return err
+	}
+
+	image_lists, err := readImageLists(tx)
+	if err != nil {
+		return err
+	}
+	if err = splitImageLists(tx, postgresDialect, image_lists); err != nil {
+		return err
+	}
+	return execAll(tx, "alter table items drop column image_list")
+}
+
+func migratePostgresItemImagesDown(tx *sql.Tx) error {
+	image_lists, err := readItemImages(tx)
+	if err != nil {
+		return err
+	}
+
+	err = execAll(tx,
+		"drop table item_images",
+		"alter table items add column image_list text",
+		"alter table items drop constraint items_token_fkey",
+		"alter table images drop constraint images_token_fkey",
+		"alter table images drop constraint images_image_id_key")
+	if err != nil {
+		return err
+	}
+	return joinImageLists(tx, postgresDialect, image_lists)
+}
+
+func migratePostgresItemParamsUp(tx *sql.Tx) error {
+	return itemParamsUp(tx, postgresDialect, "bigint", "double precision")
+}
+
+func migratePostgresItemParamsDown(tx *sql.Tx) error {
+	return itemParamsDown(tx, "double precision")
+}
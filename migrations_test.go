@@ -0,0 +1,181 @@
+package main
+
+import (
+	"testing"
+	"strings"
+	"bytes"
+	"log"
+	"os"
+	"database/sql"
+)
+
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	var count int
+	if err := db.QueryRow("select count(*) from sqlite_master where type == 'table' AND name == ?", name).Scan(&count); err != nil {
+		t.Fatalf("Error query execution: %v", err)
+	}
+	return count > 0
+}
+
+func TestMigrations(t *testing.T) {
+	s := openTestSQLiteStore(t)
+	db := s.db
+
+	if version, err := getSchemaVersion(db); err != nil || version != sqliteDialect.latestVersion() {
+		t.Fatalf("Schema version %d after open, want %d (%v)", version, sqliteDialect.latestVersion(), err)
+	}
+	if !tableExists(t, db, "items") {
+		t.Fatalf("items table not created")
+	}
+
+	if err := migrateDown(db, sqliteDialect, 0); err != nil {
+		t.Fatalf("Error migrateDown: %v", err)
+	}
+	if version, _ := getSchemaVersion(db); version != 0 {
+		t.Fatalf("Schema version %d after migrating down", version)
+	}
+	if tableExists(t, db, "items") || tableExists(t, db, "tokens") {
+		t.Fatalf("Tables left after migrating down")
+	}
+
+	if err := migrateUp(db, sqliteDialect, sqliteDialect.latestVersion()); err != nil {
+		t.Fatalf("Error migrateUp: %v", err)
+	}
+	// applying again must be a no-op
+	if err := migrateUp(db, sqliteDialect, sqliteDialect.latestVersion()); err != nil {
+		t.Fatalf("Error repeated migrateUp: %v", err)
+	}
+
+	if _, err := db.Exec("insert into schema_version (version, name, applied_at) values (?, 'future', 0)",
+		sqliteDialect.latestVersion() + 1); err != nil {
+		t.Fatalf("Error request execution: %v", err)
+	}
+	if err := prepareSchema(db, sqliteDialect); err == nil {
+		t.Fatalf("Database newer than the binary accepted")
+	}
+	if err := migrateDown(db, sqliteDialect, 1); err == nil {
+		t.Fatalf("Reverted a database newer than the binary")
+	}
+	if version, _ := getSchemaVersion(db); version != sqliteDialect.latestVersion() + 1 {
+		t.Fatalf("Schema version is %d after a refused migrateDown", version)
+	}
+}
+
+func TestSyncParamColumns(t *testing.T) {
+	s := openTestSQLiteStore(t)
+
+	saved := paramNames
+	paramNames = append(append([]string{}, saved...), "d_extra")
+	defer func() { paramNames = saved }()
+
+	if err := syncParamColumns(s.db, sqliteDialect); err != nil {
+		t.Fatalf("Error syncParamColumns: %v", err)
+	}
+	if _, err := s.db.Exec("select d_extra from items"); err != nil {
+		t.Fatalf("Column d_extra not added: %v", err)
+	}
+}
+
+func TestItemImagesMigration(t *testing.T) {
+	s := openTestSQLiteStore(t)
+	db := s.db
+	if err := migrateDown(db, sqliteDialect, 1); err != nil {
+		t.Fatalf("Error migrateDown: %v", err)
+	}
+
+	stmts := []string{
+		"insert into tokens (token, exp_time, description, shop_id) values ('t_1', 0, '', '1')",
+		"insert into images (token, image_id) values ('t_1', 'a'), ('t_1', 'b'), ('t_1', 'c')",
+		"insert into images (token, image_id) values ('t_deleted', 'x'), ('t_1', 'b')",
+		"insert into items (token, shop_id, item_id, color, size, description, type, " + strings.Join(paramNames, ", ") +
+			", image_list, requests_count) values ('t_1', '1', 'shirt', '', '', '', 1" + strings.Repeat(", 0", len(paramNames)) +
+			", 'c,missing,a', 0)",
+		"insert into items (token, shop_id, item_id, color, size, description, type, " + strings.Join(paramNames, ", ") +
+			", image_list, requests_count) values ('t_deleted', '2', 'hat', '', '', '', 1" + strings.Repeat(", 0", len(paramNames)) +
+			", 'x', 0)",
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("Error request execution: %v", err)
+		}
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	err := migrateUp(db, sqliteDialect, 2)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		t.Fatalf("Error migrateUp: %v", err)
+	}
+	// every dropped row is logged
+	for _, want := range []string{"Dropping image x of token t_deleted", "Dropping image b of token t_1",
+		"Dropping item 2 of token t_deleted", "Dropping image missing from the list of item 1"} {
+		if !strings.Contains(logged.String(), want) {
+			t.Fatalf("%q not logged in %v", want, logged.String())
+		}
+	}
+	// the store expects the latest schema, so item_images is read directly
+	image_lists, err := readItemImages(db)
+	if err != nil || len(image_lists) != 1 {
+		t.Fatalf("readItemImages returned %d items, %v", len(image_lists), err)
+	}
+	for _, image_ids := range image_lists {
+		if strings.Join(image_ids, ",") != "c,a" {
+			t.Fatalf("Wrong image list after migration: %v", image_ids)
+		}
+	}
+	if ok, _ := s.ImageExists("x"); ok {
+		t.Fatalf("Image of a missing token survived the migration")
+	}
+
+	if _, err = db.Exec("delete from images where image_id == 'a'"); err == nil {
+		t.Fatalf("Deleted an image referenced by an item")
+	}
+
+	if err = migrateDown(db, sqliteDialect, 1); err != nil {
+		t.Fatalf("Error migrateDown: %v", err)
+	}
+	var image_list string
+	if err = db.QueryRow("select image_list from items").Scan(&image_list); err != nil || image_list != "c,a" {
+		t.Fatalf("Wrong image_list after migrating down: %q, %v", image_list, err)
+	}
+}
+
+func TestItemParamsMigration(t *testing.T) {
+	s := openTestSQLiteStore(t)
+	db := s.db
+	if err := migrateDown(db, sqliteDialect, 4); err != nil {
+		t.Fatalf("Error migrateDown: %v", err)
+	}
+
+	stmts := []string{
+		"insert into tokens (token, exp_time, description, shop_id) values ('t_1', 0, '', '1')",
+		"insert into items (token, shop_id, item_id, color, size, description, type, " + strings.Join(paramNames, ", ") +
+			", requests_count) values ('t_1', '1', 'shirt', '', '', '', 1" + strings.Repeat(", 3", len(paramNames)) + ", 5)",
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("Error request execution: %v", err)
+		}
+	}
+
+	if err := migrateUp(db, sqliteDialect, sqliteDialect.latestVersion()); err != nil {
+		t.Fatalf("Error migrateUp: %v", err)
+	}
+	columns, _ := sqliteDialect.tableColumns(db, "items")
+	if columns[paramNames[0]] || !columns["category"] {
+		t.Fatalf("Wrong items columns after migration: %v", columns)
+	}
+	items, err := s.ItemsByToken("t_1")
+	if err != nil || len(items) != 1 || len(items[0].Params) != len(paramNames) || items[0].Params[paramNames[0]] != 3 {
+		t.Fatalf("ItemsByToken returned %v, %v", items, err)
+	}
+
+	if err = migrateDown(db, sqliteDialect, 4); err != nil {
+		t.Fatalf("Error migrateDown: %v", err)
+	}
+	var value float64
+	if err = db.QueryRow("select " + paramNames[len(paramNames)-1] + " from items").Scan(&value); err != nil || value != 3 {
+		t.Fatalf("Wrong param after migrating down: %v, %v", value, err)
+	}
+}
@@ -9,12 +9,9 @@ import (
 	"strconv"
 	"math/rand"
 	"bytes"
-	"database/sql"
 	"encoding/json"
 	"github.com/satori/go.uuid"
 	"github.com/gorilla/mux"
-	"os"
-	"io"
 )
 
 var (
@@ -22,37 +19,11 @@ var (
 	static = map[string]string{}
 )
 
-func addUUID(db *sql.DB, id string) error {
-	stmt, err := db.Prepare("insert into admin_uuids (uuid) values (?)")
-	if err != nil {
-		return fmt.Errorf("Error creating stmt: %v\n", err)
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(id)
-	if err != nil {
-		return fmt.Errorf("Error request execution: %v\n", err)
-	}
-	return nil
-}
-
-func checkUUID(db *sql.DB, id string) (bool, error) {
-	stmt, err := db.Prepare("select * from admin_uuids where uuid == ?")
-	if err != nil {
-		return false, fmt.Errorf("Error creating stmt: %v\n", err)
-	}
-	rows, err := stmt.Query(id)
-	if err != nil {
-		return false, fmt.Errorf("Error query execution: %v\n", err)
-	}
-	defer rows.Close()
-	return rows.Next(), nil
-}
-
-func redirectAuthorized(db *sql.DB, w http.ResponseWriter, r *http.Request) bool {
+func redirectAuthorized(w http.ResponseWriter, r *http.Request) bool {
 	cookie, err := r.Cookie("uuid")
 	result := false
 	if err == nil {
-		result, err = checkUUID(db, cookie.Value)
+		result, err = store.CheckUUID(cookie.Value)
 		if err != nil {
 			log.Print(err)
 			http.Error(w, "500 internal server error", 500)
@@ -68,11 +39,11 @@ func redirectAuthorized(db *sql.DB, w http.ResponseWriter, r *http.Request) bool
 	return false
 }
 
-func redirectUnauthorized(db *sql.DB, w http.ResponseWriter, r *http.Request) bool {
+func redirectUnauthorized(w http.ResponseWriter, r *http.Request) bool {
 	cookie, err := r.Cookie("uuid")
 	result := false
 	if err == nil {
-		result, err = checkUUID(db, cookie.Value)
+		result, err = store.CheckUUID(cookie.Value)
 		if err != nil {
 			log.Print(err)
 			http.Error(w, "500 internal server error", 500)
@@ -89,14 +60,6 @@ func redirectUnauthorized(db *sql.DB, w http.ResponseWriter, r *http.Request) bo
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("sqlite3", "sqlite3.db")
-	if err != nil {
-		log.Printf("Error opening database: %v\n", err)
-		http.Error(w, "500 internal server error", 500)
-		return
-	}
-	defer db.Close()
-
 	if (r.Method == http.MethodPost) {
 		// login
 		login := r.FormValue("login")
@@ -109,7 +72,11 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 		_id := uuid.NewV4()
 		id := _id.String()
-		addUUID(db, id)
+		if err := store.AddUUID(id); err != nil {
+			log.Print(err)
+			http.Error(w, "500 internal server error", 500)
+			return
+		}
 
 		http.SetCookie(w, &http.Cookie{
 			Name: "uuid", 
@@ -119,7 +86,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 		fmt.Fprint(w, "ok")
 	} else {
-		if redirectAuthorized(db, w, r) {
+		if redirectAuthorized(w, r) {
 			return
 		}
 
@@ -143,98 +110,64 @@ func getRandomShopID() string {
 	return strconv.Itoa(rand.Intn(10000))
 }
 
-func isTokenExists(db *sql.DB, token string) bool {
-	stmt, err := db.Prepare("select * from tokens where token == ?")
-	if err != nil {
-		log.Fatalf("Error creating stmt: %v\n", err)
-	}
-	rows, err := stmt.Query(token)
-	if err != nil {
-		log.Fatalf("Error query execution: %v\n", err)
-	}
-	defer rows.Close()
-	return rows.Next()
-}
-
-func isShopIDExists(db *sql.DB, shop_id string) bool {
-	stmt, err := db.Prepare("select * from tokens where shop_id == ?")
-	if err != nil {
-		log.Fatalf("Error creating stmt: %v\n", err)
-	}
-	rows, err := stmt.Query(shop_id)
-	if err != nil {
-		log.Fatalf("Error query execution: %v\n", err)
-	}
-	defer rows.Close()
-	return rows.Next()
-}
-
-func getRandomValidToken(db *sql.DB) string {
+func getRandomValidToken() (string, error) {
 	for {
 		token := getRandomToken()
-		if !isTokenExists(db, token) {
-			return token
+		exists, err := store.TokenExists(token)
+		if err != nil || !exists {
+			return token, err
 		}
 	}
 }
 
-func getRandomValidShopID(db *sql.DB) string {
+func getRandomValidShopID() (string, error) {
 	for {
 		shop_id := getRandomShopID()
-		if !isShopIDExists(db, shop_id) {
-			return shop_id
+		exists, err := store.ShopIDExists(shop_id)
+		if err != nil || !exists {
+			return shop_id, err
 		}
 	}
 }
 
-func getImagesCount(db *sql.DB, token string) string {
-	stmt, err := db.Prepare("select count(token) from images where token == ?")
+func getImagesCount(token string) string {
+	result, err := store.ImagesCount(token)
 	if err != nil {
-		log.Printf("Error creating stmt: %v\n", err)
+		log.Print(err)
 		return "null"
 	}
-	rows, err := stmt.Query(token)
+	return strconv.Itoa(result)
+}
+
+func getItemsCount(token string) string {
+	result, err := store.ItemsCount(token)
 	if err != nil {
-		log.Printf("Error query execution: %v\n", err)
+		log.Print(err)
 		return "null"
 	}
-	defer rows.Close()
-	rows.Next()
-
-	result := ""
-	rows.Scan(&result)
-	return result
+	return strconv.Itoa(result)
 }
 
-func getItemsCount(db *sql.DB, token string) string {
-	stmt, err := db.Prepare("select count(*) from (select distinct item_id, color, size, description from items where token == ?)")
-	if err != nil {
-		log.Printf("Error creating stmt: %v\n", err)
-		return "null"
+// parseTokenForm reads the token fields shared by the "create" and
+// "edit" actions. ok is false if the request is malformed.
+func parseTokenForm(r *http.Request) (t tokenRow, ok bool) {
+	t.Token = r.FormValue("token")
+	t.Shop_id = r.FormValue("shop_id")
+	t.Description = r.FormValue("description")
+	if t.Token == "" || t.Shop_id == "" {
+		return t, false
 	}
-	rows, err := stmt.Query(token)
+
+	expiration_time, err := strconv.ParseInt(r.FormValue("exp_time"), 10, 64)
 	if err != nil {
-		log.Printf("Error query execution: %v\n", err)
-		return "null"
+		return t, false
 	}
-	defer rows.Close()
-	rows.Next()
-
-	result := ""
-	rows.Scan(&result)
-	return result
+	t.Exp_time = expiration_time
+	return t, true
 }
 
 func tokensHandler(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("sqlite3", "sqlite3.db")
-	if err != nil {
-		log.Printf("Error opening database: %v\n", err)
-		http.Error(w, "500 internal server error", 500)
-		return
-	}
-	defer db.Close()
-
-	if redirectUnauthorized(db, w, r) {
+	if redirectUnauthorized(w, r) {
 		return
 	}
 
@@ -242,33 +175,31 @@ func tokensHandler(w http.ResponseWriter, r *http.Request) {
 		req_v := r.FormValue("v")
 
 		if req_v == "create" {
-			token := r.FormValue("token")
-			shop_id := r.FormValue("shop_id")
-			description := r.FormValue("description")
-			exp_time := r.FormValue("exp_time")
-
-			if token == "" || shop_id == "" || isTokenExists(db, token) || isShopIDExists(db, shop_id) {
+			t, ok := parseTokenForm(r)
+			if !ok {
 				fmt.Fprint(w, "invalid_request")
-				return	
+				return
 			}
 
-			expiration_time, err := strconv.ParseInt(exp_time, 10, 64)
+			token_exists, err := store.TokenExists(t.Token)
 			if err != nil {
-				fmt.Fprint(w, "invalid_request")
+				log.Print(err)
+				http.Error(w, "500 internal server error", 500)
 				return
 			}
-
-			stmt, err := db.Prepare("insert into tokens (token, exp_time, description, shop_id) values (?, ?, ?, ?)")
+			shop_id_exists, err := store.ShopIDExists(t.Shop_id)
 			if err != nil {
-				log.Printf("Error creating stmt: %v\n", err)
+				log.Print(err)
 				http.Error(w, "500 internal server error", 500)
 				return
 			}
-			defer stmt.Close()
+			if token_exists || shop_id_exists {
+				fmt.Fprint(w, "invalid_request")
+				return	
+			}
 
-			_, err = stmt.Exec(token, strconv.FormatInt(expiration_time, 10), description, shop_id)
-			if err != nil {
-				log.Printf("Error request execution: %v\n", err)
+			if err = store.CreateToken(t); err != nil {
+				log.Print(err)
 				http.Error(w, "500 internal server error", 500)
 				return
 			}
@@ -277,56 +208,39 @@ func tokensHandler(w http.ResponseWriter, r *http.Request) {
 			return
 
 		} else if req_v == "edit" {
-			token := r.FormValue("token")
-			shop_id := r.FormValue("shop_id")
-			description := r.FormValue("description")
-			exp_time := r.FormValue("exp_time")
-
-			if token == "" || shop_id == "" || !isTokenExists(db, token) {
-				fmt.Fprint(w, "invalid_request")
-				return	
-			}
-
-			if isShopIDExists(db, shop_id) {
-				token_shop_id, err := getShopID(db, token)
-				if err != nil || token_shop_id != shop_id {
-					fmt.Fprint(w, "invalid_request")
-					return
-				}
-			}
-
-			expiration_time, err := strconv.ParseInt(exp_time, 10, 64)
-			if err != nil {
+			t, ok := parseTokenForm(r)
+			if !ok {
 				fmt.Fprint(w, "invalid_request")
 				return
 			}
 
-			stmt, err := db.Prepare("update tokens set exp_time = ?, description = ?, shop_id = ? where token = ?")
+			token_exists, err := store.TokenExists(t.Token)
 			if err != nil {
-				log.Printf("Error creating stmt: %v\n", err)
+				log.Print(err)
 				http.Error(w, "500 internal server error", 500)
 				return
 			}
-			defer stmt.Close()
-			
-			_, err = stmt.Exec(strconv.FormatInt(expiration_time, 10), description, shop_id, token)
-			if err != nil {
-				log.Printf("Error request execution: %v\n", err)
-				http.Error(w, "500 internal server error", 500)
-				return
+			if !token_exists {
+				fmt.Fprint(w, "invalid_request")
+				return	
 			}
 
-			stmt2, err := db.Prepare("update items set shop_id = ? where token = ?")
+			shop_id_exists, err := store.ShopIDExists(t.Shop_id)
 			if err != nil {
-				log.Printf("Error creating stmt: %v\n", err)
+				log.Print(err)
 				http.Error(w, "500 internal server error", 500)
 				return
 			}
-			defer stmt2.Close()
-			
-			_, err = stmt2.Exec(shop_id, token)
-			if err != nil {
-				log.Printf("Error request execution: %v\n", err)
+			if shop_id_exists {
+				token_shop_id, err := store.GetShopID(t.Token)
+				if err != nil || token_shop_id != t.Shop_id {
+					fmt.Fprint(w, "invalid_request")
+					return
+				}
+			}
+
+			if err = store.EditToken(t); err != nil {
+				log.Print(err)
 				http.Error(w, "500 internal server error", 500)
 				return
 			}
@@ -335,49 +249,27 @@ func tokensHandler(w http.ResponseWriter, r *http.Request) {
 			return
 
 		} else if req_v == "delete" {
-			token := r.FormValue("token")
-			stmt, err := db.Prepare("delete from images where token = ?")
+			// deleting a token that isn't active is a no-op, as it was
+			// before the trash
+			_, err := store.TrashToken(r.FormValue("token"))
 			if err != nil {
-				log.Printf("Error creating stmt: %v\n", err)
-				http.Error(w, "500 internal server error", 500)
-				return
-			}
-			defer stmt.Close()
-			
-			_, err = stmt.Exec(token)
-			if err != nil {
-				log.Printf("Error request execution: %v\n", err)
+				log.Print(err)
 				http.Error(w, "500 internal server error", 500)
 				return
 			}
 
-			stmt2, err := db.Prepare("delete from items where token = ?")
-			if err != nil {
-				log.Printf("Error creating stmt: %v\n", err)
-				http.Error(w, "500 internal server error", 500)
-				return
-			}
-			defer stmt2.Close()
-			
-			_, err = stmt2.Exec(token)
-			if err != nil {
-				log.Printf("Error request execution: %v\n", err)
-				http.Error(w, "500 internal server error", 500)
-				return
-			}
+			fmt.Fprint(w, "ok")
+			return
 
-			stmt3, err := db.Prepare("delete from tokens where token = ?")
+		} else if req_v == "restore" {
+			restored, err := store.RestoreToken(r.FormValue("token"))
 			if err != nil {
-				log.Printf("Error creating stmt: %v\n", err)
+				log.Print(err)
 				http.Error(w, "500 internal server error", 500)
 				return
 			}
-			defer stmt3.Close()
-			
-			_, err = stmt3.Exec(token)
-			if err != nil {
-				log.Printf("Error request execution: %v\n", err)
-				http.Error(w, "500 internal server error", 500)
+			if !restored {
+				fmt.Fprint(w, "invalid_request")
 				return
 			}
 
@@ -393,49 +285,62 @@ func tokensHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Create html token list 
 
+	random_token, err := getRandomValidToken()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+	random_shop_id, err := getRandomValidShopID()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "500 internal server error", 500)
+		return
+	}
+
 	html := templates["tokens"]
-	html = strings.ReplaceAll(html, "{{token}}", getRandomValidToken(db))
-	html = strings.ReplaceAll(html, "{{shop_id}}", getRandomValidShopID(db))
+	html = strings.ReplaceAll(html, "{{token}}", random_token)
+	html = strings.ReplaceAll(html, "{{shop_id}}", random_shop_id)
 
 	token_blocks := ""
+	trash_blocks := ""
 
-	rows, err := db.Query("select * from tokens")
+	tokens, err := store.ListTokens()
 	if err != nil {
-		log.Printf("Error query execution: %v\n", err)
+		log.Print(err)
 		http.Error(w, "500 internal server error", 500)
 		return
 	}
 	
 	num := 0
-	for rows.Next() {
-		var token, description, shop_id string
-		var expTime int64
-		err := rows.Scan(&token, &expTime, &description, &shop_id)
-		if err != nil {
-			log.Print(err)
-			http.Error(w, "500 internal server error", 500)
-			return
+	for _, t := range tokens {
+		if t.Deleted_at != 0 {
+			trash_blocks += trashBlock(t)
+			continue
 		}
+		num++
 
 		token_block := templates["token-block"]
-		token_block = strings.ReplaceAll(token_block, "{{token}}", token)
-		token_block = strings.ReplaceAll(token_block, "{{shop_id}}", shop_id)
+		token_block = strings.ReplaceAll(token_block, "{{token}}", t.Token)
+		token_block = strings.ReplaceAll(token_block, "{{shop_id}}", t.Shop_id)
 		token_block = strings.ReplaceAll(token_block, "{{num}}", strconv.Itoa(num))
 
-		if description == "" {
+		if t.Description == "" {
 			token_block = strings.ReplaceAll(token_block, "{{br}}", "")	
 		} else {
 			token_block = strings.ReplaceAll(token_block, "{{br}}", "<br/>")
 		}
-		token_block = strings.ReplaceAll(token_block, "{{description}}", description)
+		token_block = strings.ReplaceAll(token_block, "{{description}}", t.Description)
 		
-		token_block = strings.ReplaceAll(token_block, "{{images_count}}", getImagesCount(db, token))
-		token_block = strings.ReplaceAll(token_block, "{{items_count}}", getItemsCount(db, token))
+		token_block = strings.ReplaceAll(token_block, "{{images_count}}", getImagesCount(t.Token))
+		token_block = strings.ReplaceAll(token_block, "{{items_count}}", getItemsCount(t.Token))
 
-		expired := expTime <= time.Now().Unix()
-		time_string := time.Unix(expTime, 0).UTC().Format("2006-01-02 15:04:05 UTC")
-		time_string_default := time.Unix(expTime, 0).UTC().Format("2006-01-02T15:04:05")
+		expired := t.Exp_time <= time.Now().Unix()
+		time_string := time.Unix(t.Exp_time, 0).UTC().Format("2006-01-02 15:04:05 UTC")
+		time_string_default := time.Unix(t.Exp_time, 0).UTC().Format("2006-01-02T15:04:05")
 		token_block = strings.ReplaceAll(token_block, "{{exp_time_default}}", time_string_default)
+		token_block = strings.ReplaceAll(token_block, "{{purge_time}}", 
+			time.Now().Add(trashRetention).UTC().Format("2006-01-02 15:04:05 UTC"))
 
 		if expired {
 			token_block = strings.ReplaceAll(token_block, "{{exp_time}}",
@@ -446,40 +351,59 @@ func tokensHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		token_blocks += token_block
-		num++
 	}
 
-	if err != nil {
-		log.Print(err)
-		http.Error(w, "500 internal server error", 500)
-		return
+	if trash_blocks != "" {
+		trash_blocks = "<h5 class=\"mt-4\">Trash</h5>" + trash_blocks
 	}
-
 	html = strings.ReplaceAll(html, "{{container}}", token_blocks)
+	html = strings.ReplaceAll(html, "{{trash}}", trash_blocks)
 	fmt.Fprint(w, html)
 }
 
+// trashBlock renders a token in the trash.
+func trashBlock(t tokenRow) string {
+	trash_block := templates["trash-block"]
+	trash_block = strings.ReplaceAll(trash_block, "{{token}}", t.Token)
+	trash_block = strings.ReplaceAll(trash_block, "{{shop_id}}", t.Shop_id)
+
+	if t.Description == "" {
+		trash_block = strings.ReplaceAll(trash_block, "{{br}}", "")
+	} else {
+		trash_block = strings.ReplaceAll(trash_block, "{{br}}", "<br/>")
+	}
+	trash_block = strings.ReplaceAll(trash_block, "{{description}}", t.Description)
+
+	trash_block = strings.ReplaceAll(trash_block, "{{images_count}}", getImagesCount(t.Token))
+	trash_block = strings.ReplaceAll(trash_block, "{{items_count}}", getItemsCount(t.Token))
+
+	deleted := time.Unix(t.Deleted_at, 0)
+	trash_block = strings.ReplaceAll(trash_block, "{{deleted_time}}", deleted.UTC().Format("2006-01-02 15:04:05 UTC"))
+	trash_block = strings.ReplaceAll(trash_block, "{{purge_time}}",
+		deleted.Add(trashRetention).UTC().Format("2006-01-02 15:04:05 UTC"))
+	return trash_block
+}
+
 type jsonItem struct {
 	Item_id string 			`json:"item_id"`
 	Color string 			`json:"color"`
 	Size string 			`json:"size"`
 	Description string 		`json:"description"`
+	Category string 		`json:"category"`
 	Requests_count int 		`json:"requests_count"`
+	Misses_count int 		`json:"misses_count"`
 	Items []jsonTypeItem 	`json:"items"`
 }
 
+// jsonTypeItem serializes the params of a type in the order of schema,
+// with null for the ones it lacks.
 type jsonTypeItem struct {
 	type_ string
-	params []float64
+	schema paramSchema
+	params map[string]float64
 	requests_count int
-	image_list string
-}
-
-type keyItem struct {
-	Item_id string
-	Color string
-	Size string
-	Description string
+	misses_count int
+	image_ids []string
 }
 
 func (item jsonTypeItem) MarshalJSON() ([]byte, error) {
@@ -490,16 +414,19 @@ func (item jsonTypeItem) MarshalJSON() ([]byte, error) {
 	}
 	buffer.WriteString("\"type\":" + string(jsonValue) + ",")
 
-	for i, name := range paramNames {
-		jsonValue, err := json.Marshal(item.params[i])
-		if err != nil {
-			return nil, err
+	for _, p := range item.schema.Params {
+		jsonValue := []byte("null")
+		if value, ok := item.params[p.Name]; ok {
+			jsonValue, err = json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
 		}
-		buffer.WriteString(fmt.Sprintf("\"%s\":%s,", name, string(jsonValue)))
+		buffer.WriteString(fmt.Sprintf("\"%s\":%s,", p.Name, string(jsonValue)))
 	}
 
-	buffer.WriteString(fmt.Sprintf("\"requests_count\":%d,\"image_list\":[", item.requests_count))
-	ids := strings.Split(item.image_list, ",")
+	buffer.WriteString(fmt.Sprintf("\"requests_count\":%d,\"misses_count\":%d,\"image_list\":[", item.requests_count, item.misses_count))
+	ids := item.image_ids
 	for i, id := range ids {
 		jsonValue, err := json.Marshal(id)
 		if err != nil {
@@ -516,91 +443,114 @@ func (item jsonTypeItem) MarshalJSON() ([]byte, error) {
 }
 
 func itemsHandler(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("sqlite3", "sqlite3.db")
+	if redirectUnauthorized(w, r) {
+		return
+	}
+
+	rows, err := store.ItemsByToken(r.FormValue("token"))
 	if err != nil {
-		log.Printf("Error opening database: %v\n", err)
+		log.Print(err)
 		http.Error(w, "500 internal server error", 500)
 		return
 	}
-	defer db.Close()
 
-	if redirectUnauthorized(db, w, r) {
-		return
+	schemas := make(map[string]paramSchema)
+	items := make(map[itemKey][]jsonTypeItem)
+	categories := make(map[itemKey]string)
+	for _, row := range rows {
+		schema, ok := schemas[row.Category]
+		if !ok {
+			schema, err = schemaFor(row.Shop_id, row.Category)
+			if err != nil {
+				log.Print(err)
+				http.Error(w, "500 internal server error", 500)
+				return
+			}
+			schemas[row.Category] = schema
+		}
+		items[row.itemKey] = append(items[row.itemKey], 
+			jsonTypeItem{row.Type, schema, row.Params, row.Requests_count, row.Misses_count, row.Image_ids})
+		categories[row.itemKey] = row.Category
 	}
 
-	token := r.FormValue("token")
+	result := []jsonItem{}
+	for key, typeItems := range items {
+		requests_count, misses_count := 0, 0
+		for _, item := range typeItems {
+			requests_count += item.requests_count
+			misses_count += item.misses_count
+		}
+		result = append(result, jsonItem{key.Item_id, key.Color, key.Size, key.Description, categories[key],
+			requests_count, misses_count, typeItems})
+	}
 
-	stmt, err := db.Prepare(fmt.Sprintf("select item_id, color, size, description, type, image_list, requests_count, %v from items where token == ?", 
-		strings.Join(paramNames, ", ")))
+	json_result, err := json.Marshal(result)
 	if err != nil {
-		log.Printf("Error creating stmt: %v\n", err)
+		log.Printf("Error json serializing: %v\n", err)
 		http.Error(w, "500 internal server error", 500)
 		return
 	}
-	defer stmt.Close()
 
-	rows, err := stmt.Query(token)
-	if err != nil {
-		log.Printf("Error query execution: %v\n", err)
-		http.Error(w, "500 internal server error", 500)
+	fmt.Fprint(w, string(json_result))
+}
+
+// schemasHandler lists all measurement schemas as JSON (GET), or saves
+// ("v=save") or deletes ("v=delete") the schema of a shop_id and
+// category, where an empty shop_id applies to all shops (POST).
+func schemasHandler(w http.ResponseWriter, r *http.Request) {
+	if redirectUnauthorized(w, r) {
 		return
 	}
-	defer rows.Close()
-
-	items := make(map[keyItem][]jsonTypeItem)
-
-	for rows.Next() {
-		var item_id, color, size, description, type_, image_list string
-		var requests_count int
-		dest := make([]interface{}, 7 + len(paramNames))
-		dest[0] = &item_id
-		dest[1] = &color
-		dest[2] = &size
-		dest[3] = &description
-		dest[4] = &type_
-		dest[5] = &image_list
-		dest[6] = &requests_count
-		for i := range paramNames {
-			dest[i+7] = new(float64)
-		}
 
-		if err = rows.Scan(dest...); err != nil {
-			log.Print(err)
-			http.Error(w, "500 internal server error", 500)
-			return
-		}
+	if r.Method == http.MethodPost {
+		shop_id := r.FormValue("shop_id")
+		category := r.FormValue("category")
+		req_v := r.FormValue("v")
 
-		params := make([]float64, len(paramNames))
-		for i := range paramNames {
-			params[i] = *(dest[i+7].(*float64))		
-		}
+		if req_v == "save" {
+			schema, ok := parseSchemaForm(r, shop_id, category)
+			if !ok {
+				fmt.Fprint(w, "invalid_request")
+				return
+			}
+			if err := store.SaveSchema(schema); err != nil {
+				log.Print(err)
+				http.Error(w, "500 internal server error", 500)
+				return
+			}
+			fmt.Fprint(w, "ok")
 
-		items[keyItem{item_id, color, size, description}] = append(items[keyItem{item_id, color, size, description}], 
-			jsonTypeItem{type_, params, requests_count, image_list})
-	}
+		} else if req_v == "delete" {
+			deleted, err := store.DeleteSchema(shop_id, category)
+			if err != nil {
+				log.Print(err)
+				http.Error(w, "500 internal server error", 500)
+				return
+			}
+			if !deleted {
+				fmt.Fprint(w, "invalid_request")
+				return
+			}
+			fmt.Fprint(w, "ok")
 
-	if err = rows.Err(); err != nil {
-		log.Printf("Error scanning rows: %v\n", err)
-		http.Error(w, "500 internal server error", 500)
+		} else {
+			fmt.Fprint(w, "invalid_request")
+		}
 		return
 	}
 
-	result := []jsonItem{}
-	for key, typeItems := range items {
-		requests_count := 0
-		for _, item := range typeItems {
-			requests_count += item.requests_count
-		}
-		result = append(result, jsonItem{key.Item_id, key.Color, key.Size, key.Description, requests_count, typeItems})
+	schemas, err := store.ListSchemas()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "500 internal server error", 500)
+		return
 	}
-
-	json_result, err := json.Marshal(result)
+	json_result, err := json.Marshal(schemas)
 	if err != nil {
 		log.Printf("Error json serializing: %v\n", err)
 		http.Error(w, "500 internal server error", 500)
 		return
 	}
-
 	fmt.Fprint(w, string(json_result))
 }
 
@@ -609,18 +559,10 @@ func isLoginStatic(name string) bool {
 }
 
 func staticHandler(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("sqlite3", "sqlite3.db")
-	if err != nil {
-		log.Printf("Error opening database: %v\n", err)
-		http.Error(w, "500 internal server error", 500)
-		return
-	}
-	defer db.Close()
-
 	name := mux.Vars(r)["name"]
 
 	if !isLoginStatic(name) {
-		if redirectUnauthorized(db, w, r) {
+		if redirectUnauthorized(w, r) {
 			return
 		}
 	}
@@ -643,57 +585,21 @@ func staticHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func imagePanelHandler(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("sqlite3", "sqlite3.db")
-	if err != nil {
-		log.Printf("Error opening database: %v\n", err)
-		http.Error(w, "500 internal server error", 500)
+	if redirectUnauthorized(w, r) {
 		return
 	}
-	defer db.Close()
 
-	if redirectUnauthorized(db, w, r) {
-		return
+	if blob_id, ok := imageBlob(w, mux.Vars(r)["id"]); ok {
+		serveImageFile(w, "./images/" + blob_id + ".jpg")
 	}
-
-	id := mux.Vars(r)["id"]
-	file, err := os.Open("./images/" + id + ".jpg")
-	if err != nil {
-		http.Error(w, "404 file not found", 404)
-		return
-	}
-	defer file.Close()
-
-	fileStat, _ := file.Stat()
-	fileSize := strconv.FormatInt(fileStat.Size(), 10)
-	w.Header().Set("Content-Type", "image/jpg")
-	w.Header().Set("Content-Length", fileSize)
-	io.Copy(w, file)
 }
 
 func previewHandler(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("sqlite3", "sqlite3.db")
-	if err != nil {
-		log.Printf("Error opening database: %v\n", err)
-		http.Error(w, "500 internal server error", 500)
+	if redirectUnauthorized(w, r) {
 		return
 	}
-	defer db.Close()
 
-	if redirectUnauthorized(db, w, r) {
-		return
+	if blob_id, ok := imageBlob(w, mux.Vars(r)["id"]); ok {
+		serveImageFile(w, "./images/previews/" + blob_id + ".jpg")
 	}
-
-	id := mux.Vars(r)["id"]
-	file, err := os.Open("./images/previews/" + id + ".jpg")
-	if err != nil {
-		http.Error(w, "404 file not found", 404)
-		return
-	}
-	defer file.Close()
-
-	fileStat, _ := file.Stat()
-	fileSize := strconv.FormatInt(fileStat.Size(), 10)
-	w.Header().Set("Content-Type", "image/jpg")
-	w.Header().Set("Content-Length", fileSize)
-	io.Copy(w, file)
-}
\ No newline at end of file
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// paramDef describes one measurement of a schema. Values are stored in
+// Unit, and Min and Max are in Unit too. A range with Min and Max both
+// 0 is not checked.
+type paramDef struct {
+	Name string `json:"name"`
+	Unit string `json:"unit"`
+	Weight float64 `json:"weight"`
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// paramSchema is the set of measurements items of a shop and garment
+// category are described with. An empty Shop_id applies to all shops,
+// an empty Category to all categories of the shop.
+type paramSchema struct {
+	Shop_id string `json:"shop_id"`
+	Category string `json:"category"`
+	Params []paramDef `json:"params"`
+}
+
+var paramNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// reservedParamNames are form fields of the API that can't be params.
+var reservedParamNames = map[string]bool{
+	"token": true, "shop_id": true, "id": true, "color": true, "size": true, "description": true,
+	"type": true, "category": true, "image_ids": true, "mode": true, "k": true, "delete_images": true,
+	"unit": true, "keys": true, "queries": true, "explain": true,
+}
+
+// lengthUnits are the units requests can send params in, by their size
+// in centimetres. Params of a schema with one of these units are
+// converted to it; other units must match exactly.
+var lengthUnits = map[string]float64{"mm": 0.1, "cm": 1, "in": 2.54}
+
+// Errors of a single param, reported by parseParams.
+const (
+	paramMissing = "missing"
+	paramNotANumber = "not_a_number"
+	paramOutOfRange = "out_of_range"
+	paramUnknownUnit = "unknown_unit"
+	paramIncompatibleUnit = "incompatible_unit"
+)
+
+// defaultSchema is built from paramNames and paramWeights and applies
+// when the database has no schema for a shop and category.
+func defaultSchema() paramSchema {
+	schema := paramSchema{Params: make([]paramDef, len(paramNames))}
+	for i, name := range paramNames {
+		schema.Params[i] = paramDef{Name: name, Unit: paramUnit, Weight: paramWeights[i], Min: paramRanges[i][0], Max: paramRanges[i][1]}
+	}
+	return schema
+}
+
+// schemaFor returns the schema that applies to items of a shop and
+// category, trying the shop's schema for the category, the shop's
+// default, the global schema for the category and defaultSchema in
+// this order.
+func schemaFor(shop_id, category string) (paramSchema, error) {
+	candidates := [][2]string{{shop_id, category}, {shop_id, ""}, {"", category}}
+	for i, c := range candidates {
+		if i > 0 && c == candidates[i-1] {
+			continue
+		}
+		schema, found, err := store.GetSchema(c[0], c[1])
+		if err != nil || found {
+			return schema, err
+		}
+	}
+	return defaultSchema(), nil
+}
+
+func (schema paramSchema) names() []string {
+	names := make([]string, len(schema.Params))
+	for i, p := range schema.Params {
+		names[i] = p.Name
+	}
+	return names
+}
+
+func (schema paramSchema) weights() []float64 {
+	weights := make([]float64, len(schema.Params))
+	for i, p := range schema.Params {
+		weights[i] = p.Weight
+	}
+	return weights
+}
+
+// check reports why a schema can't be saved.
+func (schema paramSchema) check() error {
+	if len(schema.Params) == 0 {
+		return fmt.Errorf("Schema has no params\n")
+	}
+	seen := map[string]bool{}
+	for _, p := range schema.Params {
+		if !paramNameRegexp.MatchString(p.Name) || reservedParamNames[p.Name] {
+			return fmt.Errorf("Invalid param name %q\n", p.Name)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("Duplicate param %v\n", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Weight < 0 {
+			return fmt.Errorf("Negative weight of %v\n", p.Name)
+		}
+		if (p.Min != 0 || p.Max != 0) && p.Min >= p.Max {
+			return fmt.Errorf("Invalid range of %v\n", p.Name)
+		}
+	}
+	return nil
+}
+
+// convertUnit converts a length between lengthUnits, rounded to 4
+// decimals so that converted values don't pick up float noise.
+func convertUnit(value float64, from, to string) (float64, bool) {
+	if from == to {
+		return value, true
+	}
+	fromSize, toSize := lengthUnits[from], lengthUnits[to]
+	if fromSize == 0 || toSize == 0 {
+		return 0, false
+	}
+	return math.Round(value * fromSize / toSize * 1e4) / 1e4, true
+}
+
+// parseParams reads every param of the schema from the request,
+// converted from the request's "unit" to the param's unit. errs maps
+// the fields that are missing, not numbers, out of range or in the wrong
+// unit to one of the param errors above, and is empty if params are ok.
+func (schema paramSchema) parseParams(r *http.Request) (params map[string]float64, errs map[string]string) {
+	return schema.parseValues(r.FormValue)
+}
+
+// parseValues is parseParams with the fields read by value.
+func (schema paramSchema) parseValues(value func(string) string) (params map[string]float64, errs map[string]string) {
+	params, errs = map[string]float64{}, map[string]string{}
+	unit := value("unit")
+	if unit != "" && lengthUnits[unit] == 0 {
+		errs["unit"] = paramUnknownUnit
+		return nil, errs
+	}
+
+	for _, p := range schema.Params {
+		if value(p.Name) == "" {
+			errs[p.Name] = paramMissing
+			continue
+		}
+		v, err := strconv.ParseFloat(value(p.Name), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			errs[p.Name] = paramNotANumber
+			continue
+		}
+		if unit != "" {
+			var ok bool
+			if v, ok = convertUnit(v, unit, p.Unit); !ok {
+				errs[p.Name] = paramIncompatibleUnit
+				continue
+			}
+		}
+		if (p.Min != 0 || p.Max != 0) && (v < p.Min || v > p.Max) {
+			errs[p.Name] = paramOutOfRange
+			continue
+		}
+		params[p.Name] = v
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return params, errs
+}
+
+// vector returns params in schema order. ok is false if one of the
+// schema's params is missing, e.g. for items saved before the schema
+// changed.
+func (schema paramSchema) vector(params map[string]float64) (vector []float64, ok bool) {
+	vector = make([]float64, len(schema.Params))
+	for i, p := range schema.Params {
+		value, found := params[p.Name]
+		if !found {
+			return nil, false
+		}
+		vector[i] = value
+	}
+	return vector, true
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSchemas(s Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1", 0})
+		trousers := paramSchema{"1", "trousers", []paramDef{
+			{"waist", "cm", 1, 50, 150},
+			{"inseam", "cm", 0.5, 0, 0},
+		}}
+		if err := s.SaveSchema(trousers); err != nil {
+			t.Fatalf("Error SaveSchema: %v", err)
+		}
+		s.SaveSchema(paramSchema{"", "shoes", []paramDef{{"length", "mm", 1, 0, 0}}})
+
+		schema, found, err := s.GetSchema("1", "trousers")
+		if err != nil || !found || len(schema.Params) != 2 || schema.Params[1] != trousers.Params[1] {
+			t.Fatalf("GetSchema returned %v, %v, %v", schema, found, err)
+		}
+		if _, found, _ = s.GetSchema("1", "shoes"); found {
+			t.Fatalf("GetSchema found a missing schema")
+		}
+
+		// saving again replaces the params
+		trousers.Params = trousers.Params[:1]
+		s.SaveSchema(trousers)
+		if schema, _, _ = s.GetSchema("1", "trousers"); len(schema.Params) != 1 {
+			t.Fatalf("Schema not replaced: %v", schema)
+		}
+		if schemas, _ := s.ListSchemas(); len(schemas) != 2 || schemas[0].Category != "shoes" {
+			t.Fatalf("ListSchemas returned %v", schemas)
+		}
+
+		// schemas follow their shop
+		s.EditToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "2", 0})
+		if _, found, _ = s.GetSchema("2", "trousers"); !found {
+			t.Fatalf("Schema didn't follow the shop id")
+		}
+		s.DeleteToken("t_1")
+		if _, found, _ = s.GetSchema("2", "trousers"); found {
+			t.Fatalf("Schema of a deleted token left")
+		}
+
+		if ok, _ := s.DeleteSchema("", "shoes"); !ok {
+			t.Fatalf("DeleteSchema failed")
+		}
+		if ok, _ := s.DeleteSchema("", "shoes"); ok {
+			t.Fatalf("Deleted a missing schema")
+		}
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	t.Run("memory", testSchemas(newMemoryStore()))
+	t.Run("sql", testSchemas(openTestStore(t)))
+}
+
+func TestSchemaFor(t *testing.T) {
+	s := useMemoryStore(t)
+	s.SaveSchema(paramSchema{"1", "trousers", []paramDef{{"a", "", 1, 0, 0}}})
+	s.SaveSchema(paramSchema{"1", "", []paramDef{{"b", "", 1, 0, 0}}})
+	s.SaveSchema(paramSchema{"", "trousers", []paramDef{{"c", "", 1, 0, 0}}})
+
+	tests := []struct {
+		shop_id, category string
+		want string
+	}{
+		{"1", "trousers", "a"},
+		{"1", "shoes", "b"},
+		{"1", "", "b"},
+		{"2", "trousers", "c"},
+		{"2", "shoes", paramNames[0]},
+	}
+	for _, test := range tests {
+		schema, err := schemaFor(test.shop_id, test.category)
+		if err != nil || schema.Params[0].Name != test.want {
+			t.Errorf("schemaFor(%v, %v) = %v, %v", test.shop_id, test.category, schema, err)
+		}
+	}
+}
+
+func TestDefaultSchema(t *testing.T) {
+	schema := defaultSchema()
+	if err := schema.check(); err != nil {
+		t.Fatalf("Invalid default schema: %v", err)
+	}
+	// requests without a unit are in millimetres, like the stored items
+	form := url.Values{}
+	for _, name := range paramNames {
+		form.Set(name, "800")
+	}
+	if params, errs := schema.parseValues(form.Get); len(errs) != 0 || params[paramNames[0]] != 800 {
+		t.Fatalf("Values in millimetres returned %v, %v", params, errs)
+	}
+	// centimetres sent without a unit are caught
+	for _, name := range paramNames {
+		form.Set(name, "80")
+	}
+	if _, errs := schema.parseValues(form.Get); len(errs) != len(paramNames) || errs[paramNames[0]] != paramOutOfRange {
+		t.Fatalf("Values out of range accepted: %v", errs)
+	}
+	form.Set("unit", "cm")
+	if params, errs := schema.parseValues(form.Get); len(errs) != 0 || params[paramNames[0]] != 800 {
+		t.Fatalf("Values in centimetres returned %v, %v", params, errs)
+	}
+}
+
+func TestSchemaCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		params []paramDef
+		ok bool
+	}{
+		{"valid", []paramDef{{"waist", "cm", 1, 50, 150}, {"hip_2", "cm", 0, 0, 0}}, true},
+		{"empty", []paramDef{}, false},
+		{"bad name", []paramDef{{"Waist size", "cm", 1, 0, 0}}, false},
+		{"reserved name", []paramDef{{"token", "cm", 1, 0, 0}}, false},
+		{"duplicate", []paramDef{{"waist", "cm", 1, 0, 0}, {"waist", "cm", 1, 0, 0}}, false},
+		{"negative weight", []paramDef{{"waist", "cm", -1, 0, 0}}, false},
+		{"empty range", []paramDef{{"waist", "cm", 1, 10, 10}}, false},
+	}
+	for _, test := range tests {
+		if err := (paramSchema{Params: test.params}).check(); (err == nil) != test.ok {
+			t.Errorf("%v: check returned %v", test.name, err)
+		}
+	}
+}
+
+func TestSchemaHandlers(t *testing.T) {
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1234", 0})
+	s.AddImage("t_1", "img1", "img1")
+
+	form := url.Values{"token": {"t_1"}, "category": {"trousers"},
+		"params": {`[{"name":"waist","unit":"cm","weight":1,"min":50,"max":150},{"name":"inseam","unit":"cm","weight":1}]`}}
+	if body := serve("POST", prefix + "/schema", form).Body.String(); body != `{"error":"","result":""}` {
+		t.Fatalf("Unexpected /schema response: %v", body)
+	}
+	if body := serve("GET", prefix + "/schema?token=t_1&category=trousers", nil).Body.String(); !strings.Contains(body, `"name":"inseam"`) {
+		t.Fatalf("Unexpected /schema response: %v", body)
+	}
+	if body := serve("GET", prefix + "/schema?token=t_1&category=shirts", nil).Body.String(); !strings.Contains(body, `"name":"d1"`) {
+		t.Fatalf("Default schema not returned: %v", body)
+	}
+	form.Set("params", `[{"name":"id"}]`)
+	if body := serve("POST", prefix + "/schema", form).Body.String(); body != `{"error":"invalid_request"}` {
+		t.Fatalf("Invalid schema accepted: %v", body)
+	}
+
+	update := url.Values{"token": {"t_1"}, "id": {"jeans"}, "category": {"trousers"}, "type": {"1"},
+		"image_ids": {"img1"}, "waist": {"80"}, "inseam": {"80"}}
+	if body := serve("POST", prefix + "/update", update).Body.String(); body != `{"error":"","result":"","status":"created"}` {
+		t.Fatalf("Unexpected /update response: %v", body)
+	}
+	update.Set("type", "2")
+	update.Set("waist", "90")
+	serve("POST", prefix + "/update", update)
+	update.Set("type", "3")
+	update.Set("waist", "200")
+	if body := serve("POST", prefix + "/update", update).Body.String(); body != `{"error":"invalid_params","fields":{"waist":"out_of_range"}}` {
+		t.Fatalf("Out of range param accepted: %v", body)
+	}
+	// types of an item can't mix categories
+	update = itemForm("t_1", "3", 600)
+	update.Set("id", "jeans")
+	update.Del("color")
+	update.Del("size")
+	if body := serve("POST", prefix + "/update", update).Body.String(); body != `{"error":"invalid_request"}` {
+		t.Fatalf("Mixed categories accepted: %v", body)
+	}
+
+	get := url.Values{"shop_id": {"1234"}, "id": {"jeans"}, "waist": {"88"}, "inseam": {"80"}}
+	if body := serve("POST", prefix + "/get", get).Body.String(); body != `{"error":"","result":["img1"],"type":"2","params":[90,80]}` {
+		t.Fatalf("Unexpected /get response: %v", body)
+	}
+	get.Set("unit", "in")
+	if body := serve("POST", prefix + "/get", get).Body.String(); body != `{"error":"invalid_params","fields":{"waist":"out_of_range"}}` {
+		t.Fatalf("Out of range converted params accepted: %v", body)
+	}
+	get.Set("waist", "35.5")
+	get.Set("inseam", "31.5")
+	if body := serve("POST", prefix + "/get", get).Body.String(); body != `{"error":"","result":["img1"],"type":"2","params":[90,80]}` {
+		t.Fatalf("Unexpected /get response in inches: %v", body)
+	}
+	get.Del("unit")
+	get.Set("waist", "88")
+	get.Del("inseam")
+	useMissingParams(t, missingParamsReject)
+	if body := serve("POST", prefix + "/get", get).Body.String(); body != `{"error":"invalid_params","fields":{"inseam":"missing"}}` {
+		t.Fatalf("Missing param accepted: %v", body)
+	}
+
+	form = url.Values{"token": {"t_1"}, "category": {"trousers"}, "delete": {"1"}}
+	if body := serve("POST", prefix + "/schema", form).Body.String(); body != `{"error":"","result":""}` {
+		t.Fatalf("Unexpected /schema response: %v", body)
+	}
+	// the items lack the params of the default schema now
+	get = itemForm("", "", 600)
+	get.Set("shop_id", "1234")
+	get.Set("id", "jeans")
+	get.Del("color")
+	get.Del("size")
+	if body := serve("POST", prefix + "/get", get).Body.String(); body != `{"error":"invalid_id"}` {
+		t.Fatalf("Unexpected /get response: %v", body)
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	schema := paramSchema{Params: []paramDef{{"waist", "cm", 1, 50, 150}, {"height", "cm", 1, 0, 0}, {"weight", "kg", 1, 0, 0}}}
+	tests := []struct {
+		form url.Values
+		params map[string]float64
+		errs map[string]string
+	}{
+		{url.Values{"waist": {"80"}, "height": {"180.5"}, "weight": {"70"}},
+			map[string]float64{"waist": 80, "height": 180.5, "weight": 70}, nil},
+		{url.Values{"waist": {"805"}, "height": {"1805"}, "weight": {"70"}, "unit": {"mm"}},
+			nil, map[string]string{"weight": paramIncompatibleUnit}},
+		{url.Values{"waist": {"31.5"}, "height": {"70"}, "unit": {"in"}, "weight": {"70"}},
+			nil, map[string]string{"weight": paramIncompatibleUnit}},
+		{url.Values{"waist": {"805"}, "height": {"x"}, "weight": {"NaN"}, "unit": {"mm"}},
+			nil, map[string]string{"height": paramNotANumber, "weight": paramNotANumber}},
+		{url.Values{"waist": {"20"}}, nil, map[string]string{"waist": paramOutOfRange, "height": paramMissing, "weight": paramMissing}},
+		{url.Values{"waist": {"80"}, "unit": {"ft"}}, nil, map[string]string{"unit": paramUnknownUnit}},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/?" + test.form.Encode(), nil)
+		params, errs := schema.parseParams(r)
+		if fmt.Sprint(params) != fmt.Sprint(test.params) || fmt.Sprint(errs) != fmt.Sprint(test.errs) {
+			t.Errorf("%v: parseParams returned %v, %v", test.form, params, errs)
+		}
+	}
+
+	lengths := schema
+	lengths.Params = lengths.Params[:2]
+	r := httptest.NewRequest("GET", "/?waist=805&height=31.5&unit=mm", nil)
+	if params, errs := lengths.parseParams(r); len(errs) != 0 || params["waist"] != 80.5 || params["height"] != 3.15 {
+		t.Errorf("Wrong mm conversion: %v, %v", params, errs)
+	}
+	r = httptest.NewRequest("GET", "/?waist=31.5&height=70&unit=in", nil)
+	if params, errs := lengths.parseParams(r); len(errs) != 0 || params["waist"] != 80.01 || params["height"] != 177.8 {
+		t.Errorf("Wrong in conversion: %v, %v", params, errs)
+	}
+}
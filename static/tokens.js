@@ -45,6 +45,23 @@ function deleteToken(token) {
 	xhttp.send(encodeURI("v=delete&token=" + token));
 }
 
+function restoreToken(token) {
+	var xhttp = new XMLHttpRequest();
+	xhttp.onreadystatechange = function() {
+		if (this.readyState == 4) {
+			if (this.responseText === "ok") {
+				window.location.reload(true);
+			}
+			else {
+				alert("Something went wrong");
+			}
+		}
+	};
+	xhttp.open("POST", "", true);
+	xhttp.setRequestHeader("Content-type", "application/x-www-form-urlencoded");
+	xhttp.send(encodeURI("v=restore&token=" + token));
+}
+
 function editToken(token, num) {
 	var shop_id = document.getElementById("shop_id" + num).value;
 	var description = document.getElementById("description" + num).value;
@@ -75,6 +92,12 @@ function getRandomString() {
 	return Math.random().toString(36).substring(2, 15) + Math.random().toString(36).substring(2, 15);
 }
 
+// requests, and how many of them found no type that fits
+function countsText(item) {
+	if (item.misses_count == 0) return "" + item.requests_count;
+	return item.requests_count + " (no fit: " + item.misses_count + ")";
+}
+
 function loadItems(token, num) {
 	var modal_body = document.getElementById("modal_body_" + num)
 	modal_body.innerHTML = "<p>Loading...</p>";
@@ -91,21 +114,21 @@ function loadItems(token, num) {
 				if (response[i].color !== "") summary += ", Color: " + response[i].color;
 				if (response[i].size !== "") summary += ", Size: " + response[i].size;
 				if (response[i].description !== "") summary += ", Description: " + response[i].description;
+				if (response[i].category !== "") summary += ", Category: " + response[i].category;
 
 				var subblock = ""
 				for (var j = 0;j<response[i].items.length;j++) {
-					var subblock_summary = "Type: " + response[i].items[j].type + 
-						", d1: " + response[i].items[j].d1 +
-						", d2: " + response[i].items[j].d2 +
-						", d3: " + response[i].items[j].d3 +
-						", d4: " + response[i].items[j].d4 +
-						", d5: " + response[i].items[j].d5; 
+					var subblock_summary = "Type: " + response[i].items[j].type;
+					for (var name in response[i].items[j]) {
+						if (name === "type" || name === "requests_count" || name === "misses_count" || name === "image_list") continue;
+						subblock_summary += ", " + name + ": " + response[i].items[j][name];
+					}
 
 					id1 = getRandomString();
 					id2 = getRandomString();
 
 					subblock += "<details class=\"my-1\" id=\"" + id1 + "\"><summary class=\"d-flex flex-row\"><p class=\"mr-1 mb-0\">" + subblock_summary + 
-						"</p><p class=\"text-right text-nowrap requests-count ml-auto mb-0\">" + response[i].items[j].requests_count + "</p></summary><div id=\"" + id2 + 
+						"</p><p class=\"text-right text-nowrap requests-count ml-auto mb-0\">" + countsText(response[i].items[j]) + "</p></summary><div id=\"" + id2 + 
 						"\" class=\"d-flex flex-row flex-wrap shadow-box rounded images-block\"></div></details>";
 					$('body').on('click', '#' + id1, function(image_list, id2) {
 						return function() {
@@ -124,7 +147,7 @@ function loadItems(token, num) {
 				}
 
 				block += "<details class=\"my-1\"><summary class=\"d-flex flex-row\"><p class=\"mb-0 mr-1\">" + summary + 
-					"</p><p class=\"text-right text-nowrap requests-count ml-auto mb-0\">" + response[i].requests_count + "</p></summary><div class=\"ml-4\">"
+					"</p><p class=\"text-right text-nowrap requests-count ml-auto mb-0\">" + countsText(response[i]) + "</p></summary><div class=\"ml-4\">"
 					+ subblock + "</div></details>";
 			}
 
@@ -0,0 +1,214 @@
+package main
+
+import "errors"
+
+// Store is the persistence layer shared by all HTTP handlers. It covers
+// API tokens, uploaded images, item types, measurement schemas and admin
+// panel sessions.
+type Store interface {
+	// tokens
+	IsValidToken(token string) (bool, error)
+	TokenExists(token string) (bool, error)
+	ShopIDExists(shop_id string) (bool, error)
+	GetShopID(token string) (string, error)
+	CreateToken(t tokenRow) error
+	EditToken(t tokenRow) error
+	// DeleteToken deletes the token with its images and items for good.
+	DeleteToken(token string) error
+	// ListTokens returns all tokens, including the ones in the trash.
+	ListTokens() ([]tokenRow, error)
+	// TrashToken moves the token to the trash, where it is invisible to
+	// the public API, and reports whether it was active.
+	TrashToken(token string) (bool, error)
+	// RestoreToken takes the token out of the trash and reports whether
+	// it was there.
+	RestoreToken(token string) (bool, error)
+	// TrashedTokens returns the tokens moved to the trash before the
+	// given unix time.
+	TrashedTokens(before int64) ([]string, error)
+	// DeleteTrashedToken deletes the token like DeleteToken if it was
+	// moved to the trash before the given unix time and reports whether
+	// it did.
+	DeleteTrashedToken(token string, before int64) (bool, error)
+	// ImportToken adds a token with its images, items and schemas at
+	// once. It fails without writing anything if the token, its shop_id
+	// or one of its images already exists.
+	ImportToken(c tokenCopy) error
+
+	// images; each refers to the blob its files are stored under, which
+	// images with the same content share
+	// AddImage adds an image referring to a blob and reports whether the
+	// blob is new, in which case the caller stores its files. It fails
+	// with errBlobRemoving while the blob's files are being removed.
+	AddImage(token, image_id, blob_id string) (bool, error)
+	ImageExists(image_id string) (bool, error)
+	IsValidImageID(image_id string) (bool, error)
+	// ImageBlob returns the blob of an image, "" if it doesn't exist.
+	ImageBlob(image_id string) (string, error)
+	// ImageBlobs returns the blobs of the token's images by image_id.
+	ImageBlobs(token string) (map[string]string, error)
+	// BlobReferences returns how many images refer to a blob.
+	BlobReferences(blob_id string) (int, error)
+	// ReleaseBlob marks a blob that no image refers to as being removed
+	// and reports whether it did; the caller then removes its files and
+	// calls DeleteBlob. A blob marked longer than blobRemovalTimeout ago
+	// is marked again, to finish removals that stopped halfway.
+	ReleaseBlob(blob_id string) (bool, error)
+	// DeleteBlob deletes a blob marked by ReleaseBlob.
+	DeleteBlob(blob_id string) error
+	// UnreferencedBlobs returns the blobs that no image refers to.
+	UnreferencedBlobs() ([]string, error)
+	ImagesCount(token string) (int, error)
+	ImagesByToken(token string) ([]string, error)
+	// OrphanedImages returns the images uploaded before the given unix
+	// time that no item refers to.
+	OrphanedImages(before int64) ([]string, error)
+	// DeleteOrphanedImage deletes the image if no item refers to it and
+	// reports whether it did.
+	DeleteOrphanedImage(image_id string) (bool, error)
+
+	// items
+	ItemExists(key itemKey, type_ string) (bool, error)
+	// AddItem inserts item as is, including its requests_count.
+	AddItem(item itemRow) error
+	// SaveItem creates or updates the params and images of an item type
+	// according to mode (see checkSaveMode) and reports whether a new
+	// row was created.
+	SaveItem(item itemRow, mode string) (created bool, err error)
+	// DeleteItems deletes the token's item types selected by scope and
+	// returns how many were deleted. With deleteImages it also deletes
+	// their images that no remaining item refers to and returns their ids.
+	DeleteItems(token string, scope string, key itemKey, type_ string, deleteImages bool) (int, []string, error)
+	ItemTypes(shop_id string, key itemKey) ([]itemRow, error)
+	// ItemTypesBatch returns the ItemTypes of each of keys, read at once.
+	ItemTypesBatch(shop_id string, keys []itemKey) ([][]itemRow, error)
+	// ItemColorTypes returns the types of every size and description of
+	// an item in a color.
+	ItemColorTypes(shop_id, item_id, color string) ([]itemRow, error)
+	IncrementRequests(shop_id string, key itemKey, type_ string) error
+	// IncrementMisses counts a /get whose nearest type was too far off to
+	// be a fit.
+	IncrementMisses(shop_id string, key itemKey, type_ string) error
+	// AddRequests adds to the requests_count and misses_count of many
+	// types at once.
+	AddRequests(counts map[typeKey]requestCounts) error
+	ItemsByToken(token string) ([]itemRow, error)
+	ItemsCount(token string) (int, error)
+
+	// measurement schemas
+	GetSchema(shop_id, category string) (paramSchema, bool, error)
+	// SaveSchema creates or replaces the schema of its shop and category.
+	SaveSchema(schema paramSchema) error
+	DeleteSchema(shop_id, category string) (bool, error)
+	ListSchemas() ([]paramSchema, error)
+
+	// admin sessions
+	AddUUID(id string) error
+	CheckUUID(id string) (bool, error)
+
+	Close() error
+}
+
+type tokenRow struct {
+	Token string
+	Exp_time int64
+	Description string
+	Shop_id string
+	Deleted_at int64 // unix time the token was moved to the trash, 0 if active
+}
+
+// tokenCopy is a token with everything that belongs to it, as export and
+// import move it between stores.
+type tokenCopy struct {
+	Token tokenRow
+	Image_ids []string
+	Blobs map[string]string // image_id -> blob_id
+	Items []itemRow
+	Schemas []paramSchema // of the token's shop
+}
+
+// itemKey identifies an item; every item has one or more types.
+type itemKey struct {
+	Item_id string
+	Color string
+	Size string
+	Description string
+}
+
+type itemRow struct {
+	Id int64
+	Token string
+	Shop_id string
+	itemKey
+	Category string
+	Type string
+	Params map[string]float64
+	Image_ids []string
+	Requests_count int
+	Misses_count int // requests this was the nearest type for but not a fit
+}
+
+// requestCounts are the /get requests for a type not yet written to the
+// store.
+type requestCounts struct {
+	Requests int
+	Misses int
+}
+
+var store Store
+
+const (
+	saveModeCreate = "create"
+	saveModeReplace = "replace"
+	saveModeUpsert = "upsert"
+)
+
+// Scopes of DeleteItems
+const (
+	deleteScopeType = "type" // one type of key
+	deleteScopeKey = "key" // all types of key
+	deleteScopeItem = "item" // everything with key.Item_id
+)
+
+var (
+	errItemExists = errors.New("item type already exists")
+	errItemNotFound = errors.New("item type not found")
+	errInvalidMode = errors.New("invalid save mode")
+	errBlobRemoving = errors.New("blob files are being removed")
+)
+
+// matchesDelete reports whether item is selected by a DeleteItems scope.
+func matchesDelete(item itemRow, scope string, key itemKey, type_ string) bool {
+	switch scope {
+	case deleteScopeType:
+		return item.itemKey == key && item.Type == type_
+	case deleteScopeKey:
+		return item.itemKey == key
+	case deleteScopeItem:
+		return item.Item_id == key.Item_id
+	}
+	return false
+}
+
+// checkSaveMode decides whether SaveItem may go ahead. found tells if the
+// item type already exists, sameToken if it belongs to the saving token.
+// A token can never overwrite another token's item.
+func checkSaveMode(mode string, found, sameToken bool) error {
+	switch mode {
+	case saveModeCreate:
+		if found {
+			return errItemExists
+		}
+	case saveModeReplace:
+		if !found {
+			return errItemNotFound
+		}
+	case saveModeUpsert:
+	default:
+		return errInvalidMode
+	}
+	if found && !sameToken {
+		return errItemExists
+	}
+	return nil
+}
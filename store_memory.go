@@ -0,0 +1,650 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in process memory. It is used by tests
+// and loses all data on restart.
+type memoryStore struct {
+	mu sync.Mutex
+	tokens map[string]tokenRow
+	images map[string]string // image_id -> token
+	blobs map[string]string // image_id -> blob_id
+	blobRows map[string]int64 // blob_id -> removing_at
+	imageTimes map[string]int64 // image_id -> upload time
+	items []itemRow
+	nextId int64
+	schemas map[[2]string]paramSchema // {shop_id, category} -> schema
+	uuids map[string]bool
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		tokens: map[string]tokenRow{},
+		images: map[string]string{},
+		blobs: map[string]string{},
+		blobRows: map[string]int64{},
+		imageTimes: map[string]int64{},
+		schemas: map[[2]string]paramSchema{},
+		uuids: map[string]bool{},
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) IsValidToken(token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	return ok && t.Deleted_at == 0 && t.Exp_time > time.Now().Unix(), nil
+}
+
+func (s *memoryStore) TokenExists(token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.tokens[token]
+	return ok, nil
+}
+
+func (s *memoryStore) ShopIDExists(shop_id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if t.Shop_id == shop_id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) GetShopID(token string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok {
+		return "", fmt.Errorf("Token %v not exists\n", token)
+	}
+	return t.Shop_id, nil
+}
+
+func (s *memoryStore) CreateToken(t tokenRow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[t.Token]; ok {
+		return fmt.Errorf("Token %v already exists\n", t.Token)
+	}
+	s.tokens[t.Token] = t
+	return nil
+}
+
+func (s *memoryStore) EditToken(t tokenRow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.tokens[t.Token]
+	if !ok {
+		return nil
+	}
+	t.Deleted_at = old.Deleted_at
+	s.tokens[t.Token] = t
+	for i := range s.items {
+		if s.items[i].Token == t.Token {
+			s.items[i].Shop_id = t.Shop_id
+		}
+	}
+	if old.Shop_id != t.Shop_id {
+		for key, schema := range s.schemas {
+			if key[0] == old.Shop_id {
+				delete(s.schemas, key)
+				schema.Shop_id = t.Shop_id
+				s.schemas[[2]string{t.Shop_id, key[1]}] = schema
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteToken(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteToken(token)
+	return nil
+}
+
+// deleteToken must be called with s.mu held.
+func (s *memoryStore) deleteToken(token string) {
+	for key := range s.schemas {
+		if key[0] == s.tokens[token].Shop_id {
+			delete(s.schemas, key)
+		}
+	}
+	delete(s.tokens, token)
+	for id, owner := range s.images {
+		if owner == token {
+			delete(s.images, id)
+			delete(s.imageTimes, id)
+			delete(s.blobs, id)
+		}
+	}
+	items := s.items[:0]
+	for _, item := range s.items {
+		if item.Token != token {
+			items = append(items, item)
+		}
+	}
+	s.items = items
+}
+
+func (s *memoryStore) ListTokens() ([]tokenRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []tokenRow{}
+	for _, t := range s.tokens {
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+func (s *memoryStore) TrashToken(token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok || t.Deleted_at != 0 {
+		return false, nil
+	}
+	t.Deleted_at = time.Now().Unix()
+	s.tokens[token] = t
+	return true, nil
+}
+
+func (s *memoryStore) RestoreToken(token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok || t.Deleted_at == 0 {
+		return false, nil
+	}
+	t.Deleted_at = 0
+	s.tokens[token] = t
+	return true, nil
+}
+
+func (s *memoryStore) TrashedTokens(before int64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []string{}
+	for token, t := range s.tokens {
+		if t.Deleted_at != 0 && t.Deleted_at < before {
+			result = append(result, token)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (s *memoryStore) DeleteTrashedToken(token string, before int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok || t.Deleted_at == 0 || t.Deleted_at >= before {
+		return false, nil
+	}
+	s.deleteToken(token)
+	return true, nil
+}
+
+func (s *memoryStore) ImportToken(c tokenCopy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[c.Token.Token]; ok {
+		return fmt.Errorf("Token %v already exists\n", c.Token.Token)
+	}
+	for _, t := range s.tokens {
+		if t.Shop_id == c.Token.Shop_id {
+			return fmt.Errorf("Shop id %v already exists\n", c.Token.Shop_id)
+		}
+	}
+	for _, image_id := range c.Image_ids {
+		if _, ok := s.images[image_id]; ok {
+			return fmt.Errorf("Image %v already exists\n", image_id)
+		}
+	}
+	for _, blob_id := range c.Blobs {
+		if s.blobRows[blob_id] != 0 {
+			return errBlobRemoving
+		}
+	}
+
+	s.tokens[c.Token.Token] = c.Token
+	now := time.Now().Unix()
+	for _, image_id := range c.Image_ids {
+		s.images[image_id] = c.Token.Token
+		s.blobs[image_id] = c.Blobs[image_id]
+		s.blobRows[c.Blobs[image_id]] = 0
+		s.imageTimes[image_id] = now
+	}
+	for _, item := range c.Items {
+		s.addItem(item)
+	}
+	for _, schema := range c.Schemas {
+		schema.Params = append([]paramDef(nil), schema.Params...)
+		s.schemas[[2]string{schema.Shop_id, schema.Category}] = schema
+	}
+	return nil
+}
+
+func (s *memoryStore) AddImage(token, image_id, blob_id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blobRows[blob_id] != 0 {
+		return false, errBlobRemoving
+	}
+	_, exists := s.blobRows[blob_id]
+	s.blobRows[blob_id] = 0
+	s.images[image_id] = token
+	s.blobs[image_id] = blob_id
+	s.imageTimes[image_id] = time.Now().Unix()
+	return !exists, nil
+}
+
+func (s *memoryStore) ImageExists(image_id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.images[image_id]
+	return ok, nil
+}
+
+func (s *memoryStore) IsValidImageID(image_id string) (bool, error) {
+	s.mu.Lock()
+	token, ok := s.images[image_id]
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return s.IsValidToken(token)
+}
+
+func (s *memoryStore) ImageBlob(image_id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blobs[image_id], nil
+}
+
+func (s *memoryStore) ImageBlobs(token string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := map[string]string{}
+	for image_id, owner := range s.images {
+		if owner == token {
+			result[image_id] = s.blobs[image_id]
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) BlobReferences(blob_id string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := 0
+	for _, b := range s.blobs {
+		if b == blob_id {
+			result++
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) ReleaseBlob(blob_id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removing_at, ok := s.blobRows[blob_id]
+	now := time.Now().Unix()
+	if !ok || (removing_at != 0 && removing_at > now - int64(blobRemovalTimeout.Seconds())) {
+		return false, nil
+	}
+	for _, b := range s.blobs {
+		if b == blob_id {
+			return false, nil
+		}
+	}
+	s.blobRows[blob_id] = now
+	return true, nil
+}
+
+func (s *memoryStore) DeleteBlob(blob_id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blobRows[blob_id] != 0 {
+		delete(s.blobRows, blob_id)
+	}
+	return nil
+}
+
+func (s *memoryStore) UnreferencedBlobs() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	referenced := map[string]bool{}
+	for _, blob_id := range s.blobs {
+		referenced[blob_id] = true
+	}
+	result := []string{}
+	for blob_id := range s.blobRows {
+		if !referenced[blob_id] {
+			result = append(result, blob_id)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (s *memoryStore) ImagesCount(token string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := 0
+	for _, owner := range s.images {
+		if owner == token {
+			result++
+		}
+	}
+	return result, nil
+}
+
+// referencedImages must be called with s.mu held.
+func (s *memoryStore) referencedImages() map[string]bool {
+	result := map[string]bool{}
+	for _, item := range s.items {
+		for _, image_id := range item.Image_ids {
+			result[image_id] = true
+		}
+	}
+	return result
+}
+
+func (s *memoryStore) ImagesByToken(token string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []string{}
+	for image_id, owner := range s.images {
+		if owner == token {
+			result = append(result, image_id)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (s *memoryStore) OrphanedImages(before int64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	referenced := s.referencedImages()
+	result := []string{}
+	for image_id := range s.images {
+		if !referenced[image_id] && s.imageTimes[image_id] < before {
+			result = append(result, image_id)
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) DeleteOrphanedImage(image_id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[image_id]; !ok || s.referencedImages()[image_id] {
+		return false, nil
+	}
+	delete(s.images, image_id)
+	delete(s.imageTimes, image_id)
+	delete(s.blobs, image_id)
+	return true, nil
+}
+
+func (s *memoryStore) ItemExists(key itemKey, type_ string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range s.items {
+		if item.itemKey == key && item.Type == type_ {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) AddItem(item itemRow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addItem(item)
+	return nil
+}
+
+// addItem must be called with s.mu held.
+func (s *memoryStore) addItem(item itemRow) {
+	item.Params = copyParams(item.Params)
+	item.Image_ids = append([]string(nil), item.Image_ids...)
+	s.nextId++
+	item.Id = s.nextId
+	s.items = append(s.items, item)
+}
+
+func (s *memoryStore) SaveItem(item itemRow, mode string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := -1
+	for i := range s.items {
+		if s.items[i].itemKey == item.itemKey && s.items[i].Type == item.Type {
+			found = i
+			break
+		}
+	}
+
+	if err := checkSaveMode(mode, found != -1, found != -1 && s.items[found].Token == item.Token); err != nil {
+		return false, err
+	}
+	if found == -1 {
+		s.addItem(item)
+		return true, nil
+	}
+	s.items[found].Category = item.Category
+	s.items[found].Params = copyParams(item.Params)
+	s.items[found].Image_ids = append([]string(nil), item.Image_ids...)
+	return false, nil
+}
+
+func (s *memoryStore) DeleteItems(token string, scope string, key itemKey, type_ string, deleteImages bool) (int, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	candidates := map[string]bool{}
+	items := s.items[:0]
+	deleted := 0
+	for _, item := range s.items {
+		if item.Token == token && matchesDelete(item, scope, key, type_) {
+			deleted++
+			for _, image_id := range item.Image_ids {
+				candidates[image_id] = true
+			}
+			continue
+		}
+		items = append(items, item)
+	}
+	s.items = items
+
+	deleted_images := []string{}
+	if !deleteImages {
+		return deleted, deleted_images, nil
+	}
+	for _, item := range s.items {
+		for _, image_id := range item.Image_ids {
+			delete(candidates, image_id)
+		}
+	}
+	for image_id := range candidates {
+		if s.images[image_id] == token {
+			delete(s.images, image_id)
+			delete(s.imageTimes, image_id)
+			delete(s.blobs, image_id)
+			deleted_images = append(deleted_images, image_id)
+		}
+	}
+	return deleted, deleted_images, nil
+}
+
+func (s *memoryStore) ItemTypes(shop_id string, key itemKey) ([]itemRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []itemRow{}
+	for _, item := range s.items {
+		if item.Shop_id == shop_id && item.itemKey == key && s.tokens[item.Token].Deleted_at == 0 {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) ItemTypesBatch(shop_id string, keys []itemKey) ([][]itemRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([][]itemRow, len(keys))
+	for i, key := range keys {
+		result[i] = []itemRow{}
+		for _, item := range s.items {
+			if item.Shop_id == shop_id && item.itemKey == key && s.tokens[item.Token].Deleted_at == 0 {
+				result[i] = append(result[i], item)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) ItemColorTypes(shop_id, item_id, color string) ([]itemRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []itemRow{}
+	for _, item := range s.items {
+		if item.Shop_id == shop_id && item.Item_id == item_id && item.Color == color && s.tokens[item.Token].Deleted_at == 0 {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) IncrementRequests(shop_id string, key itemKey, type_ string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, item := range s.items {
+		if item.Shop_id == shop_id && item.itemKey == key && item.Type == type_ {
+			s.items[i].Requests_count++
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) IncrementMisses(shop_id string, key itemKey, type_ string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, item := range s.items {
+		if item.Shop_id == shop_id && item.itemKey == key && item.Type == type_ {
+			s.items[i].Misses_count++
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) AddRequests(counts map[typeKey]requestCounts) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, item := range s.items {
+		c := counts[typeKey{item.Shop_id, item.itemKey, item.Type}]
+		s.items[i].Requests_count += c.Requests
+		s.items[i].Misses_count += c.Misses
+	}
+	return nil
+}
+
+func (s *memoryStore) ItemsByToken(token string) ([]itemRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []itemRow{}
+	for _, item := range s.items {
+		if item.Token == token {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) ItemsCount(token string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := map[itemKey]bool{}
+	for _, item := range s.items {
+		if item.Token == token {
+			keys[item.itemKey] = true
+		}
+	}
+	return len(keys), nil
+}
+
+func copyParams(params map[string]float64) map[string]float64 {
+	result := make(map[string]float64, len(params))
+	for name, value := range params {
+		result[name] = value
+	}
+	return result
+}
+
+func (s *memoryStore) GetSchema(shop_id, category string) (paramSchema, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	schema, ok := s.schemas[[2]string{shop_id, category}]
+	return schema, ok, nil
+}
+
+func (s *memoryStore) SaveSchema(schema paramSchema) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	schema.Params = append([]paramDef(nil), schema.Params...)
+	s.schemas[[2]string{schema.Shop_id, schema.Category}] = schema
+	return nil
+}
+
+func (s *memoryStore) DeleteSchema(shop_id, category string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := [2]string{shop_id, category}
+	_, ok := s.schemas[key]
+	delete(s.schemas, key)
+	return ok, nil
+}
+
+func (s *memoryStore) ListSchemas() ([]paramSchema, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []paramSchema{}
+	for _, schema := range s.schemas {
+		result = append(result, schema)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Shop_id != result[j].Shop_id {
+			return result[i].Shop_id < result[j].Shop_id
+		}
+		return result[i].Category < result[j].Category
+	})
+	return result, nil
+}
+
+func (s *memoryStore) AddUUID(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uuids[id] = true
+	return nil
+}
+
+func (s *memoryStore) CheckUUID(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uuids[id], nil
+}
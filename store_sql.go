@@ -0,0 +1,989 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"sync"
+	"database/sql"
+)
+
+// sqlStore implements Store on top of database/sql. Queries are written
+// with "?" placeholders and rebound for the dialect in use.
+type sqlStore struct {
+	db *sql.DB
+	dialect *dialect
+
+	stmtsMu sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func openSQLiteStore(path string) (*sqlStore, error) {
+	return openSQLStore(sqliteDialect, path)
+}
+
+func openPostgresStore(dsn string) (*sqlStore, error) {
+	return openSQLStore(postgresDialect, dsn)
+}
+
+func openSQLStore(d *dialect, dsn string) (*sqlStore, error) {
+	db, err := d.open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err = prepareSchema(db, d); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db, dialect: d, stmts: map[string]*sql.Stmt{}}, nil
+}
+
+// openStore opens the backend selected by databaseDSN.
+func openStore() (Store, error) {
+	return openSQLStore(dialectForDSN(databaseDSN), databaseDSN)
+}
+
+// openStoreReadOnly opens the backend selected by databaseDSN without
+// migrating or otherwise writing to it, for commands such as backup that
+// must see the database as the server left it.
+func openStoreReadOnly() (*sqlStore, error) {
+	d := dialectForDSN(databaseDSN)
+	db, err := d.openReadOnly(databaseDSN)
+	if err != nil {
+		return nil, err
+	}
+	current, err := readSchemaVersion(db, d)
+	if err == nil && current > d.latestVersion() {
+		err = fmt.Errorf("Database schema version %d is newer than this binary supports (%d)\n",
+			current, d.latestVersion())
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db, dialect: d, stmts: map[string]*sql.Stmt{}}, nil
+}
+
+// prepareSchema brings the schema up to date, or fails if it can't be
+// used by this binary.
+func prepareSchema(db *sql.DB, d *dialect) error {
+	current, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > d.latestVersion() {
+		return fmt.Errorf("Database schema version %d is newer than this binary supports (%d)\n",
+			current, d.latestVersion())
+	}
+	if current < d.latestVersion() && !autoMigrate {
+		return fmt.Errorf("Database schema version %d is outdated, run \"migrate up\"\n", current)
+	}
+	return migrateUp(db, d, d.latestVersion())
+}
+
+func (s *sqlStore) Close() error {
+	s.stmtsMu.Lock()
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+	s.stmts = map[string]*sql.Stmt{}
+	s.stmtsMu.Unlock()
+	return s.db.Close()
+}
+
+// prepare returns a prepared statement for query, reusing the one
+// prepared by an earlier call. The statements live until Close.
+func (s *sqlStore) prepare(query string) (*sql.Stmt, error) {
+	s.stmtsMu.Lock()
+	defer s.stmtsMu.Unlock()
+	if stmt, ok := s.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := s.db.Prepare(s.dialect.rebind(query))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating stmt: %v\n", err)
+	}
+	s.stmts[query] = stmt
+	return stmt, nil
+}
+
+// prepareIn is prepare for use inside tx, or outside of any
+// transaction if tx is nil.
+func (s *sqlStore) prepareIn(tx *sql.Tx, query string) (*sql.Stmt, error) {
+	stmt, err := s.prepare(query)
+	if err != nil || tx == nil {
+		return stmt, err
+	}
+	return tx.Stmt(stmt), nil
+}
+
+// exists reports whether query returns at least one row.
+func (s *sqlStore) exists(query string, args ...interface{}) (bool, error) {
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return false, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return false, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
+}
+
+// count runs a "select count(...)" query.
+func (s *sqlStore) count(query string, args ...interface{}) (int, error) {
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	result := 0
+	if err = stmt.QueryRow(args...).Scan(&result); err != nil {
+		return 0, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	return result, nil
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) error {
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return err
+	}
+	if _, err = stmt.Exec(args...); err != nil {
+		return fmt.Errorf("Error request execution: %v\n", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) IsValidToken(token string) (bool, error) {
+	stmt, err := s.prepare("select exp_time from tokens where token = ? AND deleted_at = 0")
+	if err != nil {
+		return false, err
+	}
+	var exp_time int64
+	err = stmt.QueryRow(token).Scan(&exp_time)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	return exp_time > time.Now().Unix(), nil
+}
+
+func (s *sqlStore) TokenExists(token string) (bool, error) {
+	return s.exists("select * from tokens where token = ?", token)
+}
+
+func (s *sqlStore) ShopIDExists(shop_id string) (bool, error) {
+	return s.exists("select * from tokens where shop_id = ?", shop_id)
+}
+
+func (s *sqlStore) GetShopID(token string) (string, error) {
+	var shop_id string
+	err := s.db.QueryRow(s.dialect.rebind("select shop_id from tokens where token = ?"), token).Scan(&shop_id)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("Token %v not exists\n", token)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error query execution: %v\n", err)
+	}
+	return shop_id, nil
+}
+
+func (s *sqlStore) CreateToken(t tokenRow) error {
+	return s.exec("insert into tokens (token, exp_time, description, shop_id, deleted_at) values (?, ?, ?, ?, ?)",
+		t.Token, t.Exp_time, t.Description, t.Shop_id, t.Deleted_at)
+}
+
+func (s *sqlStore) EditToken(t tokenRow) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Error creating database transaction: %v\n", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(s.dialect.rebind("update schema_params set shop_id = ? where shop_id = (select shop_id from tokens where token = ?)"),
+		t.Shop_id, t.Token); err != nil {
+		return fmt.Errorf("Error request execution: %v\n", err)
+	}
+	if _, err = tx.Exec(s.dialect.rebind("update tokens set exp_time = ?, description = ?, shop_id = ? where token = ?"),
+		t.Exp_time, t.Description, t.Shop_id, t.Token); err != nil {
+		return fmt.Errorf("Error request execution: %v\n", err)
+	}
+	if _, err = tx.Exec(s.dialect.rebind("update items set shop_id = ? where token = ?"), t.Shop_id, t.Token); err != nil {
+		return fmt.Errorf("Error request execution: %v\n", err)
+	}
+	return tx.Commit()
+}
+
+// DeleteToken relies on foreign keys to remove the token's images and
+// items.
+func (s *sqlStore) DeleteToken(token string) error {
+	_, err := s.deleteToken("token = ?", token)
+	return err
+}
+
+// deleteToken deletes the tokens matching the where clause with the
+// schemas of their shops and reports whether there were any.
+func (s *sqlStore) deleteToken(where string, args ...interface{}) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("Error creating database transaction: %v\n", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(s.dialect.rebind("delete from schema_params where shop_id in (select shop_id from tokens where " + where + ")"),
+		args...); err != nil {
+		return false, fmt.Errorf("Error request execution: %v\n", err)
+	}
+	result, err := tx.Exec(s.dialect.rebind("delete from tokens where " + where), args...)
+	if err != nil {
+		return false, fmt.Errorf("Error request execution: %v\n", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, tx.Commit()
+}
+
+func (s *sqlStore) ListTokens() ([]tokenRow, error) {
+	rows, err := s.db.Query("select token, exp_time, description, shop_id, deleted_at from tokens")
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+
+	result := []tokenRow{}
+	for rows.Next() {
+		var t tokenRow
+		if err = rows.Scan(&t.Token, &t.Exp_time, &t.Description, &t.Shop_id, &t.Deleted_at); err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+// updated runs an update or delete statement and reports whether it
+// changed any row.
+func (s *sqlStore) updated(query string, args ...interface{}) (bool, error) {
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return false, err
+	}
+	result, err := stmt.Exec(args...)
+	if err != nil {
+		return false, fmt.Errorf("Error request execution: %v\n", err)
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *sqlStore) TrashToken(token string) (bool, error) {
+	return s.updated("update tokens set deleted_at = ? where token = ? AND deleted_at = 0", time.Now().Unix(), token)
+}
+
+func (s *sqlStore) RestoreToken(token string) (bool, error) {
+	return s.updated("update tokens set deleted_at = 0 where token = ? AND deleted_at != 0", token)
+}
+
+func (s *sqlStore) TrashedTokens(before int64) ([]string, error) {
+	rows, err := s.db.Query(s.dialect.rebind("select token from tokens where deleted_at != 0 AND deleted_at < ? order by token"), before)
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+
+	result := []string{}
+	for rows.Next() {
+		var token string
+		if err = rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		result = append(result, token)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStore) DeleteTrashedToken(token string, before int64) (bool, error) {
+	return s.deleteToken("token = ? AND deleted_at != 0 AND deleted_at < ?", token, before)
+}
+
+func (s *sqlStore) ImportToken(c tokenCopy) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Error creating database transaction: %v\n", err)
+	}
+	defer tx.Rollback()
+
+	exists := func(query string, arg interface{}) (bool, error) {
+		var n int
+		if err := tx.QueryRow(s.dialect.rebind(query), arg).Scan(&n); err != nil {
+			return false, fmt.Errorf("Error query execution: %v\n", err)
+		}
+		return n > 0, nil
+	}
+	if found, err := exists("select count(*) from tokens where token = ?", c.Token.Token); err != nil || found {
+		return fmt.Errorf("Token %v already exists (%v)\n", c.Token.Token, err)
+	}
+	if found, err := exists("select count(*) from tokens where shop_id = ?", c.Token.Shop_id); err != nil || found {
+		return fmt.Errorf("Shop id %v already exists (%v)\n", c.Token.Shop_id, err)
+	}
+	for _, image_id := range c.Image_ids {
+		if found, err := exists("select count(*) from images where image_id = ?", image_id); err != nil || found {
+			return fmt.Errorf("Image %v already exists (%v)\n", image_id, err)
+		}
+	}
+
+	t := c.Token
+	if _, err = tx.Exec(s.dialect.rebind("insert into tokens (token, exp_time, description, shop_id, deleted_at) values (?, ?, ?, ?, ?)"),
+		t.Token, t.Exp_time, t.Description, t.Shop_id, t.Deleted_at); err != nil {
+		return fmt.Errorf("Error request execution: %v\n", err)
+	}
+	for _, blob_id := range c.Blobs {
+		if _, err = s.claimBlob(tx, blob_id); err != nil {
+			return err
+		}
+	}
+	now := time.Now().Unix()
+	for _, image_id := range c.Image_ids {
+		if _, err = tx.Exec(s.dialect.rebind("insert into images (token, image_id, blob_id, created_at) values (?, ?, ?, ?)"),
+			t.Token, image_id, c.Blobs[image_id], now); err != nil {
+			return fmt.Errorf("Error request execution: %v\n", err)
+		}
+	}
+	for _, item := range c.Items {
+		if _, err = s.insertItem(tx, item); err != nil {
+			return err
+		}
+	}
+	for _, schema := range c.Schemas {
+		if err = s.saveSchema(tx, schema); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) AddImage(token, image_id, blob_id string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("Error creating database transaction: %v\n", err)
+	}
+	defer tx.Rollback()
+
+	created, err := s.claimBlob(tx, blob_id)
+	if err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(s.dialect.rebind("insert into images (token, image_id, blob_id, created_at) values (?, ?, ?, ?)"),
+		token, image_id, blob_id, time.Now().Unix()); err != nil {
+		return false, fmt.Errorf("Error request execution: %v\n", err)
+	}
+	return created, tx.Commit()
+}
+
+// claimBlob creates the row of a blob, or locks the existing one unless
+// its files are being removed, and reports whether it created it.
+func (s *sqlStore) claimBlob(tx *sql.Tx, blob_id string) (bool, error) {
+	res, err := tx.Exec(s.dialect.rebind("insert into blobs (blob_id) values (?) on conflict (blob_id) do nothing"), blob_id)
+	if err != nil {
+		return false, fmt.Errorf("Error request execution: %v\n", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return n == 1, err
+	}
+	var removing_at int64
+	err = tx.QueryRow(s.dialect.rebind(s.dialect.forUpdate("select removing_at from blobs where blob_id = ?")), blob_id).Scan(&removing_at)
+	if err != nil {
+		return false, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	if removing_at != 0 {
+		return false, errBlobRemoving
+	}
+	return false, nil
+}
+
+func (s *sqlStore) ImageExists(image_id string) (bool, error) {
+	return s.exists("select image_id from images where image_id = ?", image_id)
+}
+
+func (s *sqlStore) IsValidImageID(image_id string) (bool, error) {
+	stmt, err := s.prepare(`select tokens.exp_time from images join tokens on images.token = tokens.token
+		where images.image_id = ? AND tokens.deleted_at = 0`)
+	if err != nil {
+		return false, err
+	}
+	var exp_time int64
+	err = stmt.QueryRow(image_id).Scan(&exp_time)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	return exp_time > time.Now().Unix(), nil
+}
+
+func (s *sqlStore) ImageBlob(image_id string) (string, error) {
+	stmt, err := s.prepare("select blob_id from images where image_id = ?")
+	if err != nil {
+		return "", err
+	}
+	var blob_id string
+	err = stmt.QueryRow(image_id).Scan(&blob_id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error query execution: %v\n", err)
+	}
+	return blob_id, nil
+}
+
+func (s *sqlStore) ImageBlobs(token string) (map[string]string, error) {
+	rows, err := s.db.Query(s.dialect.rebind("select image_id, blob_id from images where token = ?"), token)
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+	result := map[string]string{}
+	for rows.Next() {
+		var image_id, blob_id string
+		if err = rows.Scan(&image_id, &blob_id); err != nil {
+			return nil, err
+		}
+		result[image_id] = blob_id
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStore) BlobReferences(blob_id string) (int, error) {
+	return s.count("select count(image_id) from images where blob_id = ?", blob_id)
+}
+
+// ReleaseBlob locks the row of the blob before counting its images, so
+// that AddImage either adds its image first or finds the blob marked.
+func (s *sqlStore) ReleaseBlob(blob_id string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("Error creating database transaction: %v\n", err)
+	}
+	defer tx.Rollback()
+
+	var removing_at int64
+	err = tx.QueryRow(s.dialect.rebind(s.dialect.forUpdate("select removing_at from blobs where blob_id = ?")), blob_id).Scan(&removing_at)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	now := time.Now().Unix()
+	if removing_at != 0 && removing_at > now - int64(blobRemovalTimeout.Seconds()) {
+		return false, nil
+	}
+	var references int
+	if err = tx.QueryRow(s.dialect.rebind("select count(image_id) from images where blob_id = ?"), blob_id).Scan(&references); err != nil {
+		return false, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	if references > 0 {
+		return false, nil
+	}
+	if _, err = tx.Exec(s.dialect.rebind("update blobs set removing_at = ? where blob_id = ?"), now, blob_id); err != nil {
+		return false, fmt.Errorf("Error request execution: %v\n", err)
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqlStore) DeleteBlob(blob_id string) error {
+	return s.exec("delete from blobs where blob_id = ? AND removing_at != 0", blob_id)
+}
+
+func (s *sqlStore) UnreferencedBlobs() ([]string, error) {
+	rows, err := s.db.Query(`select blob_id from blobs
+		where not exists (select image_id from images where images.blob_id = blobs.blob_id) order by blob_id`)
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+	result := []string{}
+	for rows.Next() {
+		var blob_id string
+		if err = rows.Scan(&blob_id); err != nil {
+			return nil, err
+		}
+		result = append(result, blob_id)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStore) ImagesCount(token string) (int, error) {
+	return s.count("select count(token) from images where token = ?", token)
+}
+
+func (s *sqlStore) ImagesByToken(token string) ([]string, error) {
+	rows, err := s.db.Query(s.dialect.rebind("select image_id from images where token = ? order by id"), token)
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+	result := []string{}
+	for rows.Next() {
+		var image_id string
+		if err = rows.Scan(&image_id); err != nil {
+			return nil, err
+		}
+		result = append(result, image_id)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStore) OrphanedImages(before int64) ([]string, error) {
+	rows, err := s.db.Query(s.dialect.rebind(`select image_id from images where created_at < ?
+		AND not exists (select 1 from item_images where item_images.image_id = images.image_id)`), before)
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+	result := []string{}
+	for rows.Next() {
+		var image_id string
+		if err = rows.Scan(&image_id); err != nil {
+			return nil, err
+		}
+		result = append(result, image_id)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStore) DeleteOrphanedImage(image_id string) (bool, error) {
+	return s.updated(`delete from images where image_id = ?
+		AND not exists (select 1 from item_images where item_images.image_id = images.image_id)`, image_id)
+}
+
+func (s *sqlStore) ItemExists(key itemKey, type_ string) (bool, error) {
+	return s.exists("select * from items where item_id = ? AND color = ? AND size = ? AND description = ? AND type = ?",
+		key.Item_id, key.Color, key.Size, key.Description, type_)
+}
+
+func (s *sqlStore) AddItem(item itemRow) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Error creating database transaction: %v\n", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = s.insertItem(tx, item); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) insertItem(tx *sql.Tx, item itemRow) (int64, error) {
+	var id int64
+	err := tx.QueryRow(s.dialect.rebind(`insert into items (token, shop_id, item_id, color, size, description, category, type, requests_count, misses_count)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) returning id`),
+		item.Token, item.Shop_id, item.Item_id, item.Color, item.Size, item.Description, item.Category,
+		item.Type, item.Requests_count, item.Misses_count).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("Error request execution: %v\n", err)
+	}
+	if err = s.insertItemParams(tx, id, item.Params); err != nil {
+		return 0, err
+	}
+	return id, s.insertItemImages(tx, id, item.Image_ids)
+}
+
+func (s *sqlStore) SaveItem(item itemRow, mode string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("Error creating database transaction: %v\n", err)
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var token string
+	err = tx.QueryRow(s.dialect.rebind("select id, token from items where item_id = ? AND color = ? AND size = ? AND description = ? AND type = ?"),
+		item.Item_id, item.Color, item.Size, item.Description, item.Type).Scan(&id, &token)
+	found := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("Error query execution: %v\n", err)
+	}
+
+	if err = checkSaveMode(mode, found, token == item.Token); err != nil {
+		return false, err
+	}
+
+	if !found {
+		if _, err = s.insertItem(tx, item); err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+
+	if _, err = tx.Exec(s.dialect.rebind("update items set category = ? where id = ?"), item.Category, id); err != nil {
+		return false, fmt.Errorf("Error request execution: %v\n", err)
+	}
+	if _, err = tx.Exec(s.dialect.rebind("delete from item_params where item_row = ?"), id); err != nil {
+		return false, fmt.Errorf("Error request execution: %v\n", err)
+	}
+	if err = s.insertItemParams(tx, id, item.Params); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(s.dialect.rebind("delete from item_images where item_row = ?"), id); err != nil {
+		return false, fmt.Errorf("Error request execution: %v\n", err)
+	}
+	if err = s.insertItemImages(tx, id, item.Image_ids); err != nil {
+		return false, err
+	}
+	return false, tx.Commit()
+}
+
+func (s *sqlStore) DeleteItems(token string, scope string, key itemKey, type_ string, deleteImages bool) (int, []string, error) {
+	where := "token = ? AND item_id = ?"
+	args := []interface{}{token, key.Item_id}
+	switch scope {
+	case deleteScopeType:
+		where += " AND color = ? AND size = ? AND description = ? AND type = ?"
+		args = append(args, key.Color, key.Size, key.Description, type_)
+	case deleteScopeKey:
+		where += " AND color = ? AND size = ? AND description = ?"
+		args = append(args, key.Color, key.Size, key.Description)
+	case deleteScopeItem:
+	default:
+		return 0, nil, fmt.Errorf("Unknown delete scope %v\n", scope)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, nil, fmt.Errorf("Error creating database transaction: %v\n", err)
+	}
+	defer tx.Rollback()
+
+	candidates := []string{}
+	if deleteImages {
+		rows, err := tx.Query(s.dialect.rebind("select distinct image_id from item_images where item_row in (select id from items where " + where + ")"), args...)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Error query execution: %v\n", err)
+		}
+		for rows.Next() {
+			var image_id string
+			if err = rows.Scan(&image_id); err != nil {
+				rows.Close()
+				return 0, nil, err
+			}
+			candidates = append(candidates, image_id)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	result, err := tx.Exec(s.dialect.rebind("delete from items where " + where), args...)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Error request execution: %v\n", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	deleted_images := []string{}
+	for _, image_id := range candidates {
+		result, err = tx.Exec(s.dialect.rebind(`delete from images where image_id = ? AND token = ?
+			AND not exists (select 1 from item_images where item_images.image_id = images.image_id)`), image_id, token)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Error request execution: %v\n", err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			deleted_images = append(deleted_images, image_id)
+		}
+	}
+	return int(deleted), deleted_images, tx.Commit()
+}
+
+func (s *sqlStore) insertItemImages(tx *sql.Tx, id int64, image_ids []string) error {
+	stmt, err := tx.Prepare(s.dialect.rebind("insert into item_images (item_row, position, image_id) values (?, ?, ?)"))
+	if err != nil {
+		return fmt.Errorf("Error creating stmt: %v\n", err)
+	}
+	defer stmt.Close()
+	for position, image_id := range image_ids {
+		if _, err = stmt.Exec(id, position, image_id); err != nil {
+			return fmt.Errorf("Error request execution: %v\n", err)
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) insertItemParams(tx *sql.Tx, id int64, params map[string]float64) error {
+	stmt, err := tx.Prepare(s.dialect.rebind("insert into item_params (item_row, name, value) values (?, ?, ?)"))
+	if err != nil {
+		return fmt.Errorf("Error creating stmt: %v\n", err)
+	}
+	defer stmt.Close()
+	for name, value := range params {
+		if _, err = stmt.Exec(id, name, value); err != nil {
+			return fmt.Errorf("Error request execution: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// scanItems reads rows selected with itemColumns.
+func scanItems(rows *sql.Rows) ([]itemRow, error) {
+	result := []itemRow{}
+	for rows.Next() {
+		var item itemRow
+		err := rows.Scan(&item.Id, &item.Token, &item.Shop_id, &item.Item_id, &item.Color, &item.Size,
+			&item.Description, &item.Category, &item.Type, &item.Requests_count, &item.Misses_count)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+const itemColumns = "id, token, shop_id, item_id, color, size, description, category, type, requests_count, misses_count"
+
+// queryItems selects the items matching the where clause and fills in
+// their params and image lists from item_params and item_images.
+func (s *sqlStore) queryItems(where string, args ...interface{}) ([]itemRow, error) {
+	return s.queryItemsIn(nil, where, args...)
+}
+
+// queryItemsIn is queryItems inside tx, or outside of any transaction if
+// tx is nil.
+func (s *sqlStore) queryItemsIn(tx *sql.Tx, where string, args ...interface{}) ([]itemRow, error) {
+	stmt, err := s.prepareIn(tx, "select " + itemColumns + " from items where " + where)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	items, err := scanItems(rows)
+	rows.Close()
+	if err != nil || len(items) == 0 {
+		return items, err
+	}
+
+	byId := map[int64]*itemRow{}
+	for i := range items {
+		byId[items[i].Id] = &items[i]
+		items[i].Params = map[string]float64{}
+		items[i].Image_ids = []string{}
+	}
+
+	stmt, err = s.prepareIn(tx, `select item_params.item_row, item_params.name, item_params.value from item_params
+		join items on items.id = item_params.item_row where ` + where)
+	if err != nil {
+		return nil, err
+	}
+	rows, err = stmt.Query(args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	for rows.Next() {
+		var id int64
+		var name string
+		var value float64
+		if err = rows.Scan(&id, &name, &value); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if item, ok := byId[id]; ok {
+			item.Params[name] = value
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stmt, err = s.prepareIn(tx, `select item_images.item_row, item_images.image_id from item_images
+		join items on items.id = item_images.item_row where ` + where +
+		" order by item_images.item_row, item_images.position")
+	if err != nil {
+		return nil, err
+	}
+	rows, err = stmt.Query(args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var image_id string
+		if err = rows.Scan(&id, &image_id); err != nil {
+			return nil, err
+		}
+		if item, ok := byId[id]; ok {
+			item.Image_ids = append(item.Image_ids, image_id)
+		}
+	}
+	return items, rows.Err()
+}
+
+const itemTypesWhere = `items.shop_id = ? AND items.item_id = ? AND items.color = ? AND items.size = ? AND items.description = ?
+	AND exists (select 1 from tokens where tokens.token = items.token AND tokens.deleted_at = 0)`
+
+func (s *sqlStore) ItemTypes(shop_id string, key itemKey) ([]itemRow, error) {
+	return s.queryItems(itemTypesWhere, shop_id, key.Item_id, key.Color, key.Size, key.Description)
+}
+
+// ItemTypesBatch reads all keys in one transaction, so that they're
+// consistent with each other.
+func (s *sqlStore) ItemTypesBatch(shop_id string, keys []itemKey) ([][]itemRow, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating database transaction: %v\n", err)
+	}
+	defer tx.Rollback()
+
+	result := make([][]itemRow, len(keys))
+	for i, key := range keys {
+		result[i], err = s.queryItemsIn(tx, itemTypesWhere, shop_id, key.Item_id, key.Color, key.Size, key.Description)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (s *sqlStore) ItemColorTypes(shop_id, item_id, color string) ([]itemRow, error) {
+	return s.queryItems(`items.shop_id = ? AND items.item_id = ? AND items.color = ?
+		AND exists (select 1 from tokens where tokens.token = items.token AND tokens.deleted_at = 0)`,
+		shop_id, item_id, color)
+}
+
+func (s *sqlStore) IncrementRequests(shop_id string, key itemKey, type_ string) error {
+	return s.exec(`update items set requests_count = requests_count + 1
+		where shop_id = ? AND item_id = ? AND color = ? AND size = ? AND description = ? AND type = ?`,
+		shop_id, key.Item_id, key.Color, key.Size, key.Description, type_)
+}
+
+func (s *sqlStore) IncrementMisses(shop_id string, key itemKey, type_ string) error {
+	return s.exec(`update items set misses_count = misses_count + 1
+		where shop_id = ? AND item_id = ? AND color = ? AND size = ? AND description = ? AND type = ?`,
+		shop_id, key.Item_id, key.Color, key.Size, key.Description, type_)
+}
+
+func (s *sqlStore) AddRequests(counts map[typeKey]requestCounts) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Error creating database transaction: %v\n", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(s.dialect.rebind(`update items set requests_count = requests_count + ?, misses_count = misses_count + ?
+		where shop_id = ? AND item_id = ? AND color = ? AND size = ? AND description = ? AND type = ?`))
+	if err != nil {
+		return fmt.Errorf("Error creating stmt: %v\n", err)
+	}
+	defer stmt.Close()
+	for k, c := range counts {
+		if _, err = stmt.Exec(c.Requests, c.Misses, k.Shop_id, k.Item_id, k.Color, k.Size, k.Description, k.Type); err != nil {
+			return fmt.Errorf("Error request execution: %v\n", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) ItemsByToken(token string) ([]itemRow, error) {
+	return s.queryItems("items.token = ?", token)
+}
+
+func (s *sqlStore) ItemsCount(token string) (int, error) {
+	return s.count("select count(*) from (select distinct item_id, color, size, description from items where token = ?) as item_keys", token)
+}
+
+func (s *sqlStore) GetSchema(shop_id, category string) (paramSchema, bool, error) {
+	schema := paramSchema{Shop_id: shop_id, Category: category}
+	stmt, err := s.prepare(`select name, unit, weight, min_value, max_value from schema_params
+		where shop_id = ? AND category = ? order by position`)
+	if err != nil {
+		return schema, false, err
+	}
+	rows, err := stmt.Query(shop_id, category)
+	if err != nil {
+		return schema, false, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p paramDef
+		if err = rows.Scan(&p.Name, &p.Unit, &p.Weight, &p.Min, &p.Max); err != nil {
+			return schema, false, err
+		}
+		schema.Params = append(schema.Params, p)
+	}
+	return schema, len(schema.Params) > 0, rows.Err()
+}
+
+func (s *sqlStore) SaveSchema(schema paramSchema) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Error creating database transaction: %v\n", err)
+	}
+	defer tx.Rollback()
+
+	if err = s.saveSchema(tx, schema); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) saveSchema(tx *sql.Tx, schema paramSchema) error {
+	if _, err := tx.Exec(s.dialect.rebind("delete from schema_params where shop_id = ? AND category = ?"),
+		schema.Shop_id, schema.Category); err != nil {
+		return fmt.Errorf("Error request execution: %v\n", err)
+	}
+	for position, p := range schema.Params {
+		if _, err := tx.Exec(s.dialect.rebind(`insert into schema_params (shop_id, category, position, name, unit, weight, min_value, max_value)
+			values (?, ?, ?, ?, ?, ?, ?, ?)`),
+			schema.Shop_id, schema.Category, position, p.Name, p.Unit, p.Weight, p.Min, p.Max); err != nil {
+			return fmt.Errorf("Error request execution: %v\n", err)
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteSchema(shop_id, category string) (bool, error) {
+	return s.updated("delete from schema_params where shop_id = ? AND category = ?", shop_id, category)
+}
+
+func (s *sqlStore) ListSchemas() ([]paramSchema, error) {
+	rows, err := s.db.Query(`select shop_id, category, name, unit, weight, min_value, max_value from schema_params
+		order by shop_id, category, position`)
+	if err != nil {
+		return nil, fmt.Errorf("Error query execution: %v\n", err)
+	}
+	defer rows.Close()
+
+	result := []paramSchema{}
+	for rows.Next() {
+		var shop_id, category string
+		var p paramDef
+		if err = rows.Scan(&shop_id, &category, &p.Name, &p.Unit, &p.Weight, &p.Min, &p.Max); err != nil {
+			return nil, err
+		}
+		if n := len(result); n == 0 || result[n-1].Shop_id != shop_id || result[n-1].Category != category {
+			result = append(result, paramSchema{Shop_id: shop_id, Category: category})
+		}
+		result[len(result)-1].Params = append(result[len(result)-1].Params, p)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStore) AddUUID(id string) error {
+	return s.exec("insert into admin_uuids (uuid) values (?)", id)
+}
+
+func (s *sqlStore) CheckUUID(id string) (bool, error) {
+	return s.exists("select * from admin_uuids where uuid = ?", id)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"time"
+	"testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func openTestSQLiteStore(t *testing.T) *sqlStore {
+	dir, err := ioutil.TempDir("", "decety-store")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s, err := openSQLiteStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// openTestStore opens a PostgreSQL store in a fresh schema if
+// DECETY_TEST_POSTGRES_DSN points to a reachable server, and falls back
+// to SQLite otherwise.
+func openTestStore(t *testing.T) *sqlStore {
+	dsn := os.Getenv("DECETY_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		return openTestSQLiteStore(t)
+	}
+	db, err := postgresDialect.open(dsn)
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Logf("PostgreSQL unavailable, using SQLite: %v", err)
+		return openTestSQLiteStore(t)
+	}
+
+	schema := "decety_test_" + strings.ToLower(getRandomID())
+	if _, err = db.Exec("create schema " + schema); err != nil {
+		t.Fatalf("Error creating schema: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec("drop schema " + schema + " cascade")
+		db.Close()
+	})
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	s, err := openPostgresStore(dsn + separator + "search_path=" + schema)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestDialect(t *testing.T) {
+	query := "select * from items where token = ? AND type = ?"
+	if got := postgresDialect.rebind(query); got != "select * from items where token = $1 AND type = $2" {
+		t.Fatalf("Wrong postgres rebind: %v", got)
+	}
+	if got := sqliteDialect.rebind(query); got != query {
+		t.Fatalf("Wrong sqlite rebind: %v", got)
+	}
+
+	for dsn, want := range map[string]*dialect{
+		"sqlite3.db": sqliteDialect,
+		"/var/lib/decety/sqlite3.db": sqliteDialect,
+		"postgres://decety@localhost/decety?sslmode=disable": postgresDialect,
+		"host=localhost dbname=decety": postgresDialect,
+	} {
+		if dialectForDSN(dsn) != want {
+			t.Fatalf("Wrong dialect for %v", dsn)
+		}
+	}
+}
+
+func testParams(value float64) map[string]float64 {
+	params := map[string]float64{}
+	for _, name := range paramNames {
+		params[name] = value
+	}
+	return params
+}
+
+func testStore(s Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		valid := tokenRow{"t_valid", time.Now().Add(time.Hour).Unix(), "", "1234", 0}
+		expired := tokenRow{"t_expired", time.Now().Add(-time.Hour).Unix(), "old", "9876", 0}
+		for _, token := range []tokenRow{valid, expired} {
+			if err := s.CreateToken(token); err != nil {
+				t.Fatalf("Error CreateToken: %v", err)
+			}
+		}
+
+		if ok, err := s.IsValidToken("t_valid"); err != nil || !ok {
+			t.Fatalf("Valid token reported invalid: %v", err)
+		}
+		if ok, err := s.IsValidToken("t_expired"); err != nil || ok {
+			t.Fatalf("Expired token reported valid: %v", err)
+		}
+		if ok, err := s.IsValidToken("t_missing"); err != nil || ok {
+			t.Fatalf("Missing token reported valid: %v", err)
+		}
+		if ok, _ := s.ShopIDExists("9876"); !ok {
+			t.Fatalf("ShopIDExists failed")
+		}
+		if shop_id, err := s.GetShopID("t_valid"); err != nil || shop_id != "1234" {
+			t.Fatalf("GetShopID returned %q, %v", shop_id, err)
+		}
+
+		for _, id := range []string{"img1", "img2"} {
+			if created, err := s.AddImage("t_valid", id, id); err != nil || !created {
+				t.Fatalf("Error AddImage: %v, %v", created, err)
+			}
+		}
+		s.AddImage("t_expired", "img3", "img3")
+
+		// a blob is released once no image refers to it, and takes no
+		// images until its removal is done
+		if created, _ := s.AddImage("t_valid", "img_b", "b"); !created {
+			t.Fatalf("New blob not reported created")
+		}
+		if created, _ := s.AddImage("t_valid", "img_b2", "b"); created {
+			t.Fatalf("Shared blob reported created")
+		}
+		s.DeleteOrphanedImage("img_b")
+		if released, err := s.ReleaseBlob("b"); released || err != nil {
+			t.Fatalf("Referenced blob released: %v", err)
+		}
+		s.DeleteOrphanedImage("img_b2")
+		if released, err := s.ReleaseBlob("b"); !released || err != nil {
+			t.Fatalf("Unreferenced blob not released: %v", err)
+		}
+		if released, _ := s.ReleaseBlob("b"); released {
+			t.Fatalf("Blob released twice")
+		}
+		if _, err := s.AddImage("t_valid", "img_b", "b"); err != errBlobRemoving {
+			t.Fatalf("Image added to a blob being removed: %v", err)
+		}
+		if blobs, _ := s.UnreferencedBlobs(); strings.Join(blobs, ",") != "b" {
+			t.Fatalf("Wrong unreferenced blobs %v", blobs)
+		}
+		s.DeleteBlob("b")
+		if blobs, _ := s.UnreferencedBlobs(); len(blobs) != 0 {
+			t.Fatalf("Blob not deleted: %v", blobs)
+		}
+		if ok, _ := s.IsValidImageID("img1"); !ok {
+			t.Fatalf("IsValidImageID failed for valid token")
+		}
+		if ok, _ := s.IsValidImageID("img3"); ok {
+			t.Fatalf("IsValidImageID succeeded for expired token")
+		}
+		if n, _ := s.ImagesCount("t_valid"); n != 2 {
+			t.Fatalf("ImagesCount returned %d", n)
+		}
+
+		key := itemKey{"shirt", "red", "M", ""}
+		for i, type_ := range []string{"1", "2"} {
+			err := s.AddItem(itemRow{Token: "t_valid", Shop_id: "1234", itemKey: key,
+				Type: type_, Params: testParams(float64(i)), Image_ids: []string{"img2", "img1"}})
+			if err != nil {
+				t.Fatalf("Error AddItem: %v", err)
+			}
+		}
+		if ok, _ := s.ItemExists(key, "2"); !ok {
+			t.Fatalf("ItemExists failed")
+		}
+		types, err := s.ItemTypes("1234", key)
+		if err != nil || len(types) != 2 {
+			t.Fatalf("ItemTypes returned %d rows, %v", len(types), err)
+		}
+		if types[1].Params[paramNames[0]] != 1 || strings.Join(types[1].Image_ids, ",") != "img2,img1" {
+			t.Fatalf("ItemTypes returned wrong row: %+v", types[1])
+		}
+		updated := itemRow{Token: "t_valid", Shop_id: "1234", itemKey: key,
+			Type: "2", Params: testParams(7), Image_ids: []string{"img1"}}
+		if created, err := s.SaveItem(updated, saveModeCreate); err != errItemExists || created {
+			t.Fatalf("SaveItem created a duplicate: %v", err)
+		}
+		if created, err := s.SaveItem(updated, saveModeReplace); err != nil || created {
+			t.Fatalf("SaveItem replace failed: %v", err)
+		}
+		types, _ = s.ItemTypes("1234", key)
+		if types[1].Params[paramNames[0]] != 7 || strings.Join(types[1].Image_ids, ",") != "img1" {
+			t.Fatalf("SaveItem didn't update the row: %+v", types[1])
+		}
+		updated.Type = "3"
+		if _, err := s.SaveItem(updated, saveModeReplace); err != errItemNotFound {
+			t.Fatalf("SaveItem replaced a missing type: %v", err)
+		}
+		if created, err := s.SaveItem(updated, saveModeUpsert); err != nil || !created {
+			t.Fatalf("SaveItem upsert failed: %v", err)
+		}
+
+		if err = s.IncrementRequests("1234", key, "2"); err != nil {
+			t.Fatalf("Error IncrementRequests: %v", err)
+		}
+		if n, _ := s.ItemsCount("t_valid"); n != 1 {
+			t.Fatalf("ItemsCount returned %d", n)
+		}
+		s.AddItem(itemRow{Token: "t_valid", Shop_id: "1234", itemKey: itemKey{"shirt", "red", "L", ""}, Type: "1"})
+		s.AddItem(itemRow{Token: "t_valid", Shop_id: "1234", itemKey: itemKey{"shirt", "blue", "L", ""}, Type: "1"})
+		if types, err = s.ItemColorTypes("1234", "shirt", "red"); err != nil || len(types) != 4 {
+			t.Fatalf("ItemColorTypes returned %d rows, %v", len(types), err)
+		}
+
+		valid.Shop_id = "4321"
+		if err = s.EditToken(valid); err != nil {
+			t.Fatalf("Error EditToken: %v", err)
+		}
+		items, _ := s.ItemsByToken("t_valid")
+		requests_count := 0
+		for _, item := range items {
+			if item.Shop_id != "4321" {
+				t.Fatalf("EditToken didn't update item shop_id")
+			}
+			requests_count += item.Requests_count
+		}
+		if requests_count != 1 {
+			t.Fatalf("Wrong requests_count %d", requests_count)
+		}
+
+		if err = s.DeleteToken("t_valid"); err != nil {
+			t.Fatalf("Error DeleteToken: %v", err)
+		}
+		if ok, _ := s.ImageExists("img1"); ok {
+			t.Fatalf("Image exists after DeleteToken")
+		}
+		if n, _ := s.ItemsCount("t_valid"); n != 0 {
+			t.Fatalf("Items exist after DeleteToken")
+		}
+		if tokens, _ := s.ListTokens(); len(tokens) != 1 {
+			t.Fatalf("ListTokens returned %d tokens", len(tokens))
+		}
+
+		s.AddUUID("session")
+		if ok, _ := s.CheckUUID("session"); !ok {
+			t.Fatalf("CheckUUID failed")
+		}
+		if ok, _ := s.CheckUUID("other"); ok {
+			t.Fatalf("CheckUUID succeeded for unknown uuid")
+		}
+	}
+}
+
+func TestStores(t *testing.T) {
+	t.Run("memory", testStore(newMemoryStore()))
+	t.Run("sql", testStore(openTestStore(t)))
+}
+
+func serve(method, target string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func useMemoryStore(t *testing.T) *memoryStore {
+	saved := store
+	s := newMemoryStore()
+	store = s
+	t.Cleanup(func() { store = saved })
+	return s
+}
+
+func itemForm(token, type_ string, value float64) url.Values {
+	form := url.Values{"token": {token}, "id": {"shirt"}, "color": {"red"}, "size": {"M"},
+		"type": {type_}, "image_ids": {"img1"}}
+	for _, name := range paramNames {
+		form.Set(name, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	return form
+}
+
+func TestHandlersMemoryStore(t *testing.T) {
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1234", 0})
+	s.AddImage("t_1", "img1", "img1")
+
+	if body := serve("POST", prefix + "/update", itemForm("bad", "1", 600)).Body.String(); body != `{"error":"invalid_token"}` {
+		t.Fatalf("Unexpected /update response: %v", body)
+	}
+	for i, type_ := range []string{"1", "2", "3"} {
+		if body := serve("POST", prefix + "/update", itemForm("t_1", type_, float64(600 + i * 10))).Body.String(); body != `{"error":"","result":"","status":"created"}` {
+			t.Fatalf("Unexpected /update response: %v", body)
+		}
+	}
+	if body := serve("POST", prefix + "/update", itemForm("t_1", "1", 600)).Body.String(); body != `{"error":"invalid_id"}` {
+		t.Fatalf("Duplicate type accepted: %v", body)
+	}
+
+	form := itemForm("t_1", "4", 600)
+	form.Set("mode", "replace")
+	if body := serve("POST", prefix + "/update", form).Body.String(); body != `{"error":"invalid_id"}` {
+		t.Fatalf("Replaced a missing type: %v", body)
+	}
+	form.Set("mode", "upsert")
+	if body := serve("POST", prefix + "/update", form).Body.String(); body != `{"error":"","result":"","status":"created"}` {
+		t.Fatalf("Unexpected upsert response: %v", body)
+	}
+	form = itemForm("t_1", "4", 700)
+	form.Set("mode", "replace")
+	if body := serve("POST", prefix + "/update", form).Body.String(); body != `{"error":"","result":"","status":"updated"}` {
+		t.Fatalf("Unexpected replace response: %v", body)
+	}
+	form.Set("mode", "overwrite")
+	if body := serve("POST", prefix + "/update", form).Body.String(); body != `{"error":"invalid_request"}` {
+		t.Fatalf("Unknown mode accepted: %v", body)
+	}
+	s.CreateToken(tokenRow{"t_other", time.Now().Add(time.Hour).Unix(), "", "5678", 0})
+	form = itemForm("t_other", "4", 600)
+	form.Set("mode", "upsert")
+	if body := serve("POST", prefix + "/update", form).Body.String(); body != `{"error":"invalid_id"}` {
+		t.Fatalf("Overwrote another token's item: %v", body)
+	}
+
+	form = itemForm("", "", 611)
+	form.Set("shop_id", "1234")
+	body := serve("POST", prefix + "/get", form).Body.String()
+	if !strings.Contains(body, `"type":"2"`) || !strings.Contains(body, `"result":["img1"]`) {
+		t.Fatalf("Unexpected /get response: %v", body)
+	}
+	form.Set("shop_id", "0000")
+	if body = serve("POST", prefix + "/get", form).Body.String(); body != `{"error":"invalid_id"}` {
+		t.Fatalf("Unexpected /get response for unknown shop: %v", body)
+	}
+
+	if rec := serve("GET", prefix + "/dc-admin-p/items?token=t_1", nil); rec.Code != http.StatusMovedPermanently {
+		t.Fatalf("Unauthorized items request returned %d", rec.Code)
+	}
+}
+
+func TestSQLiteConcurrentWrites(t *testing.T) {
+	s := openTestSQLiteStore(t)
+
+	var mode string
+	if err := s.db.QueryRow("pragma journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Fatalf("journal_mode is %q, %v", mode, err)
+	}
+
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1", 0})
+	errs := make(chan error, 128)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			if _, err := s.IsValidToken("t_1"); err != nil {
+				errs <- err
+				return
+			}
+			_, err := s.AddImage("t_1", "img" + strconv.Itoa(i), "img" + strconv.Itoa(i))
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Concurrent write failed: %v", err)
+		}
+	}
+	if n, _ := s.ImagesCount("t_1"); n != cap(errs) {
+		t.Fatalf("ImagesCount returned %d", n)
+	}
+
+	a, _ := s.prepare("select exp_time from tokens where token = ?")
+	b, _ := s.prepare("select exp_time from tokens where token = ?")
+	if a != b {
+		t.Fatalf("Prepared statement wasn't reused")
+	}
+}
+
+func testDeleteItems(s Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1", 0})
+		s.CreateToken(tokenRow{"t_2", time.Now().Add(time.Hour).Unix(), "", "2", 0})
+		for _, id := range []string{"a", "b", "c"} {
+			s.AddImage("t_1", id, id)
+		}
+		add := func(token, item_id, color, type_ string, image_ids ...string) {
+			err := s.AddItem(itemRow{Token: token, itemKey: itemKey{item_id, color, "M", ""},
+				Type: type_, Params: testParams(0), Image_ids: image_ids})
+			if err != nil {
+				t.Fatalf("Error AddItem: %v", err)
+			}
+		}
+		add("t_1", "shirt", "red", "1", "a", "b")
+		add("t_1", "shirt", "red", "2", "b")
+		add("t_1", "shirt", "blue", "1", "c")
+		add("t_1", "dress", "red", "1", "c")
+		add("t_2", "shirt", "red", "1")
+
+		deleted, images, err := s.DeleteItems("t_1", deleteScopeType, itemKey{"shirt", "red", "M", ""}, "1", true)
+		if err != nil || deleted != 1 || strings.Join(images, ",") != "a" {
+			t.Fatalf("Deleting a type returned %d, %v, %v", deleted, images, err)
+		}
+		deleted, images, err = s.DeleteItems("t_1", deleteScopeKey, itemKey{"shirt", "red", "M", ""}, "", false)
+		if err != nil || deleted != 1 || len(images) != 0 {
+			t.Fatalf("Deleting a key returned %d, %v, %v", deleted, images, err)
+		}
+		if ok, _ := s.ImageExists("b"); !ok {
+			t.Fatalf("Image deleted without delete_images")
+		}
+		// "c" is still used by the dress
+		deleted, images, err = s.DeleteItems("t_1", deleteScopeItem, itemKey{Item_id: "shirt"}, "", true)
+		if err != nil || deleted != 1 || len(images) != 0 {
+			t.Fatalf("Deleting an item returned %d, %v, %v", deleted, images, err)
+		}
+		if n, _ := s.ItemsCount("t_2"); n != 1 {
+			t.Fatalf("Deleted another token's items")
+		}
+	}
+}
+
+func TestDeleteItems(t *testing.T) {
+	t.Run("memory", testDeleteItems(newMemoryStore()))
+	t.Run("sql", testDeleteItems(openTestStore(t)))
+
+	s := useMemoryStore(t)
+	s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1234", 0})
+	s.AddImage("t_1", "img1", "img1")
+	serve("POST", prefix + "/update", itemForm("t_1", "1", 600))
+
+	form := url.Values{"token": {"t_1"}, "id": {"shirt"}, "color": {"red"}, "size": {"M"}, "type": {"2"}}
+	if body := serve("POST", prefix + "/delete", form).Body.String(); body != `{"error":"invalid_id"}` {
+		t.Fatalf("Deleted a missing type: %v", body)
+	}
+	form.Set("type", "1")
+	form.Set("delete_images", "1")
+	if body := serve("POST", prefix + "/delete", form).Body.String(); body != `{"error":"","result":{"types":1,"images":["img1"]}}` {
+		t.Fatalf("Unexpected /delete response: %v", body)
+	}
+	form.Set("token", "bad")
+	if body := serve("POST", prefix + "/delete", form).Body.String(); body != `{"error":"invalid_token"}` {
+		t.Fatalf("Unexpected /delete response: %v", body)
+	}
+}
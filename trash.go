@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// purgeTrashedTokens deletes the tokens that were moved to the trash
+// more than retention ago, with their items, images and image files,
+// and returns the purged tokens.
+func purgeTrashedTokens(retention time.Duration) ([]string, error) {
+	before := time.Now().Add(-retention).Unix()
+	tokens, err := store.TrashedTokens(before)
+	if err != nil {
+		return nil, err
+	}
+
+	purged := []string{}
+	for _, token := range tokens {
+		// trashed tokens can't upload images, so the list stays complete
+		blobs, err := store.ImageBlobs(token)
+		if err != nil {
+			return purged, err
+		}
+		// the token may have been restored since the query
+		deleted, err := store.DeleteTrashedToken(token, before)
+		if err != nil {
+			return purged, err
+		}
+		if deleted {
+			released := []string{}
+			for _, blob_id := range blobs {
+				released = append(released, blob_id)
+			}
+			if err = releaseBlobs(released); err != nil {
+				return purged, err
+			}
+			purged = append(purged, token)
+		}
+	}
+	return purged, nil
+}
+
+// startTrashPurger runs purgeTrashedTokens every trashPurgeInterval
+// until the process exits.
+func startTrashPurger() {
+	if trashPurgeInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(trashPurgeInterval) {
+			purged, err := purgeTrashedTokens(trashRetention)
+			if err != nil {
+				log.Printf("Error purging trashed tokens: %v\n", err)
+			}
+			if len(purged) > 0 {
+				log.Printf("Purged %d tokens from the trash\n", len(purged))
+			}
+		}
+	}()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"time"
+	"testing"
+	"os"
+)
+
+func testTrashTokens(s Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		s.CreateToken(tokenRow{"t_1", time.Now().Add(time.Hour).Unix(), "", "1", 0})
+		s.AddImage("t_1", "img1", "img1")
+		key := itemKey{"shirt", "red", "M", ""}
+		s.AddItem(itemRow{Token: "t_1", Shop_id: "1", itemKey: key, Type: "1",
+			Params: testParams(0), Image_ids: []string{"img1"}})
+
+		if ok, err := s.TrashToken("t_1"); err != nil || !ok {
+			t.Fatalf("Error TrashToken: %v", err)
+		}
+		if ok, _ := s.TrashToken("t_1"); ok {
+			t.Fatalf("Trashed a token twice")
+		}
+		if ok, _ := s.IsValidToken("t_1"); ok {
+			t.Fatalf("Trashed token reported valid")
+		}
+		if ok, _ := s.IsValidImageID("img1"); ok {
+			t.Fatalf("Image of a trashed token reported valid")
+		}
+		if types, _ := s.ItemTypes("1", key); len(types) != 0 {
+			t.Fatalf("ItemTypes returned items of a trashed token")
+		}
+		// the token keeps its name and shop id while in the trash
+		if ok, _ := s.ShopIDExists("1"); !ok {
+			t.Fatalf("Shop id of a trashed token reported free")
+		}
+		tokens, _ := s.ListTokens()
+		if len(tokens) != 1 || tokens[0].Deleted_at == 0 {
+			t.Fatalf("ListTokens returned %v", tokens)
+		}
+
+		if trashed, _ := s.TrashedTokens(time.Now().Add(-time.Hour).Unix()); len(trashed) != 0 {
+			t.Fatalf("TrashedTokens returned a token inside the retention window")
+		}
+		if ok, _ := s.RestoreToken("t_1"); !ok {
+			t.Fatalf("RestoreToken failed")
+		}
+		if ok, _ := s.RestoreToken("t_1"); ok {
+			t.Fatalf("Restored an active token")
+		}
+		if types, _ := s.ItemTypes("1", key); len(types) != 1 || len(types[0].Image_ids) != 1 {
+			t.Fatalf("Items not restored: %v", types)
+		}
+
+		before := time.Now().Add(time.Minute).Unix()
+		if ok, _ := s.DeleteTrashedToken("t_1", before); ok {
+			t.Fatalf("Purged an active token")
+		}
+		s.TrashToken("t_1")
+		if trashed, _ := s.TrashedTokens(before); len(trashed) != 1 || trashed[0] != "t_1" {
+			t.Fatalf("TrashedTokens returned %v", trashed)
+		}
+		if ok, err := s.DeleteTrashedToken("t_1", before); err != nil || !ok {
+			t.Fatalf("Error DeleteTrashedToken: %v", err)
+		}
+		if ok, _ := s.TokenExists("t_1"); ok {
+			t.Fatalf("Token left after purge")
+		}
+		if ok, _ := s.ImageExists("img1"); ok {
+			t.Fatalf("Image left after purge")
+		}
+	}
+}
+
+func TestTrashTokens(t *testing.T) {
+	t.Run("memory", testTrashTokens(newMemoryStore()))
+	t.Run("sql", testTrashTokens(openTestStore(t)))
+}
+
+func TestPurgeTrashedTokens(t *testing.T) {
+	chdirTemp(t)
+	s := useMemoryStore(t)
+	for _, token := range []tokenRow{{"t_1", time.Now().Add(time.Hour).Unix(), "", "1", 0},
+		{"t_2", time.Now().Add(time.Hour).Unix(), "", "2", 0}} {
+		s.CreateToken(token)
+		s.AddImage(token.Token, "img_" + token.Token, "img_" + token.Token)
+		writeImageFiles(t, "img_" + token.Token)
+		s.TrashToken(token.Token)
+	}
+	s.RestoreToken("t_2")
+
+	if purged, _ := purgeTrashedTokens(time.Hour); len(purged) != 0 {
+		t.Fatalf("Purged tokens inside the retention window: %v", purged)
+	}
+	purged, err := purgeTrashedTokens(-time.Minute)
+	if err != nil || len(purged) != 1 || purged[0] != "t_1" {
+		t.Fatalf("purgeTrashedTokens returned %v, %v", purged, err)
+	}
+	if _, err = os.Stat("images/small/img_t_1.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("Image files of a purged token left")
+	}
+	if _, err = os.Stat("images/img_t_2.jpg"); err != nil {
+		t.Fatalf("Removed image files of a restored token")
+	}
+}